@@ -0,0 +1,611 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kinds of Rule
+const (
+	// Threshold compares a reading with Value
+	Threshold = "threshold"
+	// Rate compares the change in a reading per Per with Value
+	Rate = "rate"
+	// Absence fires when a meter sends nothing for Per
+	Absence = "absence"
+)
+
+// A Rule describes when to raise an alert, e.g. demand above 5 kW for
+// 10 minutes:
+//
+//	Rule{Name: "high demand", Kind: Threshold, Fragment: "InstantaneousDemand", Op: ">", Value: 5, For: 10 * time.Minute}
+//
+// ParseRule reads the same rules written more briefly.
+type Rule struct {
+	Name     string
+	Kind     string
+	Severity string
+	Meters   []string // only these meters; empty for all
+
+	// Fragment is the type of fragment the rule reads, e.g.
+	// InstantaneousDemand.  Absence rules may leave it empty to watch
+	// every fragment.
+	Fragment string
+
+	// Field is a packet field, e.g. Tier or LinkStrength, read as a
+	// number (hex or decimal).  If empty, the fragment's scaled Value
+	// is used.
+	Field string
+
+	// Op is one of > >= < <= == != and compares the reading with
+	// Value, or with Text if Text is set
+	Op    string
+	Value float64
+	Text  string
+
+	// For is how long the condition must hold before the alert fires
+	For time.Duration
+
+	// Per is the period of a Rate and how long an Absence lasts
+	Per time.Duration
+}
+
+// ParseRule reads a rule from its short form.  Examples:
+//
+//	InstantaneousDemand > 5 for 10m
+//	PriceCluster.Tier == 3
+//	NetworkInfo.LinkStrength < 0x40
+//	NetworkInfo.Status != "Connected" for 1m
+//	InstantaneousDemand rate > 2 per 5m
+//	absent 15m
+//	CurrentSummationDelivered absent 1h
+func ParseRule(name, s string) (Rule, error) {
+	r := Rule{Name: name, Kind: Threshold}
+	words := ruleWords(s)
+	bad := func() (Rule, error) {
+		return r, fmt.Errorf("Can't parse rule %s: %q", name, s)
+	}
+	if len(words) == 0 {
+		return bad()
+	}
+	if words[0] != "absent" {
+		r.Fragment = words[0]
+		if dot := strings.IndexByte(r.Fragment, '.'); dot >= 0 {
+			r.Field = r.Fragment[dot+1:]
+			r.Fragment = r.Fragment[:dot]
+		}
+		words = words[1:]
+	}
+	if len(words) == 2 && words[0] == "absent" {
+		d, err := time.ParseDuration(words[1])
+		if err != nil || r.Field != "" {
+			return bad()
+		}
+		r.Kind = Absence
+		r.Per = d
+		return r, r.validate()
+	}
+	if len(words) > 0 && words[0] == "rate" {
+		r.Kind = Rate
+		words = words[1:]
+	}
+	if len(words) < 2 {
+		return bad()
+	}
+	r.Op = words[0]
+	if strings.HasPrefix(words[1], `"`) {
+		text, err := strconv.Unquote(words[1])
+		if err != nil {
+			return bad()
+		}
+		r.Text = text
+	} else {
+		v, err := parseNumber(words[1])
+		if err != nil {
+			return bad()
+		}
+		r.Value = v
+	}
+	words = words[2:]
+	for len(words) >= 2 {
+		d, err := time.ParseDuration(words[1])
+		if err != nil {
+			return bad()
+		}
+		switch words[0] {
+		case "for":
+			r.For = d
+		case "per":
+			r.Per = d
+		default:
+			return bad()
+		}
+		words = words[2:]
+	}
+	if len(words) != 0 {
+		return bad()
+	}
+	return r, r.validate()
+}
+
+// ruleWords splits a rule at spaces, keeping quoted text together
+func ruleWords(s string) []string {
+	var result []string
+	word := -1
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				quoted = false
+			}
+		case c == ' ' || c == '\t':
+			if word >= 0 {
+				result = append(result, s[word:i])
+				word = -1
+			}
+			continue
+		case c == '"':
+			quoted = true
+		}
+		if word < 0 {
+			word = i
+		}
+	}
+	if word >= 0 {
+		result = append(result, s[word:])
+	}
+	return result
+}
+
+// parseNumber reads a decimal or 0x prefixed hex number
+func parseNumber(s string) (float64, error) {
+	if hexPattern.MatchString(s) {
+		v, err := strconv.ParseUint(s[2:], 16, 64)
+		return float64(v), err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func (r Rule) validate() error {
+	switch r.Kind {
+	case Absence:
+		if r.Per <= 0 {
+			return fmt.Errorf("Rule %s: absence needs a period", r.Name)
+		}
+		return nil
+	case Rate:
+		if r.Per <= 0 {
+			return fmt.Errorf("Rule %s: rate needs a period", r.Name)
+		}
+		if r.Text != "" {
+			return fmt.Errorf("Rule %s: rate of text", r.Name)
+		}
+	case Threshold:
+	default:
+		return fmt.Errorf("Rule %s: unknown kind %s", r.Name, r.Kind)
+	}
+	if r.Fragment == "" {
+		return fmt.Errorf("Rule %s: no fragment", r.Name)
+	}
+	if !IsFragmentName(r.Fragment) {
+		return fmt.Errorf("Rule %s: unknown fragment %s", r.Name, r.Fragment)
+	}
+	if r.Field != "" {
+		if _, ok := packetTypes[r.Fragment].FieldByName(r.Field); !ok {
+			return fmt.Errorf("Rule %s: %s has no field %s", r.Name, r.Fragment, r.Field)
+		}
+	}
+	switch r.Op {
+	case ">", ">=", "<", "<=":
+		if r.Text != "" {
+			return fmt.Errorf("Rule %s: %s can't compare text", r.Name, r.Op)
+		}
+	case "==", "!=":
+	default:
+		return fmt.Errorf("Rule %s: unknown operator %s", r.Name, r.Op)
+	}
+	return nil
+}
+
+// The state of an Alert
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+// An Alert is raised when a rule's condition holds for a meter, and
+// resolved when it stops holding
+type Alert struct {
+	Rule     string    `json:"rule"`
+	Severity string    `json:"severity,omitempty"`
+	Meter    string    `json:"meter"`
+	State    string    `json:"state"`
+	Message  string    `json:"message"`
+	Value    float64   `json:"value"`
+	Started  time.Time `json:"started"`
+	Ended    time.Time `json:"ended,omitempty"`
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("%s %s %s: %s", a.State, a.Rule, a.Meter, a.Message)
+}
+
+// A Notifier is told when alerts fire and resolve
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// NotifierFunc lets a function be used as a Notifier
+type NotifierFunc func(ctx context.Context, a Alert) error
+
+func (f NotifierFunc) Notify(ctx context.Context, a Alert) error {
+	return f(ctx, a)
+}
+
+// LogNotifier writes alerts to a logger, or the standard logger if
+// Logger is nil
+type LogNotifier struct {
+	Logger *log.Logger
+}
+
+func (l LogNotifier) Notify(ctx context.Context, a Alert) error {
+	if l.Logger != nil {
+		l.Logger.Print(a)
+	} else {
+		log.Print(a)
+	}
+	return nil
+}
+
+// The state of one rule for one meter
+type ruleState struct {
+	since  time.Time // when the condition started holding
+	alert  *Alert    // the firing alert, if any
+	value  float64   // the last value compared
+	last   float64   // the last reading, for rates
+	prev   time.Time // the time of the last reading, for rates
+	seen   time.Time // when the meter was last heard from
+	active bool      // whether the condition holds
+}
+
+type ruleKey struct {
+	rule  int
+	meter string
+}
+
+// An Engine evaluates rules against a stream of fragments and tells
+// its notifiers about alerts.  An alert is sent once when it fires and
+// once when it resolves.  An Engine is a Sink.
+type Engine struct {
+	// Now returns the current time; it may be replaced for replays
+	// and tests
+	Now func() time.Time
+
+	// Errors, if not nil, is called with errors from notifiers
+	Errors func(error)
+
+	rules     []Rule
+	notifiers []Notifier
+
+	mu    sync.Mutex
+	state map[ruleKey]*ruleState
+}
+
+// NewEngine checks the rules and returns an engine for them
+func NewEngine(rules []Rule, notifiers ...Notifier) (*Engine, error) {
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+	}
+	e := &Engine{
+		Now:       time.Now,
+		rules:     rules,
+		notifiers: notifiers,
+		state:     make(map[ruleKey]*ruleState),
+	}
+	// Meters named by absence rules are expected from the start
+	now := e.Now()
+	for i, r := range rules {
+		if r.Kind == Absence {
+			for _, m := range r.Meters {
+				e.state[ruleKey{i, NormalizeMac(m)}] = &ruleState{seen: now}
+			}
+		}
+	}
+	return e, nil
+}
+
+// Write evaluates the rules against frags
+func (e *Engine) Write(ctx context.Context, frags []Fragment) error {
+	var alerts []Alert
+	e.mu.Lock()
+	now := e.Now()
+	for _, f := range frags {
+		alerts = append(alerts, e.evaluate(f, now)...)
+	}
+	alerts = append(alerts, e.check(now)...)
+	e.mu.Unlock()
+	e.notify(ctx, alerts)
+	return nil
+}
+
+// Close does nothing
+func (e *Engine) Close() error {
+	return nil
+}
+
+// Check fires alerts that depend only on time passing: absences, and
+// conditions that have now held long enough.  Run calls it regularly.
+func (e *Engine) Check(ctx context.Context) {
+	e.mu.Lock()
+	alerts := e.check(e.Now())
+	e.mu.Unlock()
+	e.notify(ctx, alerts)
+}
+
+// Run calls Check every interval until ctx is done
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Active returns the alerts that are firing, oldest first
+func (e *Engine) Active() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var result []Alert
+	for _, s := range e.state {
+		if s.alert != nil {
+			result = append(result, *s.alert)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Started.Before(result[j].Started)
+	})
+	return result
+}
+
+func (e *Engine) notify(ctx context.Context, alerts []Alert) {
+	for _, a := range alerts {
+		for _, n := range e.notifiers {
+			if err := n.Notify(ctx, a); err != nil && e.Errors != nil {
+				e.Errors(err)
+			}
+		}
+	}
+}
+
+// evaluate applies a fragment to every rule; e.mu must be held
+func (e *Engine) evaluate(f Fragment, now time.Time) []Alert {
+	var alerts []Alert
+	meter := NormalizeMac(f.MeterMacId)
+	if meter == "" {
+		meter = NormalizeMac(f.DeviceMacId)
+	}
+	for i, r := range e.rules {
+		if !r.wants(meter) || (r.Fragment != "" && r.Fragment != f.Name) {
+			continue
+		}
+		key := ruleKey{i, meter}
+		s := e.state[key]
+		if s == nil {
+			s = &ruleState{}
+			e.state[key] = s
+		}
+		if r.Kind == Absence {
+			s.seen = now
+			if s.alert != nil {
+				alerts = append(alerts, e.resolve(s, now, "data received"))
+			}
+			continue
+		}
+
+		var holds bool
+		var value float64
+		var message string
+		if r.Text != "" {
+			text, ok := packetField(f.Packet, r.Field)
+			if !ok {
+				continue
+			}
+			holds = (text == r.Text) == (r.Op == "==")
+			message = fmt.Sprintf("%s.%s is %q", r.Fragment, r.Field, text)
+		} else {
+			v, ok := r.reading(f)
+			if !ok {
+				continue
+			}
+			if r.Kind == Rate {
+				// Readings are timed by when they were taken, so
+				// that replays and batches give rates too
+				at := f.Time
+				if at.IsZero() {
+					at = now
+				}
+				last, lastTime := s.last, s.prev
+				s.last, s.prev = v, at
+				if lastTime.IsZero() || !at.After(lastTime) {
+					continue
+				}
+				v = (v - last) / float64(at.Sub(lastTime)) * float64(r.Per)
+				message = fmt.Sprintf("%s changing by %g per %s", r.describe(), v, r.Per)
+			} else {
+				message = fmt.Sprintf("%s is %g", r.describe(), v)
+			}
+			holds = compare(v, r.Op, r.Value)
+			value = v
+		}
+
+		if !holds {
+			s.active = false
+			if s.alert != nil {
+				alerts = append(alerts, e.resolve(s, now, message))
+			}
+			continue
+		}
+		if !s.active {
+			s.active = true
+			s.since = now
+		}
+		s.value = value
+		if s.alert != nil {
+			s.alert.Value = value
+			continue
+		}
+		if now.Sub(s.since) >= r.For {
+			s.alert = &Alert{
+				Rule:     r.Name,
+				Severity: r.Severity,
+				Meter:    meter,
+				State:    Firing,
+				Message:  message,
+				Value:    value,
+				Started:  s.since,
+			}
+			alerts = append(alerts, *s.alert)
+		}
+	}
+	return alerts
+}
+
+// check fires absences and conditions that have held long enough;
+// e.mu must be held
+func (e *Engine) check(now time.Time) []Alert {
+	var alerts []Alert
+	for key, s := range e.state {
+		r := e.rules[key.rule]
+		if s.alert != nil {
+			continue
+		}
+		switch {
+		case r.Kind == Absence && now.Sub(s.seen) >= r.Per:
+			s.alert = &Alert{
+				Rule:     r.Name,
+				Severity: r.Severity,
+				Meter:    key.meter,
+				State:    Firing,
+				Message:  fmt.Sprintf("nothing since %s", s.seen.Format(time.RFC3339)),
+				Started:  s.seen,
+			}
+			alerts = append(alerts, *s.alert)
+		case r.Kind != Absence && s.active && r.For > 0 && now.Sub(s.since) >= r.For:
+			limit := strconv.FormatFloat(r.Value, 'g', -1, 64)
+			if r.Text != "" {
+				limit = strconv.Quote(r.Text)
+			}
+			what := r.describe()
+			if r.Kind == Rate {
+				what += " rate"
+				limit += " per " + r.Per.String()
+			}
+			s.alert = &Alert{
+				Rule:     r.Name,
+				Severity: r.Severity,
+				Meter:    key.meter,
+				State:    Firing,
+				Message:  fmt.Sprintf("%s %s %s for %s", what, r.Op, limit, r.For),
+				Value:    s.value,
+				Started:  s.since,
+			}
+			alerts = append(alerts, *s.alert)
+		}
+	}
+	return alerts
+}
+
+// resolve ends the alert in s
+func (e *Engine) resolve(s *ruleState, now time.Time, message string) Alert {
+	a := *s.alert
+	a.State = Resolved
+	a.Ended = now
+	a.Message = message
+	s.alert = nil
+	return a
+}
+
+func (r Rule) wants(meter string) bool {
+	if len(r.Meters) == 0 {
+		return true
+	}
+	for _, m := range r.Meters {
+		if SameMac(m, meter) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) describe() string {
+	if r.Field != "" {
+		return r.Fragment + "." + r.Field
+	}
+	return r.Fragment
+}
+
+// reading returns the number the rule looks at
+func (r Rule) reading(f Fragment) (float64, bool) {
+	if r.Field == "" {
+		return f.Value()
+	}
+	s, ok := packetField(f.Packet, r.Field)
+	if !ok {
+		return 0, false
+	}
+	v, err := parseNumber(s)
+	return v, err == nil
+}
+
+// packetField returns a string field of a packet by name
+func packetField(packet interface{}, field string) (string, bool) {
+	v := reflect.ValueOf(packet)
+	if v.Kind() != reflect.Struct {
+		return "", false
+	}
+	f := v.FieldByName(field)
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return "", false
+	}
+	return f.String(), true
+}
+
+func compare(a float64, op string, b float64) bool {
+	switch op {
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	}
+	return false
+}
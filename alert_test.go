@@ -0,0 +1,164 @@
+package rainforestCommon
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	good := map[string]Rule{
+		"InstantaneousDemand > 5 for 10m":       {Kind: Threshold, Fragment: "InstantaneousDemand", Op: ">", Value: 5, For: 10 * time.Minute},
+		"PriceCluster.Tier == 3":                {Kind: Threshold, Fragment: "PriceCluster", Field: "Tier", Op: "==", Value: 3},
+		"NetworkInfo.LinkStrength < 0x40":       {Kind: Threshold, Fragment: "NetworkInfo", Field: "LinkStrength", Op: "<", Value: 64},
+		`NetworkInfo.Status != "Join: Success"`: {Kind: Threshold, Fragment: "NetworkInfo", Field: "Status", Op: "!=", Text: "Join: Success"},
+		"InstantaneousDemand rate > 2 per 5m":   {Kind: Rate, Fragment: "InstantaneousDemand", Op: ">", Value: 2, Per: 5 * time.Minute},
+		"absent 15m":                            {Kind: Absence, Per: 15 * time.Minute},
+	}
+	for s, want := range good {
+		r, err := ParseRule("", s)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fmt.Sprint(r) != fmt.Sprint(want) {
+			t.Error("Expected ", want, " got ", r)
+		}
+	}
+	for _, s := range []string{"", "Demand > 5", "PriceCluster.Nothing == 3", "InstantaneousDemand ~ 5", "InstantaneousDemand rate > 2", "InstantaneousDemand > 5 for"} {
+		if _, err := ParseRule("", s); err == nil {
+			t.Error("Expected an error for ", s)
+		}
+	}
+}
+
+// demandAt returns a demand fragment for kw kilowatts
+func demandAt(kw int) Fragment {
+	f, _ := NewFragment(InstantaneousDemand{
+		XMLName:    xml.Name{Local: "InstantaneousDemand"},
+		MeterMacId: "0x01",
+		Demand:     fmt.Sprintf("0x%06x", kw),
+		Multiplier: "0x00000001",
+		Divisor:    "0x00000001",
+	})
+	return f
+}
+
+func TestEngine(t *testing.T) {
+	high, _ := ParseRule("high", "InstantaneousDemand > 5 for 10m")
+	quiet, _ := ParseRule("quiet", "absent 15m")
+	var alerts []Alert
+	e, err := NewEngine([]Rule{high, quiet}, NotifierFunc(func(ctx context.Context, a Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := targetTimeU
+	e.Now = func() time.Time { return now }
+	ctx := context.Background()
+
+	e.Write(ctx, []Fragment{demandAt(6)})
+	now = now.Add(5 * time.Minute)
+	e.Write(ctx, []Fragment{demandAt(7)})
+	if len(alerts) != 0 {
+		t.Fatal("Expected no alerts before 10 minutes got ", alerts)
+	}
+	now = now.Add(6 * time.Minute)
+	e.Check(ctx)
+	e.Write(ctx, []Fragment{demandAt(8)})
+	if len(alerts) != 1 || alerts[0].Rule != "high" || alerts[0].State != Firing {
+		t.Fatal("Expected one high demand alert got ", alerts)
+	}
+	if len(e.Active()) != 1 {
+		t.Error("Expected one active alert got ", e.Active())
+	}
+	e.Write(ctx, []Fragment{demandAt(2)})
+	if len(alerts) != 2 || alerts[1].State != Resolved {
+		t.Fatal("Expected the alert to resolve got ", alerts)
+	}
+
+	now = now.Add(20 * time.Minute)
+	e.Check(ctx)
+	if len(alerts) != 3 || alerts[2].Rule != "quiet" {
+		t.Fatal("Expected an absence alert got ", alerts)
+	}
+	e.Check(ctx)
+	if len(alerts) != 3 {
+		t.Error("Expected the absence alert only once got ", alerts)
+	}
+	e.Write(ctx, []Fragment{demandAt(2)})
+	if len(alerts) != 4 || alerts[3].Rule != "quiet" || alerts[3].State != Resolved {
+		t.Error("Expected the absence to resolve got ", alerts)
+	}
+}
+
+func TestEngineRate(t *testing.T) {
+	jump, _ := ParseRule("jump", "InstantaneousDemand rate > 2 per 1m")
+	var alerts []Alert
+	e, _ := NewEngine([]Rule{jump}, NotifierFunc(func(ctx context.Context, a Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	}))
+	now := targetTimeU
+	e.Now = func() time.Time { return now }
+	ctx := context.Background()
+
+	e.Write(ctx, []Fragment{demandAt(1)})
+	now = now.Add(time.Minute)
+	e.Write(ctx, []Fragment{demandAt(2)})
+	now = now.Add(30 * time.Second)
+	e.Write(ctx, []Fragment{demandAt(4)})
+	if len(alerts) != 1 || alerts[0].Value != 4 {
+		t.Error("Expected a rate alert of 4 per minute got ", alerts)
+	}
+}
+
+func TestEngineRateReplay(t *testing.T) {
+	jump, _ := ParseRule("jump", "InstantaneousDemand rate > 2 per 1m")
+	var alerts []Alert
+	e, _ := NewEngine([]Rule{jump}, NotifierFunc(func(ctx context.Context, a Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	}))
+	e.Now = func() time.Time { return targetTimeU.Add(time.Hour) }
+
+	// One batch of readings taken a minute apart
+	e.Write(context.Background(), []Fragment{
+		demandFragment(targetTimeU, 1000),
+		demandFragment(targetTimeU.Add(time.Minute), 2000),
+		demandFragment(targetTimeU.Add(2*time.Minute), 5000),
+	})
+	if len(alerts) != 1 || alerts[0].Value != 3 {
+		t.Error("Expected a rate alert of 3 per minute got ", alerts)
+	}
+}
+
+func TestEngineRateFor(t *testing.T) {
+	jump, _ := ParseRule("jump", "InstantaneousDemand rate > 2 per 1m for 5m")
+	var alerts []Alert
+	e, _ := NewEngine([]Rule{jump}, NotifierFunc(func(ctx context.Context, a Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	}))
+	now := targetTimeU
+	e.Now = func() time.Time { return now }
+	ctx := context.Background()
+
+	e.Write(ctx, []Fragment{demandAt(1)})
+	now = now.Add(time.Minute)
+	e.Write(ctx, []Fragment{demandAt(4)})
+	now = now.Add(time.Minute)
+	e.Write(ctx, []Fragment{demandAt(8)})
+	if len(alerts) != 0 {
+		t.Fatal("Expected the alert to wait 5m got ", alerts)
+	}
+	now = now.Add(5 * time.Minute)
+	e.Check(ctx)
+	if len(alerts) != 1 || alerts[0].State != Firing || !alerts[0].Started.Equal(targetTimeU.Add(time.Minute)) {
+		t.Error("Expected the rate alert to fire after 5m got ", alerts)
+	}
+}
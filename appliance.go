@@ -0,0 +1,282 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An ApplianceEvent is something switching on at Start and off at End,
+// drawing KW while it ran
+type ApplianceEvent struct {
+	MeterMacId string        `json:"meterMacId"`
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	KW         float64       `json:"kw"`
+	Duration   time.Duration `json:"duration"`
+	KWh        float64       `json:"kWh"`
+	Cluster    int           `json:"cluster"`
+	Label      string        `json:"label,omitempty"`
+}
+
+// An ApplianceCluster is a group of events of about the same power,
+// which are probably the same appliance
+type ApplianceCluster struct {
+	Id         int           `json:"id"`
+	MeterMacId string        `json:"meterMacId"`
+	KW         float64       `json:"kw"` // mean
+	Events     int           `json:"events"`
+	Duration   time.Duration `json:"duration"` // mean
+	KWh        float64       `json:"kWh"`      // total
+	Label      string        `json:"label,omitempty"`
+}
+
+// An ApplianceLabel names the appliance that draws KW
+type ApplianceLabel struct {
+	Name string  `json:"name"`
+	KW   float64 `json:"kw"`
+}
+
+// An ApplianceDetector watches InstantaneousDemand, ideally fast
+// polled, for steps up and down and pairs them into appliance events.
+// A step is a change of at least MinStep that holds for the following
+// reading; one that doesn't is taken as noise.  A step down is matched
+// to the step up closest to it in power, within Tolerance, that is no
+// more than MaxDuration old.  Loads that overlap are told apart only
+// by their power, so this is a guide rather than a measurement.  An
+// ApplianceDetector is a Sink.
+type ApplianceDetector struct {
+	// MinStep is the smallest change counted, 0.3 kW if zero
+	MinStep float64
+
+	// Tolerance is how far apart, as a fraction, steps up and down
+	// and the events in a cluster can be, 0.2 if zero
+	Tolerance float64
+
+	// MaxDuration is the longest an appliance is taken to run, 12
+	// hours if zero
+	MaxDuration time.Duration
+
+	// Labels name the appliances of known power
+	Labels []ApplianceLabel
+
+	// Events, if not nil, is called with each event as it ends
+	Events func(ApplianceEvent)
+
+	mu     sync.Mutex
+	meters map[string]*applianceState
+}
+
+type applianceState struct {
+	level   float64
+	pending *applianceStep
+	on      []applianceStep
+}
+
+// applianceStep is a change in demand from before to after at time
+type applianceStep struct {
+	time          time.Time
+	before, after float64
+}
+
+// NewApplianceDetector returns a detector that has seen no demand
+func NewApplianceDetector() *ApplianceDetector {
+	return &ApplianceDetector{meters: make(map[string]*applianceState)}
+}
+
+func (d *ApplianceDetector) minStep() float64 {
+	if d.MinStep > 0 {
+		return d.MinStep
+	}
+	return 0.3
+}
+
+func (d *ApplianceDetector) tolerance() float64 {
+	if d.Tolerance > 0 {
+		return d.Tolerance
+	}
+	return 0.2
+}
+
+// Write adds the demand in frags
+func (d *ApplianceDetector) Write(ctx context.Context, frags []Fragment) error {
+	for _, f := range frags {
+		d.Add(f)
+	}
+	return nil
+}
+
+// Close does nothing
+func (d *ApplianceDetector) Close() error {
+	return nil
+}
+
+// Add adds one demand reading, which should be later than the meter's
+// last, and returns the event it ends, if any
+func (d *ApplianceDetector) Add(f Fragment) (e ApplianceEvent, ok bool) {
+	p, isDemand := f.Packet.(InstantaneousDemand)
+	if !isDemand || f.Time.IsZero() {
+		return ApplianceEvent{}, false
+	}
+	kw, valid := demandKW(p)
+	if !valid {
+		return ApplianceEvent{}, false
+	}
+	meter := NormalizeMac(f.MeterMacId)
+
+	d.mu.Lock()
+	if d.meters == nil {
+		d.meters = make(map[string]*applianceState)
+	}
+	s := d.meters[meter]
+	if s == nil {
+		s = &applianceState{level: kw}
+		d.meters[meter] = s
+		d.mu.Unlock()
+		return ApplianceEvent{}, false
+	}
+	min := d.minStep()
+	var step *applianceStep
+	if s.pending != nil {
+		if math.Abs(kw-s.pending.after) < min/2 {
+			step = s.pending
+		}
+		s.pending = nil
+	}
+	switch {
+	case step != nil:
+		s.level = kw
+		e, ok = d.step(s, meter, *step)
+	case math.Abs(kw-s.level) >= min:
+		s.pending = &applianceStep{time: f.Time, before: s.level, after: kw}
+	default:
+		s.level = kw
+	}
+	d.mu.Unlock()
+
+	if ok && d.Events != nil {
+		d.Events(e)
+	}
+	return e, ok
+}
+
+// step records a step up, or matches a step down to one
+func (d *ApplianceDetector) step(s *applianceState, meter string, step applianceStep) (ApplianceEvent, bool) {
+	maxDuration := orDefault(d.MaxDuration, 12*time.Hour)
+	on := s.on[:0]
+	for _, o := range s.on {
+		if step.time.Sub(o.time) <= maxDuration {
+			on = append(on, o)
+		}
+	}
+	s.on = on
+
+	delta := step.after - step.before
+	if delta > 0 {
+		s.on = append(s.on, step)
+		return ApplianceEvent{}, false
+	}
+	best, bestDiff := -1, 0.0
+	for i, o := range s.on {
+		up := o.after - o.before
+		diff := math.Abs(up + delta)
+		if diff <= d.tolerance()*math.Max(up, -delta) && (best < 0 || diff <= bestDiff) {
+			best, bestDiff = i, diff
+		}
+	}
+	if best < 0 {
+		return ApplianceEvent{}, false
+	}
+	o := s.on[best]
+	s.on = append(s.on[:best], s.on[best+1:]...)
+	e := ApplianceEvent{
+		MeterMacId: meter,
+		Start:      o.time,
+		End:        step.time,
+		KW:         (o.after - o.before - delta) / 2,
+		Duration:   step.time.Sub(o.time),
+	}
+	e.KWh = e.KW * e.Duration.Hours()
+	e.Cluster, e.Label = -1, d.label(e.KW)
+	return e, true
+}
+
+// label returns the name of the labelled appliance nearest kw, within
+// Tolerance
+func (d *ApplianceDetector) label(kw float64) string {
+	name, best := "", 0.0
+	for _, l := range d.Labels {
+		diff := math.Abs(kw - l.KW)
+		if diff <= d.tolerance()*l.KW && (name == "" || diff < best) {
+			name, best = l.Name, diff
+		}
+	}
+	return name
+}
+
+// Detect returns the events in frags, which should be in time order,
+// using a new detector with d's settings
+func (d *ApplianceDetector) Detect(frags []Fragment) []ApplianceEvent {
+	n := NewApplianceDetector()
+	n.MinStep, n.Tolerance, n.MaxDuration, n.Labels = d.MinStep, d.Tolerance, d.MaxDuration, d.Labels
+	var events []ApplianceEvent
+	for _, f := range frags {
+		if e, ok := n.Add(f); ok {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Cluster groups each meter's events by power, sets their Cluster to
+// the index of their group in the result, and labels the groups.  A
+// group holds events within Tolerance of its smallest.
+func (d *ApplianceDetector) Cluster(events []ApplianceEvent) []ApplianceCluster {
+	order := make([]int, len(events))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := events[order[i]], events[order[j]]
+		if a.MeterMacId != b.MeterMacId {
+			return a.MeterMacId < b.MeterMacId
+		}
+		return a.KW < b.KW
+	})
+
+	var clusters []ApplianceCluster
+	var floor float64
+	for _, i := range order {
+		e := &events[i]
+		n := len(clusters)
+		if n == 0 || clusters[n-1].MeterMacId != e.MeterMacId || e.KW > floor*(1+d.tolerance()) {
+			clusters = append(clusters, ApplianceCluster{Id: n, MeterMacId: e.MeterMacId})
+			floor = e.KW
+			n++
+		}
+		c := &clusters[n-1]
+		c.Events++
+		c.KW += e.KW
+		c.Duration += e.Duration
+		c.KWh += e.KWh
+		e.Cluster = c.Id
+	}
+	for i := range clusters {
+		c := &clusters[i]
+		c.KW /= float64(c.Events)
+		c.Duration /= time.Duration(c.Events)
+		c.Label = d.label(c.KW)
+	}
+	for i := range events {
+		if c := events[i].Cluster; c >= 0 && c < len(clusters) {
+			events[i].Label = clusters[c].Label
+		}
+	}
+	return clusters
+}
@@ -0,0 +1,59 @@
+package rainforestCommon
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestApplianceDetector(t *testing.T) {
+	// Every 10 seconds for three hours: 200 W always on, a 1.1 kW
+	// pump three times for 10 minutes, once while a 4.5 kW dryer runs
+	// for 50 minutes, and a one reading spike
+	var frags []Fragment
+	for i := 0; i < 3*360; i++ {
+		minute := i / 6
+		watts := 200
+		if minute >= 60 && minute < 110 {
+			watts += 4500
+		}
+		if minute%60 >= 20 && minute%60 < 30 {
+			watts += 1100
+		}
+		if i == 100 {
+			watts += 3000
+		}
+		frags = append(frags, demandFragment(targetTimeU.Add(time.Duration(i)*10*time.Second), watts))
+	}
+
+	d := &ApplianceDetector{Labels: []ApplianceLabel{{Name: "dryer", KW: 4.4}}}
+	events := d.Detect(frags)
+	if len(events) != 4 {
+		t.Fatal("Expected 4 events got ", events)
+	}
+	clusters := d.Cluster(events)
+	if len(clusters) != 2 {
+		t.Fatal("Expected two clusters got ", clusters)
+	}
+	pump, dryer := clusters[0], clusters[1]
+	if pump.Events != 3 || math.Abs(pump.KW-1.1) > 1e-9 || pump.Duration != 10*time.Minute || pump.Label != "" {
+		t.Error("Expected the pump three times got ", pump)
+	}
+	if dryer.Events != 1 || math.Abs(dryer.KWh-4.5*50/60) > 1e-9 || dryer.Label != "dryer" {
+		t.Error("Expected the dryer once got ", dryer)
+	}
+	for _, e := range events {
+		if e.KW > 4 && (e.Label != "dryer" || !e.Start.Equal(targetTimeU.Add(time.Hour))) {
+			t.Error("Expected the dryer event labelled got ", e)
+		}
+	}
+
+	// A detector made without NewApplianceDetector works as a Sink
+	var ended int
+	var sink Sink = &ApplianceDetector{Events: func(ApplianceEvent) { ended++ }}
+	sink.Write(context.Background(), frags)
+	if ended != 4 {
+		t.Error("Expected 4 events from the sink got ", ended)
+	}
+}
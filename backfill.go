@@ -0,0 +1,332 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Span is a period of time, [Start, End)
+type Span struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// The fragments that hold summations, which history fills in
+var summationNames = []string{"CurrentSummation", "CurrentSummationDelivered"}
+
+// A Backfill fills gaps in a meter's summations in a FileStore by
+// asking the eagle or RAVEn for its history.  Gaps are split into
+// chunks of at most Chunk, requested one at a time with Delay between
+// them.  Chunks still to be requested, and those requested whose
+// history hasn't been merged yet, are kept in StateFile, so a backfill
+// that is stopped resumes where it left off.
+//
+// A RAVEn sends history on its stream rather than in reply to the
+// command, so with a Raven the Backfill must also be written the
+// fragments read from the port; it is a Sink for that purpose.
+// Merging is idempotent: summations already in the store are skipped.
+type Backfill struct {
+	Commander Commander
+	Store     *FileStore
+	MacId     string
+
+	// Interval is how often the meter records a summation, 15 minutes
+	// if zero.  Gaps longer than twice Interval are filled, one
+	// summation every Interval.
+	Interval time.Duration
+
+	// Chunk is the longest period per request, 6 hours if zero, and
+	// Delay the wait between requests, 10 seconds if zero
+	Chunk time.Duration
+	Delay time.Duration
+
+	// StateFile, if not empty, is where progress is kept
+	StateFile string
+
+	mu    sync.Mutex // serializes merges and guards state
+	state *backfillState
+}
+
+// backfillState is what is kept in StateFile: the range being filled,
+// the chunks still to be requested and those requested whose history
+// hasn't arrived
+type backfillState struct {
+	MacId   string    `json:"macId"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	Chunks  []Span    `json:"chunks"`
+	Pending []Span    `json:"pending,omitempty"`
+}
+
+func (b *Backfill) interval() time.Duration {
+	return orDefault(b.Interval, 15*time.Minute)
+}
+
+// Gaps returns the periods in [since, until) with no summation for
+// more than twice Interval
+func (b *Backfill) Gaps(since, until time.Time) ([]Span, error) {
+	frags, err := b.Store.Read(b.MacId, since, until, Filter{Names: summationNames})
+	if err != nil {
+		return nil, err
+	}
+	var gaps []Span
+	last := since
+	limit := 2 * b.interval()
+	for _, f := range frags {
+		if f.Time.Sub(last) > limit {
+			gaps = append(gaps, Span{last, f.Time})
+		}
+		last = f.Time
+	}
+	if until.Sub(last) > limit {
+		gaps = append(gaps, Span{last, until})
+	}
+	return gaps, nil
+}
+
+// Chunks splits spans into pieces no longer than Chunk
+func (b *Backfill) Chunks(spans []Span) []Span {
+	size := orDefault(b.Chunk, 6*time.Hour)
+	var result []Span
+	for _, s := range spans {
+		for start := s.Start; start.Before(s.End); start = start.Add(size) {
+			end := start.Add(size)
+			if end.After(s.End) {
+				end = s.End
+			}
+			result = append(result, Span{start, end})
+		}
+	}
+	return result
+}
+
+// Run fills the gaps in [since, until).  If StateFile holds chunks left
+// from an earlier run over the same range they are requested instead,
+// starting with those whose history never arrived; it is an error if
+// it holds a different range.  Run returns when every chunk has been
+// requested, when a request fails, or when ctx is done.  A chunk stays
+// in StateFile until summations in it are merged, which with a RAVEn
+// may be after Run returns.
+func (b *Backfill) Run(ctx context.Context, since, until time.Time) error {
+	state, err := b.load()
+	if err != nil {
+		return err
+	}
+	if state != nil && (!state.Since.Equal(since) || !state.Until.Equal(until)) {
+		return fmt.Errorf("Backfill state in %s is for %s to %s; remove it to fill %s to %s",
+			b.StateFile, state.Since.Format(time.RFC3339), state.Until.Format(time.RFC3339),
+			since.Format(time.RFC3339), until.Format(time.RFC3339))
+	}
+	if state == nil {
+		gaps, err := b.Gaps(since, until)
+		if err != nil {
+			return err
+		}
+		state = &backfillState{MacId: b.MacId, Since: since, Until: until, Chunks: b.Chunks(gaps)}
+	} else {
+		state.Chunks = append(state.Pending, state.Chunks...)
+		state.Pending = nil
+	}
+	b.mu.Lock()
+	b.state = state
+	err = b.save()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	delay := orDefault(b.Delay, 10*time.Second)
+	for i := 0; ; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		// The chunk is pending from before it is asked for until its
+		// history is merged
+		b.mu.Lock()
+		if len(b.state.Chunks) == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		c := b.state.Chunks[0]
+		b.state.Chunks = b.state.Chunks[1:]
+		b.state.Pending = append(b.state.Pending, c)
+		err := b.save()
+		b.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		cmd, err := GetHistoryData(b.MacId, c.Start, c.End, b.interval())
+		if err != nil {
+			return err
+		}
+		frags, err := b.Commander.Command(ctx, cmd)
+		if err != nil {
+			return err
+		}
+		if err := b.Merge(frags); err != nil {
+			return err
+		}
+	}
+}
+
+// Write merges the history in frags; see Merge
+func (b *Backfill) Write(ctx context.Context, frags []Fragment) error {
+	return b.Merge(frags)
+}
+
+// Close does nothing
+func (b *Backfill) Close() error {
+	return nil
+}
+
+// Merge adds the summations in frags, including those in HistoryData,
+// to the store, skipping any that are already there, and drops the
+// chunks they fall in from StateFile
+func (b *Backfill) Merge(frags []Fragment) error {
+	var summations []Fragment
+	for _, f := range expandHistory(frags) {
+		if b.MacId != "" && f.MeterMacId != "" && !SameMac(b.MacId, f.MeterMacId) {
+			continue
+		}
+		if _, ok := f.Packet.(CurrentSummation); ok && !f.Time.IsZero() {
+			summations = append(summations, f)
+		}
+	}
+	if len(summations) == 0 {
+		return nil
+	}
+	sort.SliceStable(summations, func(i, j int) bool {
+		return summations[i].Time.Before(summations[j].Time)
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	type key struct {
+		meter string
+		time  time.Time
+	}
+	seen := make(map[key]bool)
+	loaded := make(map[string]bool)
+	first, last := summations[0].Time, summations[len(summations)-1].Time
+	var fresh []Fragment
+	for _, f := range summations {
+		meter := NormalizeMac(f.MeterMacId)
+		if !loaded[meter] {
+			// Load what the store already has for this meter
+			loaded[meter] = true
+			stored, err := b.Store.Read(meter, first, last.Add(time.Second), Filter{Names: []string{"CurrentSummation"}})
+			if err != nil {
+				return err
+			}
+			for _, s := range stored {
+				seen[key{meter, s.Time.UTC()}] = true
+			}
+		}
+		k := key{meter, f.Time.UTC()}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		fresh = append(fresh, f)
+	}
+	if err := b.Store.Write(context.Background(), fresh); err != nil {
+		return err
+	}
+	return b.settle(summations)
+}
+
+// settle drops the pending chunks that summations fall in, now that
+// their history has arrived; b.mu must be held
+func (b *Backfill) settle(summations []Fragment) error {
+	if b.state == nil || len(b.state.Pending) == 0 {
+		return nil
+	}
+	var pending []Span
+	for _, c := range b.state.Pending {
+		arrived := false
+		for _, f := range summations {
+			if !f.Time.Before(c.Start) && f.Time.Before(c.End) {
+				arrived = true
+				break
+			}
+		}
+		if !arrived {
+			pending = append(pending, c)
+		}
+	}
+	if len(pending) == len(b.state.Pending) {
+		return nil
+	}
+	b.state.Pending = pending
+	return b.save()
+}
+
+// load returns the state left in StateFile for this meter, or nil
+func (b *Backfill) load() (*backfillState, error) {
+	if b.StateFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(b.StateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s backfillState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if !SameMac(s.MacId, b.MacId) || len(s.Chunks)+len(s.Pending) == 0 {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+// save replaces StateFile with the state; b.mu must be held
+func (b *Backfill) save() error {
+	if b.StateFile == "" {
+		return nil
+	}
+	if b.state == nil || len(b.state.Chunks)+len(b.state.Pending) == 0 {
+		err := os.Remove(b.StateFile)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	data, err := json.Marshal(b.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(b.StateFile), filepath.Base(b.StateFile))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), b.StateFile)
+}
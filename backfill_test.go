@@ -0,0 +1,185 @@
+package rainforestCommon
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// summationAt returns a summation of the meter's reading at t, which
+// rises by a kWh every 15 minutes
+func summationAt(t time.Time) CurrentSummation {
+	stamp, _ := EncodeMeterTime(t)
+	return CurrentSummation{
+		XMLName:            xml.Name{Local: "CurrentSummation"},
+		MeterMacId:         "0x01",
+		TimeStamp:          stamp,
+		SummationDelivered: fmt.Sprintf("0x%016x", t.Sub(targetTimeU)/(15*time.Minute)*1000),
+		Multiplier:         "0x00000001",
+		Divisor:            "0x000003e8",
+	}
+}
+
+// historyMeter answers get_history_data, failing once after fail
+// requests if fail isn't zero
+type historyMeter struct {
+	requests int
+	fail     int
+}
+
+func (m *historyMeter) Command(ctx context.Context, cmd LocalCommand) ([]Fragment, error) {
+	m.requests++
+	if m.requests == m.fail {
+		return nil, errors.New("busy")
+	}
+	start, _ := DecodeMeterTime(cmd.StartTime)
+	end, _ := DecodeMeterTime(cmd.EndTime)
+	h := HistoryData{XMLName: xml.Name{Local: "HistoryData"}}
+	for t := start; t.Before(end); t = t.Add(15 * time.Minute) {
+		h.SummationList = append(h.SummationList, summationAt(t))
+	}
+	f, err := NewFragment(h)
+	return []Fragment{f}, err
+}
+
+func TestBackfill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &FileStore{Dir: dir}
+
+	// Two hours of summations, eight missing, then two more
+	var frags []Fragment
+	for i := 0; i < 48; i++ {
+		if i >= 8 && i < 40 {
+			continue
+		}
+		f, _ := NewFragment(summationAt(targetTimeU.Add(time.Duration(i) * 15 * time.Minute)))
+		frags = append(frags, f)
+	}
+	store.Write(context.Background(), frags)
+
+	m := &historyMeter{fail: 2}
+	b := &Backfill{
+		Commander: m,
+		Store:     store,
+		MacId:     "0x01",
+		Chunk:     3 * time.Hour,
+		Delay:     time.Millisecond,
+		StateFile: filepath.Join(dir, "backfill.json"),
+	}
+	since, until := targetTimeU, targetTimeU.Add(12*time.Hour)
+	gaps, _ := b.Gaps(since, until)
+	if len(gaps) != 1 || !gaps[0].Start.Equal(since.Add(105*time.Minute)) || !gaps[0].End.Equal(since.Add(10*time.Hour)) {
+		t.Fatal("Expected one gap got ", gaps)
+	}
+
+	if err := b.Run(context.Background(), since, until); err == nil {
+		t.Fatal("Expected the second request to fail")
+	}
+	if _, err := os.Stat(b.StateFile); err != nil {
+		t.Fatal("Expected the remaining chunks to be saved: ", err)
+	}
+
+	// Resume with the two chunks that are left
+	if err := b.Run(context.Background(), since, until); err != nil {
+		t.Fatal(err)
+	}
+	if m.requests != 4 {
+		t.Error("Expected 4 requests got ", m.requests)
+	}
+	if _, err := os.Stat(b.StateFile); !os.IsNotExist(err) {
+		t.Error("Expected the state file to be removed")
+	}
+	if gaps, _ := b.Gaps(since, until); len(gaps) != 0 {
+		t.Error("Expected no gaps got ", gaps)
+	}
+
+	// Merging the same history again changes nothing
+	again, _ := m.Command(context.Background(), LocalCommand{StartTime: "0x1c96bb5d", EndTime: "0x1c9747fd"})
+	if err := b.Merge(again); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := store.Read("0x01", since, until, Filter{})
+	if len(stored) != 48 {
+		t.Error("Expected 48 summations got ", len(stored))
+	}
+}
+
+// quietMeter takes get_history_data without answering, like a RAVEn,
+// whose HistoryData arrives later on its stream
+type quietMeter struct {
+	cmds []LocalCommand
+}
+
+func (m *quietMeter) Command(ctx context.Context, cmd LocalCommand) ([]Fragment, error) {
+	m.cmds = append(m.cmds, cmd)
+	return nil, nil
+}
+
+func TestBackfillPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &quietMeter{}
+	b := &Backfill{
+		Commander: m,
+		Store:     &FileStore{Dir: dir},
+		MacId:     "0x01",
+		Chunk:     3 * time.Hour,
+		Delay:     time.Millisecond,
+		StateFile: filepath.Join(dir, "backfill.json"),
+	}
+	since, until := targetTimeU, targetTimeU.Add(6*time.Hour)
+	if err := b.Run(context.Background(), since, until); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.cmds) != 2 {
+		t.Fatal("Expected 2 requests got ", len(m.cmds))
+	}
+	if _, err := os.Stat(b.StateFile); err != nil {
+		t.Fatal("Expected the requested chunks to be kept until their history arrives: ", err)
+	}
+
+	// A restart asks for them again, but not for a different range
+	restarted := &Backfill{Commander: m, Store: b.Store, MacId: "0x01", Delay: time.Millisecond, StateFile: b.StateFile}
+	if err := restarted.Run(context.Background(), since, until.Add(time.Hour)); err == nil {
+		t.Error("Expected an error for a range that doesn't match the saved state")
+	}
+	if err := restarted.Run(context.Background(), since, until); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.cmds) != 4 || m.cmds[2] != m.cmds[0] || m.cmds[3] != m.cmds[1] {
+		t.Error("Expected the pending chunks to be requested again got ", m.cmds)
+	}
+
+	// The history arrives
+	history := &historyMeter{}
+	for i, cmd := range m.cmds[2:] {
+		frags, _ := history.Command(context.Background(), cmd)
+		if err := restarted.Write(context.Background(), frags); err != nil {
+			t.Fatal(err)
+		}
+		_, err := os.Stat(b.StateFile)
+		if i == 0 && err != nil {
+			t.Error("Expected the second chunk to still be pending: ", err)
+		}
+		if i == 1 && !os.IsNotExist(err) {
+			t.Error("Expected the state file to be removed")
+		}
+	}
+	if gaps, _ := restarted.Gaps(since, until); len(gaps) != 0 {
+		t.Error("Expected no gaps got ", gaps)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"sort"
+	"time"
+)
+
+// A BaseloadNight is the baseload estimated from one night's demand.
+// Date is the day the night started, in Baseload's Location.
+type BaseloadNight struct {
+	Date    string  `json:"date"`
+	KW      float64 `json:"kw"`
+	Samples int     `json:"samples"`
+}
+
+// A BaseloadWeek is the median of the nights in the week starting
+// Monday Start
+type BaseloadWeek struct {
+	Start  time.Time `json:"start"`
+	KW     float64   `json:"kw"`
+	Nights int       `json:"nights"`
+}
+
+// A BaseloadReport is a meter's always on demand.  KW is the median of
+// the nights in the last four weeks of data, and Trend how the weekly
+// figure is changing.  AnnualCost is AnnualKWh at Price, which is in
+// the currency of the meter's PriceCluster.
+type BaseloadReport struct {
+	MeterMacId string          `json:"meterMacId"`
+	KW         float64         `json:"kw"`
+	Trend      float64         `json:"trend"` // kW per week
+	AnnualKWh  float64         `json:"annualKWh"`
+	Price      float64         `json:"price"` // per kWh
+	AnnualCost float64         `json:"annualCost"`
+	Nights     []BaseloadNight `json:"nights"`
+	Weeks      []BaseloadWeek  `json:"weeks"`
+}
+
+// A Baseload estimates each meter's always on demand: what the fridge,
+// network gear and standby loads draw when nobody is using anything.
+// For each night it takes a low percentile of the demand in the Night
+// window, from InstantaneousDemand or ProfileData, so that a fridge
+// cycling off doesn't pull the figure down to its minimum.
+type Baseload struct {
+	// Percentile is the percentile of a night's demand that is taken
+	// as its baseload, 10 if zero
+	Percentile float64
+
+	// Night is when the house is asleep, 01:00-05:00 if zero, in
+	// Location, which is UTC if nil
+	Night    Window
+	Location *time.Location
+
+	// MinSamples is the fewest samples a night needs to count, 3 if
+	// zero
+	MinSamples int
+
+	// Price is the cost per kWh.  If zero, the last PriceCluster price
+	// for the meter is used.
+	Price float64
+}
+
+// Report returns the baseload of each meter with demand in frags, in
+// mac id order
+func (b *Baseload) Report(frags []Fragment) []BaseloadReport {
+	night := b.Night
+	if night == (Window{}) {
+		night = Window{Start: time.Hour, End: 5 * time.Hour}
+	}
+	loc := b.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	pct := b.Percentile
+	if pct <= 0 {
+		pct = 10
+	}
+	min := b.MinSamples
+	if min <= 0 {
+		min = 3
+	}
+
+	prices := make(map[string]float64)
+	for _, f := range frags {
+		if f.Name == "PriceCluster" {
+			if v, ok := f.Value(); ok {
+				prices[NormalizeMac(f.MeterMacId)] = v
+			}
+		}
+	}
+
+	// Group each meter's demand by the night it falls in
+	nights := make(map[string]map[string][]float64)
+	for _, s := range LoadSamples(frags) {
+		t := s.Time.In(loc)
+		if !night.Contains(t) {
+			continue
+		}
+		// A night that starts before midnight belongs to the day it
+		// started
+		date := t.Add(-night.Start).Format("2006-01-02")
+		m := nights[s.MeterMacId]
+		if m == nil {
+			m = make(map[string][]float64)
+			nights[s.MeterMacId] = m
+		}
+		m[date] = append(m[date], s.KW)
+	}
+
+	reports := make([]BaseloadReport, 0, len(nights))
+	for meter, m := range nights {
+		r := BaseloadReport{MeterMacId: meter, Price: b.Price}
+		if r.Price == 0 {
+			r.Price = prices[meter]
+		}
+		for date, values := range m {
+			if len(values) >= min {
+				r.Nights = append(r.Nights, BaseloadNight{Date: date, KW: percentile(values, pct), Samples: len(values)})
+			}
+		}
+		if len(r.Nights) == 0 {
+			continue
+		}
+		sort.Slice(r.Nights, func(i, j int) bool { return r.Nights[i].Date < r.Nights[j].Date })
+		r.Weeks = baseloadWeeks(r.Nights, loc)
+
+		last, _ := time.ParseInLocation("2006-01-02", r.Nights[len(r.Nights)-1].Date, loc)
+		var recent []float64
+		for _, n := range r.Nights {
+			if d, _ := time.ParseInLocation("2006-01-02", n.Date, loc); last.Sub(d) < 28*24*time.Hour {
+				recent = append(recent, n.KW)
+			}
+		}
+		r.KW = median(recent)
+
+		if len(r.Weeks) > 1 {
+			var x, y []float64
+			for _, w := range r.Weeks {
+				x = append(x, w.Start.Sub(r.Weeks[0].Start).Hours()/(7*24))
+				y = append(y, w.KW)
+			}
+			_, r.Trend = linearFit(x, y)
+		}
+		r.AnnualKWh = r.KW * 365 * 24
+		r.AnnualCost = r.AnnualKWh * r.Price
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].MeterMacId < reports[j].MeterMacId })
+	return reports
+}
+
+// baseloadWeeks groups sorted nights into weeks starting on Monday
+func baseloadWeeks(nights []BaseloadNight, loc *time.Location) []BaseloadWeek {
+	var weeks []BaseloadWeek
+	var values []float64
+	flush := func() {
+		if len(values) > 0 {
+			weeks[len(weeks)-1].KW = median(values)
+			weeks[len(weeks)-1].Nights = len(values)
+		}
+		values = nil
+	}
+	for _, n := range nights {
+		d, err := time.ParseInLocation("2006-01-02", n.Date, loc)
+		if err != nil {
+			continue
+		}
+		start := d.AddDate(0, 0, -((int(d.Weekday()) + 6) % 7))
+		if len(weeks) == 0 || !weeks[len(weeks)-1].Start.Equal(start) {
+			flush()
+			weeks = append(weeks, BaseloadWeek{Start: start})
+		}
+		values = append(values, n.KW)
+	}
+	flush()
+	return weeks
+}
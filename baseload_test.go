@@ -0,0 +1,89 @@
+package rainforestCommon
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// demandFragment returns a demand of watts from meter 0x01 at t
+func demandFragment(t time.Time, watts int) Fragment {
+	stamp, _ := EncodeMeterTime(t)
+	f, _ := NewFragment(InstantaneousDemand{
+		XMLName:    xml.Name{Local: "InstantaneousDemand"},
+		MeterMacId: "0x01",
+		TimeStamp:  stamp,
+		Demand:     fmt.Sprintf("0x%06x", watts&0xffffff),
+		Multiplier: "0x00000001",
+		Divisor:    "0x000003e8",
+	})
+	return f
+}
+
+func TestBaseload(t *testing.T) {
+	// Three weeks from Monday 2015-03-02, with a baseload of 200 W
+	// rising 50 W a week and a fridge that is on every other sample
+	start := time.Date(2015, time.March, 2, 0, 0, 0, 0, time.UTC)
+	var frags []Fragment
+	for i := 0; i < 21*24*4; i++ {
+		t := start.Add(time.Duration(i) * 15 * time.Minute)
+		watts := 200 + 50*(i/(7*24*4))
+		if i%2 == 1 {
+			watts += 150
+		}
+		if t.Hour() >= 7 {
+			watts += 1500
+		}
+		frags = append(frags, demandFragment(t, watts))
+	}
+	price, _ := NewFragment(PriceCluster{
+		XMLName:        xml.Name{Local: "PriceCluster"},
+		MeterMacId:     "0x01",
+		Price:          "0x0000000c",
+		TrailingDigits: "0x02",
+	})
+	frags = append(frags, price)
+
+	reports := (&Baseload{}).Report(frags)
+	if len(reports) != 1 {
+		t.Fatal("Expected one meter got ", reports)
+	}
+	r := reports[0]
+	if len(r.Nights) != 21 || len(r.Weeks) != 3 {
+		t.Fatal("Expected 21 nights in 3 weeks got ", r.Nights, r.Weeks)
+	}
+	if r.Nights[0].KW != 0.2 || r.Weeks[2].KW != 0.3 {
+		t.Error("Expected the fridge to be ignored got ", r.Nights[0], r.Weeks[2])
+	}
+	if r.KW != 0.25 || math.Abs(r.Trend-0.05) > 1e-9 {
+		t.Error("Expected 0.25 kW rising 0.05 a week got ", r.KW, " ", r.Trend)
+	}
+	if r.Price != 0.12 || math.Abs(r.AnnualCost-0.25*8760*0.12) > 1e-6 {
+		t.Error("Expected the annual cost at 0.12 got ", r.AnnualCost)
+	}
+}
+
+func TestProfileIntervals(t *testing.T) {
+	end := targetTimeU
+	stamp, _ := EncodeMeterTime(end)
+	p := ProfileData{
+		XMLName:                  xml.Name{Local: "ProfileData"},
+		MeterMacId:               "0x01",
+		EndTime:                  stamp,
+		ProfileIntervalPeriod:    "0x03",
+		NumberOfPeriodsDelivered: "0x03",
+		IntervalData1:            "0x0000fa",
+		IntervalData2:            "0xffffff",
+		IntervalData3:            "0x00007d",
+	}
+	f, _ := NewFragment(p)
+	samples := LoadSamples([]Fragment{f})
+	if len(samples) != 2 {
+		t.Fatal("Expected two intervals got ", samples)
+	}
+	if !samples[0].Time.Equal(end.Add(-45*time.Minute)) || samples[0].KW != 0.5 || samples[1].KW != 1 {
+		t.Error("Expected 0.5 kW then 1 kW got ", samples)
+	}
+}
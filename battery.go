@@ -0,0 +1,247 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// The dispatch strategies a Battery can follow
+const (
+	// StrategyArbitrage charges at each day's lowest price and
+	// discharges at its highest, when the difference covers the losses
+	StrategyArbitrage = "arbitrage"
+
+	// StrategyPeakShaving discharges to hold demand at ShaveAbove and
+	// charges below it
+	StrategyPeakShaving = "peak_shaving"
+
+	// StrategySelfConsumption charges from solar that would be
+	// exported and discharges to cover the house
+	StrategySelfConsumption = "self_consumption"
+)
+
+// A Battery is a home battery model that replays a meter's demand.
+// The battery never exports: it discharges no more than the house is
+// using.  Losses are split evenly between charging and discharging.
+type Battery struct {
+	CapacityKWh float64
+	PowerKW     float64 // charge and discharge limit
+
+	// Efficiency is the round trip efficiency, 0.9 if zero, and
+	// Reserve the fraction of capacity that is never used
+	Efficiency float64
+	Reserve    float64
+
+	Strategy string
+
+	// ShaveAbove is the demand peak shaving holds to.  If zero it is
+	// the highest demand less PowerKW.
+	ShaveAbove float64
+
+	// Tariff, if not nil, prices the energy and bills, including any
+	// demand charge; energy sent back is credited at the same rates.
+	// Otherwise the meter's PriceCluster prices are used.
+	Tariff *Tariff
+
+	// Location is where days and the tariff's windows are, UTC if nil
+	Location *time.Location
+
+	// Step is the length of the intervals demand is averaged over, 15
+	// minutes if zero
+	Step time.Duration
+}
+
+// A BatteryInterval is one step of a simulation.  BatteryKW is positive
+// when discharging, and NetKW is what the meter would have seen.
+// Stored is the energy in the battery at the end of the step.
+type BatteryInterval struct {
+	Start     time.Time     `json:"start"`
+	Period    time.Duration `json:"period"`
+	LoadKW    float64       `json:"loadKW"`
+	BatteryKW float64       `json:"batteryKW"`
+	NetKW     float64       `json:"netKW"`
+	Stored    float64       `json:"stored"` // kWh
+}
+
+// A BatterySimulation is what a battery would have done for a meter
+type BatterySimulation struct {
+	MeterMacId     string            `json:"meterMacId"`
+	Strategy       string            `json:"strategy"`
+	BaselineCost   float64           `json:"baselineCost"`
+	Cost           float64           `json:"cost"`
+	Savings        float64           `json:"savings"`
+	BaselinePeakKW float64           `json:"baselinePeakKW"`
+	PeakKW         float64           `json:"peakKW"`
+	ChargedKWh     float64           `json:"chargedKWh"`
+	DischargedKWh  float64           `json:"dischargedKWh"`
+	Cycles         float64           `json:"cycles"` // full equivalent
+	Intervals      []BatteryInterval `json:"intervals"`
+}
+
+// Simulate replays each meter's demand in frags through the battery:
+// InstantaneousDemand averaged over each Step or, for meters without
+// it, ProfileData or the use between summations
+func (b *Battery) Simulate(frags []Fragment) ([]BatterySimulation, error) {
+	if b.CapacityKWh <= 0 || b.PowerKW <= 0 {
+		return nil, fmt.Errorf("Battery needs a capacity and a power limit")
+	}
+	switch b.Strategy {
+	case StrategyArbitrage, StrategyPeakShaving, StrategySelfConsumption:
+	default:
+		return nil, fmt.Errorf("Unknown battery strategy %q", b.Strategy)
+	}
+	loc := b.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	step := orDefault(b.Step, 15*time.Minute)
+
+	loads := UsageIntervals(frags)
+	demand := make(map[string][]LoadSample)
+	for _, s := range LoadSamples(frags) {
+		if s.Period == 0 {
+			demand[s.MeterMacId] = append(demand[s.MeterMacId], s)
+		}
+	}
+	for meter, samples := range demand {
+		loads[meter] = averageDemand(samples, step)
+	}
+	prices := meterPrices(frags)
+
+	var sims []BatterySimulation
+	for meter, intervals := range loads {
+		if len(intervals) == 0 {
+			continue
+		}
+		price := func(t time.Time) float64 {
+			if b.Tariff != nil {
+				return b.Tariff.RateAt(t.In(loc))
+			}
+			return priceAt(prices[meter], t).price
+		}
+		sims = append(sims, b.simulate(meter, intervals, price, loc))
+	}
+	sort.Slice(sims, func(i, j int) bool { return sims[i].MeterMacId < sims[j].MeterMacId })
+	return sims, nil
+}
+
+// averageDemand averages time ordered demand over each step it falls in
+func averageDemand(samples []LoadSample, step time.Duration) []EnergyInterval {
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	var intervals []EnergyInterval
+	var sum float64
+	var n int
+	flush := func() {
+		if n > 0 {
+			e := &intervals[len(intervals)-1]
+			e.KWh = sum / float64(n) * step.Hours()
+		}
+		sum, n = 0, 0
+	}
+	for _, s := range samples {
+		start := s.Time.Truncate(step)
+		if len(intervals) == 0 || !intervals[len(intervals)-1].Start.Equal(start) {
+			flush()
+			intervals = append(intervals, EnergyInterval{Start: start, Period: step})
+		}
+		sum += s.KW
+		n++
+	}
+	flush()
+	return intervals
+}
+
+// simulate runs the battery over one meter's intervals, starting empty
+func (b *Battery) simulate(meter string, intervals []EnergyInterval, price func(time.Time) float64, loc *time.Location) BatterySimulation {
+	sim := BatterySimulation{MeterMacId: meter, Strategy: b.Strategy}
+	eff := b.Efficiency
+	if eff <= 0 || eff > 1 {
+		eff = 0.9
+	}
+	oneWay := math.Sqrt(eff)
+	floor := b.CapacityKWh * b.Reserve
+
+	for _, e := range intervals {
+		sim.BaselinePeakKW = math.Max(sim.BaselinePeakKW, e.KWh/e.Period.Hours())
+	}
+	shave := b.ShaveAbove
+	if shave <= 0 {
+		shave = math.Max(sim.BaselinePeakKW-b.PowerKW, 0)
+	}
+
+	// Each day's cheapest and dearest price, for arbitrage
+	type spread struct{ low, high float64 }
+	days := make(map[string]*spread)
+	if b.Strategy == StrategyArbitrage {
+		for _, e := range intervals {
+			day := e.Start.In(loc).Format("2006-01-02")
+			p := price(e.Start)
+			if s := days[day]; s == nil {
+				days[day] = &spread{p, p}
+			} else {
+				s.low, s.high = math.Min(s.low, p), math.Max(s.high, p)
+			}
+		}
+	}
+
+	stored := floor
+	baseline := make([]EnergyInterval, len(intervals))
+	net := make([]EnergyInterval, len(intervals))
+	for i, e := range intervals {
+		h := e.Period.Hours()
+		load := e.KWh / h
+		var want float64 // kW, positive to discharge
+		switch b.Strategy {
+		case StrategyPeakShaving:
+			want = load - shave
+		case StrategySelfConsumption:
+			want = load
+		case StrategyArbitrage:
+			s := days[e.Start.In(loc).Format("2006-01-02")]
+			p := price(e.Start)
+			if s.high*eff > s.low {
+				switch p {
+				case s.high:
+					want = load
+				case s.low:
+					want = -b.PowerKW
+				}
+			}
+		}
+		want = math.Max(math.Min(want, b.PowerKW), -b.PowerKW)
+		if want > 0 {
+			want = math.Min(want, math.Max(load, 0))
+			want = math.Min(want, (stored-floor)*oneWay/h)
+			stored -= want * h / oneWay
+			sim.DischargedKWh += want * h
+		} else if want < 0 {
+			want = math.Max(want, -(b.CapacityKWh-stored)/(oneWay*h))
+			stored -= want * h * oneWay
+			sim.ChargedKWh -= want * h
+		}
+
+		r := BatteryInterval{Start: e.Start, Period: e.Period, LoadKW: load, BatteryKW: want, NetKW: load - want, Stored: stored}
+		sim.Intervals = append(sim.Intervals, r)
+		sim.PeakKW = math.Max(sim.PeakKW, r.NetKW)
+		baseline[i] = e
+		net[i] = EnergyInterval{e.Start, e.Period, r.NetKW * h}
+		if b.Tariff == nil {
+			p := price(e.Start)
+			sim.BaselineCost += e.KWh * p
+			sim.Cost += r.NetKW * h * p
+		}
+	}
+	if b.Tariff != nil {
+		sim.BaselineCost = b.Tariff.Cost(baseline, loc).Total
+		sim.Cost = b.Tariff.Cost(net, loc).Total
+	}
+	sim.Savings = sim.BaselineCost - sim.Cost
+	sim.Cycles = sim.DischargedKWh / b.CapacityKWh
+	return sim
+}
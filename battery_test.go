@@ -0,0 +1,139 @@
+package rainforestCommon
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// dayOfDemand returns a demand every five minutes for a day from start,
+// of watts(t)
+func dayOfDemand(start time.Time, watts func(t time.Time) int) []Fragment {
+	var frags []Fragment
+	for t := start; t.Before(start.Add(24 * time.Hour)); t = t.Add(5 * time.Minute) {
+		frags = append(frags, demandFragment(t, watts(t)))
+	}
+	return frags
+}
+
+func TestBatteryPeakShaving(t *testing.T) {
+	start := time.Date(2015, 3, 16, 0, 0, 0, 0, time.UTC)
+	frags := dayOfDemand(start, func(t time.Time) int {
+		if t.Hour() == 18 {
+			return 6000
+		}
+		return 2000
+	})
+	b := &Battery{CapacityKWh: 10, PowerKW: 5, Strategy: StrategyPeakShaving, ShaveAbove: 4,
+		Tariff: &Tariff{Name: "demand", Rate: 0.1, Demand: 10}}
+	sims, err := b.Simulate(frags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sims) != 1 {
+		t.Fatalf("got %d simulations, want 1", len(sims))
+	}
+	s := sims[0]
+	if s.BaselinePeakKW != 6 || math.Abs(s.PeakKW-4) > 1e-9 {
+		t.Errorf("peak %v kW from %v, want 4 from 6", s.PeakKW, s.BaselinePeakKW)
+	}
+	if math.Abs(s.DischargedKWh-2) > 1e-9 {
+		t.Errorf("discharged %v kWh, want 2", s.DischargedKWh)
+	}
+	if math.Abs(s.Cycles-0.2) > 1e-9 {
+		t.Errorf("cycles %v, want 0.2", s.Cycles)
+	}
+	// 20 off the demand charge, less the losses at 0.1
+	losses := (s.ChargedKWh - s.DischargedKWh) * 0.1
+	if math.Abs(s.Savings-(20-losses)) > 1e-9 {
+		t.Errorf("savings %v, want %v", s.Savings, 20-losses)
+	}
+	if len(s.Intervals) != 96 {
+		t.Errorf("got %d intervals, want 96", len(s.Intervals))
+	}
+}
+
+func TestBatterySelfConsumption(t *testing.T) {
+	start := time.Date(2015, 3, 16, 0, 0, 0, 0, time.UTC)
+	frags := dayOfDemand(start, func(t time.Time) int {
+		if t.Hour() >= 10 && t.Hour() < 16 {
+			return -3000
+		}
+		if t.Hour() >= 16 {
+			return 1000
+		}
+		return 0
+	})
+	b := &Battery{CapacityKWh: 10, PowerKW: 5, Efficiency: 0.81, Strategy: StrategySelfConsumption}
+	sims, err := b.Simulate(frags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sims[0]
+
+	// 18 kWh of solar fills the battery, which gives back 9 kWh, enough
+	// for the evening's 8
+	if math.Abs(s.ChargedKWh-10/0.9) > 1e-9 {
+		t.Errorf("charged %v kWh, want %v", s.ChargedKWh, 10/0.9)
+	}
+	if math.Abs(s.DischargedKWh-8) > 1e-9 {
+		t.Errorf("discharged %v kWh, want 8", s.DischargedKWh)
+	}
+	for _, r := range s.Intervals {
+		if r.Stored > 10+1e-9 || r.Stored < 0 {
+			t.Errorf("%v stored %v kWh", r.Start, r.Stored)
+		}
+		if r.Start.Hour() >= 16 && math.Abs(r.NetKW) > 1e-9 {
+			t.Errorf("%v net %v kW, want 0", r.Start, r.NetKW)
+		}
+		if math.Abs(r.BatteryKW) > 5 {
+			t.Errorf("%v battery %v kW, over the limit", r.Start, r.BatteryKW)
+		}
+	}
+}
+
+func TestBatteryArbitrage(t *testing.T) {
+	start := time.Date(2015, 3, 16, 0, 0, 0, 0, time.UTC)
+	frags := dayOfDemand(start, func(time.Time) int { return 2000 })
+	peak := Window{17 * time.Hour, 21 * time.Hour}
+	tariff := &Tariff{Name: "tou", Rate: 0.1,
+		Periods: []TariffPeriod{{Name: "peak", Windows: []Window{peak}, Rate: 0.4}}}
+	b := &Battery{CapacityKWh: 10, PowerKW: 5, Strategy: StrategyArbitrage, Tariff: tariff}
+	sims, err := b.Simulate(frags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sims[0]
+	for _, r := range s.Intervals {
+		inPeak := peak.Contains(r.Start)
+		if r.BatteryKW > 0 && !inPeak || r.BatteryKW < 0 && inPeak {
+			t.Errorf("%v battery %v kW", r.Start, r.BatteryKW)
+		}
+	}
+	// The battery covers the 8 kWh of peak use
+	if math.Abs(s.DischargedKWh-8) > 1e-9 {
+		t.Errorf("discharged %v kWh, want 8", s.DischargedKWh)
+	}
+	want := 8*0.4 - s.ChargedKWh*0.1
+	if math.Abs(s.Savings-want) > 1e-9 {
+		t.Errorf("savings %v, want %v", s.Savings, want)
+	}
+
+	// A spread too small for the losses isn't worth it
+	tariff.Periods[0].Rate = 0.105
+	if sims, _ = b.Simulate(frags); sims[0].ChargedKWh != 0 {
+		t.Errorf("charged %v kWh on a small spread", sims[0].ChargedKWh)
+	}
+}
+
+func TestBatteryConfig(t *testing.T) {
+	for _, b := range []Battery{
+		{PowerKW: 5, Strategy: StrategyArbitrage},
+		{CapacityKWh: 10, Strategy: StrategyArbitrage},
+		{CapacityKWh: 10, PowerKW: 5, Strategy: "hoarding"},
+	} {
+		if _, err := b.Simulate(nil); err == nil {
+			t.Errorf("%+v: no error", b)
+		}
+	}
+}
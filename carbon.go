@@ -0,0 +1,299 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An IntensityPoint is the grid's carbon intensity, in grams of CO2e
+// per kWh, from Time until the next point
+type IntensityPoint struct {
+	Time  time.Time
+	Grams float64
+}
+
+// CarbonIntensity is a time ordered series of grid carbon intensity,
+// average or marginal, usually hourly.  The last point lasts as long
+// as the one before it, or an hour if it is the only one.
+type CarbonIntensity []IntensityPoint
+
+// The time layouts ReadCarbonIntensity understands, after RFC 3339.
+// Times without a zone are UTC.
+var intensityLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// ReadCarbonIntensity reads a csv of time,gCO2e/kWh with an optional
+// header row
+func ReadCarbonIntensity(r io.Reader) (CarbonIntensity, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	var c CarbonIntensity
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("Carbon intensity line %d: want time,intensity", line)
+		}
+		var t time.Time
+		for _, layout := range intensityLayouts {
+			if t, err = time.Parse(layout, strings.TrimSpace(record[0])); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			if line == 1 {
+				continue // header
+			}
+			return nil, fmt.Errorf("Carbon intensity line %d: %v", line, err)
+		}
+		g, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Carbon intensity line %d: %v", line, err)
+		}
+		c = append(c, IntensityPoint{t, g})
+	}
+	sort.SliceStable(c, func(i, j int) bool { return c[i].Time.Before(c[j].Time) })
+	return c, nil
+}
+
+// At returns the intensity at t, or false if t isn't covered
+func (c CarbonIntensity) At(t time.Time) (float64, bool) {
+	i := sort.Search(len(c), func(i int) bool { return c[i].Time.After(t) }) - 1
+	if i < 0 {
+		return 0, false
+	}
+	if i == len(c)-1 {
+		last := time.Hour
+		if i > 0 {
+			last = c[i].Time.Sub(c[i-1].Time)
+		}
+		if !t.Before(c[i].Time.Add(last)) {
+			return 0, false
+		}
+	}
+	return c[i].Grams, true
+}
+
+// A CarbonInterval is the emissions of a meter's use in the Period from
+// Start.  Clean is set if the intensity was among the day's lowest.
+type CarbonInterval struct {
+	MeterMacId string        `json:"meterMacId"`
+	Start      time.Time     `json:"start"`
+	Period     time.Duration `json:"period"`
+	KWh        float64       `json:"kWh"`
+	Intensity  float64       `json:"intensity"` // gCO2e/kWh
+	KgCO2e     float64       `json:"kgCO2e"`
+	Clean      bool          `json:"clean"`
+}
+
+// Header returns the csv column names used by Fields
+func (c CarbonInterval) Header() []string {
+	return []string{"time", "meter_mac", "seconds", "kwh", "intensity", "kgco2e", "clean"}
+}
+
+// Fields returns the interval as a csv record
+func (c CarbonInterval) Fields() []string {
+	return []string{c.Start.Format(time.RFC3339), c.MeterMacId,
+		strconv.FormatFloat(c.Period.Seconds(), 'f', -1, 64),
+		formatAmount(c.KWh),
+		formatAmount(c.Intensity),
+		formatAmount(c.KgCO2e),
+		strconv.FormatBool(c.Clean)}
+}
+
+func (c CarbonInterval) String() string {
+	clean := ""
+	if c.Clean {
+		clean = " clean"
+	}
+	return fmt.Sprintf("%s %s %8.3f kWh %6.1f g/kWh %8.3f kgCO2e%s\n",
+		c.Start.Format(time.RFC3339), c.MeterMacId, c.KWh, c.Intensity, c.KgCO2e, clean)
+}
+
+// A CarbonTotal is a meter's emissions over a day, e.g. 2015-03-14, or
+// a month, e.g. 2015-03.  CleanShare is the fraction of its use that
+// was in the cleanest hours.
+type CarbonTotal struct {
+	MeterMacId string  `json:"meterMacId"`
+	Date       string  `json:"date"`
+	KWh        float64 `json:"kWh"`
+	KgCO2e     float64 `json:"kgCO2e"`
+	Intensity  float64 `json:"intensity"` // gCO2e/kWh, weighted by use
+	CleanKWh   float64 `json:"cleanKWh"`
+	CleanShare float64 `json:"cleanShare"`
+}
+
+// Header returns the csv column names used by Fields
+func (c CarbonTotal) Header() []string {
+	return []string{"date", "meter_mac", "kwh", "kgco2e", "intensity", "clean_kwh", "clean_share"}
+}
+
+// Fields returns the total as a csv record
+func (c CarbonTotal) Fields() []string {
+	return []string{c.Date, c.MeterMacId,
+		formatAmount(c.KWh),
+		formatAmount(c.KgCO2e),
+		formatAmount(c.Intensity),
+		formatAmount(c.CleanKWh),
+		formatAmount(c.CleanShare)}
+}
+
+func (c CarbonTotal) String() string {
+	return fmt.Sprintf("%-10s %s %9.3f kWh %9.3f kgCO2e %6.1f g/kWh %3.0f%% in the cleanest hours\n",
+		c.Date, c.MeterMacId, c.KWh, c.KgCO2e, c.Intensity, c.CleanShare*100)
+}
+
+// A CarbonAccount attaches emissions to energy use
+type CarbonAccount struct {
+	Intensity CarbonIntensity
+
+	// Clean is the percentage of each day's intensity readings counted
+	// as its cleanest hours, 25 if zero
+	Clean float64
+
+	// Location is where days and months start, UTC if nil
+	Location *time.Location
+}
+
+// Intervals returns the emissions of each meter's use, from ProfileData
+// or its summations and HistoryData, by meter and then time.  Intervals
+// longer than an hour are split evenly into hours, and use at times the
+// intensity doesn't cover is left out.
+func (c *CarbonAccount) Intervals(frags []Fragment) []CarbonInterval {
+	loc := c.location()
+	clean := c.Clean
+	if clean <= 0 {
+		clean = 25
+	}
+
+	// The highest intensity among each day's cleanest
+	thresholds := make(map[string]float64)
+	day := make(map[string][]float64)
+	for _, p := range c.Intensity {
+		d := p.Time.In(loc).Format("2006-01-02")
+		day[d] = append(day[d], p.Grams)
+	}
+	for d, g := range day {
+		thresholds[d] = percentile(g, clean)
+	}
+
+	usage := UsageIntervals(frags)
+	meters := make([]string, 0, len(usage))
+	for meter := range usage {
+		meters = append(meters, meter)
+	}
+	sort.Strings(meters)
+
+	var result []CarbonInterval
+	for _, meter := range meters {
+		for _, e := range usage[meter] {
+			for _, part := range splitHours(e) {
+				g, ok := c.Intensity.At(part.Start)
+				if !ok {
+					continue
+				}
+				result = append(result, CarbonInterval{
+					MeterMacId: meter,
+					Start:      part.Start,
+					Period:     part.Period,
+					KWh:        part.KWh,
+					Intensity:  g,
+					KgCO2e:     part.KWh * g / 1000,
+					Clean:      g <= thresholds[part.Start.In(loc).Format("2006-01-02")],
+				})
+			}
+		}
+	}
+	return result
+}
+
+// splitHours splits an interval longer than an hour into hours, sharing
+// its energy evenly
+func splitHours(e EnergyInterval) []EnergyInterval {
+	if e.Period <= time.Hour {
+		return []EnergyInterval{e}
+	}
+	var parts []EnergyInterval
+	for t := e.Start; t.Before(e.Start.Add(e.Period)); t = t.Add(time.Hour) {
+		period := time.Hour
+		if end := e.Start.Add(e.Period); t.Add(period).After(end) {
+			period = end.Sub(t)
+		}
+		parts = append(parts, EnergyInterval{t, period, e.KWh * float64(period) / float64(e.Period)})
+	}
+	return parts
+}
+
+// Days totals intervals by meter and day
+func (c *CarbonAccount) Days(intervals []CarbonInterval) []CarbonTotal {
+	return c.totals(intervals, "2006-01-02")
+}
+
+// Months totals intervals by meter and month
+func (c *CarbonAccount) Months(intervals []CarbonInterval) []CarbonTotal {
+	return c.totals(intervals, "2006-01")
+}
+
+func (c *CarbonAccount) totals(intervals []CarbonInterval, layout string) []CarbonTotal {
+	loc := c.location()
+	type key struct{ meter, date string }
+	sums := make(map[key]*CarbonTotal)
+	var totals []*CarbonTotal
+	for _, i := range intervals {
+		k := key{i.MeterMacId, i.Start.In(loc).Format(layout)}
+		t := sums[k]
+		if t == nil {
+			t = &CarbonTotal{MeterMacId: k.meter, Date: k.date}
+			sums[k] = t
+			totals = append(totals, t)
+		}
+		t.KWh += i.KWh
+		t.KgCO2e += i.KgCO2e
+		if i.Clean {
+			t.CleanKWh += i.KWh
+		}
+	}
+	result := make([]CarbonTotal, len(totals))
+	for n, t := range totals {
+		if t.KWh != 0 {
+			t.Intensity = t.KgCO2e * 1000 / t.KWh
+			t.CleanShare = t.CleanKWh / t.KWh
+		}
+		result[n] = *t
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].MeterMacId != result[j].MeterMacId {
+			return result[i].MeterMacId < result[j].MeterMacId
+		}
+		return result[i].Date < result[j].Date
+	})
+	return result
+}
+
+// formatAmount formats v for csv, rounded to a millionth so that sums
+// don't show float noise
+func formatAmount(v float64) string {
+	return strconv.FormatFloat(math.Round(v*1e6)/1e6, 'f', -1, 64)
+}
+
+func (c *CarbonAccount) location() *time.Location {
+	if c.Location == nil {
+		return time.UTC
+	}
+	return c.Location
+}
@@ -0,0 +1,98 @@
+package rainforestCommon
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCarbonIntensity(t *testing.T) {
+	c, err := ReadCarbonIntensity(strings.NewReader("time,gCO2e/kWh\n" +
+		"2015-03-14 01:00, 300\n" +
+		"2015-03-14T00:00:00Z,250.5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2015, 3, 14, 0, 0, 0, 0, time.UTC)
+	for _, c2 := range []struct {
+		at   time.Duration
+		want float64
+		ok   bool
+	}{
+		{-time.Minute, 0, false},
+		{30 * time.Minute, 250.5, true},
+		{90 * time.Minute, 300, true},
+		{2 * time.Hour, 0, false},
+	} {
+		if g, ok := c.At(start.Add(c2.at)); g != c2.want || ok != c2.ok {
+			t.Errorf("At %v: got %v %v, want %v %v", c2.at, g, ok, c2.want, c2.ok)
+		}
+	}
+
+	if _, err := ReadCarbonIntensity(strings.NewReader("2015-03-14 01:00,300\nyesterday,200\n")); err == nil {
+		t.Error("bad time: no error")
+	}
+}
+
+func TestCarbonAccount(t *testing.T) {
+	start := time.Date(2015, 3, 14, 0, 0, 0, 0, time.UTC)
+	frags := summationsOf(start, 48, func(time.Time) float64 { return 1 })
+
+	// Clean from 10:00 to 16:00, a quarter of each day
+	var csv strings.Builder
+	for h := 0; h < 48; h++ {
+		g := 400
+		if h%24 >= 10 && h%24 < 16 {
+			g = 100
+		}
+		fmt.Fprintf(&csv, "%s,%d\n", start.Add(time.Duration(h)*time.Hour).Format(time.RFC3339), g)
+	}
+	intensity, err := ReadCarbonIntensity(strings.NewReader(csv.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &CarbonAccount{Intensity: intensity}
+	intervals := c.Intervals(frags)
+	if len(intervals) != 48 {
+		t.Fatalf("got %d intervals, want 48", len(intervals))
+	}
+	if i := intervals[12]; !i.Clean || math.Abs(i.KgCO2e-0.1) > 1e-9 {
+		t.Errorf("noon: got %+v", i)
+	}
+
+	days := c.Days(intervals)
+	if len(days) != 2 {
+		t.Fatalf("got %d days, want 2", len(days))
+	}
+	for _, d := range days {
+		if math.Abs(d.KWh-24) > 1e-9 || math.Abs(d.KgCO2e-7.8) > 1e-9 || math.Abs(d.CleanShare-0.25) > 1e-9 {
+			t.Errorf("%s: got %+v", d.Date, d)
+		}
+	}
+	months := c.Months(intervals)
+	if len(months) != 1 || months[0].Date != "2015-03" || math.Abs(months[0].KgCO2e-15.6) > 1e-9 ||
+		math.Abs(months[0].Intensity-325) > 1e-9 {
+		t.Errorf("got months %+v", months)
+	}
+
+	var buf bytes.Buffer
+	w, _ := NewRecordWriter(&buf, FormatCSV)
+	w.Write(days[0])
+	w.Flush()
+	expected := "date,meter_mac,kwh,kgco2e,intensity,clean_kwh,clean_share\n" +
+		"2015-03-14,0x01,24,7.8,325,6,0.25\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q got %q", expected, buf.String())
+	}
+}
+
+func TestSplitHours(t *testing.T) {
+	start := time.Date(2015, 3, 14, 0, 0, 0, 0, time.UTC)
+	parts := splitHours(EnergyInterval{start, 150 * time.Minute, 5})
+	if len(parts) != 3 || parts[0].KWh != 2 || parts[2].Period != 30*time.Minute || parts[2].KWh != 1 {
+		t.Errorf("got %+v", parts)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// A TimeOfUse prices energy by when it is used: PeakPrice in the Peak
+// windows and OffPeakPrice otherwise.  The windows apply on weekdays
+// only unless Weekends is set.
+type TimeOfUse struct {
+	Location     *time.Location // UTC if nil
+	Peak         []Window
+	Weekends     bool
+	PeakPrice    float64 // per kWh
+	OffPeakPrice float64
+}
+
+// IsPeak reports whether t is in a peak window
+func (u *TimeOfUse) IsPeak(t time.Time) bool {
+	if u.Location != nil {
+		t = t.In(u.Location)
+	} else {
+		t = t.UTC()
+	}
+	return inWindows(t, u.Peak, u.Weekends)
+}
+
+// inWindows reports whether t, in its own location, is in one of
+// windows, which apply on weekends only if weekends is set
+func inWindows(t time.Time, windows []Window, weekends bool) bool {
+	if !weekends && (t.Weekday() == time.Saturday || t.Weekday() == time.Sunday) {
+		return false
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// PriceAt returns the price per kWh at t and whether t is on peak
+func (u *TimeOfUse) PriceAt(t time.Time) (price float64, peak bool) {
+	if u.IsPeak(t) {
+		return u.PeakPrice, true
+	}
+	return u.OffPeakPrice, false
+}
+
+// A ChargingSession is a stretch of sustained high demand, most likely
+// an EV charging.  KWh is the energy drawn above the demand before the
+// session started, split into PeakKWh and OffPeakKWh.
+type ChargingSession struct {
+	MeterMacId string        `json:"meterMacId"`
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	Duration   time.Duration `json:"duration"`
+	KW         float64       `json:"kw"` // mean
+	KWh        float64       `json:"kWh"`
+	PeakKWh    float64       `json:"peakKWh"`
+	OffPeakKWh float64       `json:"offPeakKWh"`
+	Cost       float64       `json:"cost"`
+}
+
+// A ChargingMonth totals the sessions that started in Month, e.g.
+// 2015-03
+type ChargingMonth struct {
+	MeterMacId string  `json:"meterMacId"`
+	Month      string  `json:"month"`
+	Sessions   int     `json:"sessions"`
+	KWh        float64 `json:"kWh"`
+	PeakKWh    float64 `json:"peakKWh"`
+	OffPeakKWh float64 `json:"offPeakKWh"`
+	Cost       float64 `json:"cost"`
+}
+
+// A ChargingDetector finds charging sessions in InstantaneousDemand.
+// A session starts when demand rises at least MinKW above what it was,
+// and lasts while demand stays more than half that above it, allowing
+// dips of up to Gap.  Sessions shorter than MinDuration, like an oven
+// or a dryer, are dropped.
+//
+// Energy is priced with Tariff or, if it is nil, at the last
+// PriceCluster price, with tiers above 1 counted as on peak.
+type ChargingDetector struct {
+	// MinKW is the smallest charging power, 3 kW if zero
+	MinKW float64
+
+	// MinDuration is the shortest session, 45 minutes if zero, and
+	// Gap the longest dip in one, 2 minutes if zero
+	MinDuration time.Duration
+	Gap         time.Duration
+
+	Tariff *TimeOfUse
+
+	// Location is where months start, UTC if nil
+	Location *time.Location
+}
+
+// meterPrice is a PriceCluster's price from time on
+type meterPrice struct {
+	time  time.Time
+	price float64
+	peak  bool // in a tier above 1
+}
+
+// meterPrices returns each meter's PriceCluster prices in time order
+func meterPrices(frags []Fragment) map[string][]meterPrice {
+	prices := make(map[string][]meterPrice)
+	for _, f := range frags {
+		if p, ok := f.Packet.(PriceCluster); ok {
+			if v, ok := f.Value(); ok {
+				meter := NormalizeMac(f.MeterMacId)
+				prices[meter] = append(prices[meter], meterPrice{f.Time, v, getval(p.Tier) > 1})
+			}
+		}
+	}
+	for _, p := range prices {
+		sort.SliceStable(p, func(i, j int) bool { return p[i].time.Before(p[j].time) })
+	}
+	return prices
+}
+
+// priceAt returns the price in effect at t: the last one before it, or
+// the first if none is
+func priceAt(prices []meterPrice, t time.Time) meterPrice {
+	var p meterPrice
+	for _, q := range prices {
+		if q.time.After(t) && !p.time.IsZero() {
+			break
+		}
+		p = q
+	}
+	return p
+}
+
+// Sessions returns the charging sessions in frags, in time order
+func (c *ChargingDetector) Sessions(frags []Fragment) []ChargingSession {
+	minKW := c.MinKW
+	if minKW <= 0 {
+		minKW = 3
+	}
+	minDuration := orDefault(c.MinDuration, 45*time.Minute)
+	gap := orDefault(c.Gap, 2*time.Minute)
+
+	prices := meterPrices(frags)
+
+	demand := make(map[string][]LoadSample)
+	var meters []string
+	for _, s := range LoadSamples(frags) {
+		if s.Period != 0 {
+			continue
+		}
+		if demand[s.MeterMacId] == nil {
+			meters = append(meters, s.MeterMacId)
+		}
+		demand[s.MeterMacId] = append(demand[s.MeterMacId], s)
+	}
+
+	var sessions []ChargingSession
+	for _, meter := range meters {
+		samples := demand[meter]
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+		price := func(t time.Time) (float64, bool) {
+			if c.Tariff != nil {
+				return c.Tariff.PriceAt(t)
+			}
+			p := priceAt(prices[meter], t)
+			return p.price, p.peak
+		}
+
+		base := 0.0
+		start, lastHigh := -1, -1
+		end := func(i int) {
+			// The session ran from start to the reading after lastHigh
+			if s, ok := c.session(meter, samples[start:i], base, gap, price); ok && s.Duration >= minDuration {
+				sessions = append(sessions, s)
+			}
+			start, lastHigh = -1, -1
+		}
+		for i, s := range samples {
+			switch {
+			case start < 0 && s.KW-base >= minKW:
+				start, lastHigh = i, i
+			case start < 0:
+				base = s.KW
+			case s.KW-base > minKW/2:
+				lastHigh = i
+			case s.Time.Sub(samples[lastHigh].Time) > gap:
+				end(lastHigh + 2)
+				base = s.KW
+			}
+		}
+		if start >= 0 {
+			if lastHigh+2 > len(samples) {
+				end(len(samples))
+			} else {
+				end(lastHigh + 2)
+			}
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].Start.Before(sessions[j].Start) })
+	return sessions
+}
+
+// session totals the readings of a session, each of which holds until
+// the next one or for at most gap
+func (c *ChargingDetector) session(meter string, samples []LoadSample, base float64, gap time.Duration,
+	price func(time.Time) (float64, bool)) (ChargingSession, bool) {
+	if len(samples) < 2 {
+		return ChargingSession{}, false
+	}
+	s := ChargingSession{MeterMacId: meter, Start: samples[0].Time, End: samples[len(samples)-1].Time}
+	s.Duration = s.End.Sub(s.Start)
+	for i := 0; i < len(samples)-1; i++ {
+		dt := samples[i+1].Time.Sub(samples[i].Time)
+		if dt > gap {
+			dt = gap
+		}
+		kwh := math.Max(samples[i].KW-base, 0) * dt.Hours()
+		p, peak := price(samples[i].Time)
+		s.KWh += kwh
+		s.Cost += kwh * p
+		if peak {
+			s.PeakKWh += kwh
+		} else {
+			s.OffPeakKWh += kwh
+		}
+	}
+	if s.Duration > 0 {
+		s.KW = s.KWh / s.Duration.Hours()
+	}
+	return s, true
+}
+
+// Months totals sessions by meter and the month they started in
+func (c *ChargingDetector) Months(sessions []ChargingSession) []ChargingMonth {
+	loc := c.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	type key struct{ meter, month string }
+	totals := make(map[key]*ChargingMonth)
+	var months []*ChargingMonth
+	for _, s := range sessions {
+		k := key{s.MeterMacId, s.Start.In(loc).Format("2006-01")}
+		m := totals[k]
+		if m == nil {
+			m = &ChargingMonth{MeterMacId: k.meter, Month: k.month}
+			totals[k] = m
+			months = append(months, m)
+		}
+		m.Sessions++
+		m.KWh += s.KWh
+		m.PeakKWh += s.PeakKWh
+		m.OffPeakKWh += s.OffPeakKWh
+		m.Cost += s.Cost
+	}
+	result := make([]ChargingMonth, 0, len(months))
+	for _, m := range months {
+		result = append(result, *m)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].MeterMacId != result[j].MeterMacId {
+			return result[i].MeterMacId < result[j].MeterMacId
+		}
+		return result[i].Month < result[j].Month
+	})
+	return result
+}
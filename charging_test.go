@@ -0,0 +1,63 @@
+package rainforestCommon
+
+import (
+	"encoding/xml"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestChargingDetector(t *testing.T) {
+	// Every minute from Monday 2015-03-02: 500 W always on, a car
+	// charging at 7.2 kW overnight and again in the evening peak, and a
+	// half hour dryer
+	start := time.Date(2015, time.March, 2, 0, 0, 0, 0, time.UTC)
+	var frags []Fragment
+	for i := 0; i < 48*60; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		watts := 500
+		switch hour := i / 60; {
+		case hour >= 23 && hour < 27, hour == 42:
+			watts += 7200
+		case i >= 36*60 && i < 36*60+30:
+			watts += 4500
+		}
+		frags = append(frags, demandFragment(at, watts))
+	}
+	peak, _ := ParseWindow("17:00-21:00")
+	c := &ChargingDetector{Tariff: &TimeOfUse{Peak: []Window{peak}, PeakPrice: 0.3, OffPeakPrice: 0.1}}
+
+	sessions := c.Sessions(frags)
+	if len(sessions) != 2 {
+		t.Fatal("Expected two sessions got ", sessions)
+	}
+	night, evening := sessions[0], sessions[1]
+	if !night.Start.Equal(start.Add(23*time.Hour)) || night.Duration != 4*time.Hour {
+		t.Error("Expected four hours from 23:00 got ", night)
+	}
+	if math.Abs(night.KWh-28.8) > 1e-9 || math.Abs(night.Cost-2.88) > 1e-9 || night.PeakKWh != 0 {
+		t.Error("Expected 28.8 kWh off peak got ", night)
+	}
+	if math.Abs(evening.PeakKWh-7.2) > 1e-9 || math.Abs(evening.Cost-2.16) > 1e-9 {
+		t.Error("Expected 7.2 kWh on peak got ", evening)
+	}
+
+	months := c.Months(sessions)
+	if len(months) != 1 || months[0].Month != "2015-03" || months[0].Sessions != 2 || math.Abs(months[0].OffPeakKWh-28.8) > 1e-9 {
+		t.Error("Expected one month got ", months)
+	}
+
+	// Without a tariff the meter's price and tier are used
+	price, _ := NewFragment(PriceCluster{
+		XMLName:        xml.Name{Local: "PriceCluster"},
+		MeterMacId:     "0x01",
+		Price:          "0x00000014",
+		TrailingDigits: "0x02",
+		Tier:           "0x02",
+	})
+	c.Tariff = nil
+	sessions = c.Sessions(append([]Fragment{price}, frags...))
+	if len(sessions) != 2 || math.Abs(sessions[0].Cost-28.8*0.2) > 1e-9 || sessions[0].OffPeakKWh != 0 {
+		t.Error("Expected the meter's tier 2 price got ", sessions)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The rules of the alerts a ClockMonitor sends
+const (
+	RuleClockJump     = "clock jump"
+	RuleUTCOffsetJump = "utc offset jump"
+)
+
+// A ClockEstimate is what a ClockMonitor knows about one meter's clock
+type ClockEstimate struct {
+	MeterMacId string `json:"meterMacId"`
+
+	// Offset is meter time minus host time, now
+	Offset time.Duration `json:"offset"`
+
+	// Drift is how fast Offset is changing, in seconds per day.
+	// Positive means the meter is gaining.
+	Drift float64 `json:"drift"`
+
+	// UTCOffset is LocalTime - UTCTime in the newest TimeCluster
+	UTCOffset time.Duration `json:"utcOffset"`
+
+	// StandardOffset is the smallest UTCOffset seen.  ObservesDST is
+	// set once offsets an hour apart have been seen, and InDST when
+	// the meter is using the larger one.
+	StandardOffset time.Duration `json:"standardOffset"`
+	ObservesDST    bool          `json:"observesDst"`
+	InDST          bool          `json:"inDst"`
+
+	Samples int       `json:"samples"`
+	Updated time.Time `json:"updated"` // host time of the newest sample
+}
+
+// Zone returns a fixed zone for the meter's current local time
+func (c ClockEstimate) Zone() *time.Location {
+	sign, m := '+', int(c.UTCOffset.Minutes())
+	if m < 0 {
+		sign, m = '-', -m
+	}
+	return time.FixedZone(fmt.Sprintf("UTC%c%02d:%02d", sign, m/60, m%60), int(c.UTCOffset.Seconds()))
+}
+
+// A ClockMonitor compares the UTCTime in TimeCluster fragments with the
+// host clock.  It estimates each meter's offset and drift, infers the
+// meter's time zone from LocalTime, and alerts when either offset
+// jumps.  It is a Sink.
+type ClockMonitor struct {
+	// Window is how much history the drift is fitted over, 24 hours
+	// if zero
+	Window time.Duration
+
+	// Jump is how far a sample can be from the fitted offset before
+	// the meter's clock is taken to have been set, 30 seconds if zero.
+	// The history is discarded after a jump.
+	Jump time.Duration
+
+	// Now returns the host time a fragment was received.  time.Now is
+	// used if nil.
+	Now func() time.Time
+
+	// Errors, if not nil, is called with errors from notifiers
+	Errors func(error)
+
+	notifiers []Notifier
+	mu        sync.Mutex
+	meters    map[string]*clockState
+}
+
+type clockSample struct {
+	host   time.Time
+	offset float64 // seconds
+}
+
+type clockState struct {
+	samples   []clockSample
+	utcOffset time.Duration
+	offsets   map[time.Duration]bool // UTC offsets seen
+}
+
+// NewClockMonitor returns a monitor that sends alerts to notifiers
+func NewClockMonitor(notifiers ...Notifier) *ClockMonitor {
+	return &ClockMonitor{notifiers: notifiers, meters: make(map[string]*clockState)}
+}
+
+func (c *ClockMonitor) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+func (c *ClockMonitor) window() time.Duration {
+	if c.Window > 0 {
+		return c.Window
+	}
+	return 24 * time.Hour
+}
+
+func (c *ClockMonitor) jump() time.Duration {
+	if c.Jump > 0 {
+		return c.Jump
+	}
+	return 30 * time.Second
+}
+
+// Write records the TimeCluster fragments in frags, taking them to
+// have been received now
+func (c *ClockMonitor) Write(ctx context.Context, frags []Fragment) error {
+	now := c.now()
+	for _, f := range frags {
+		if tc, ok := f.Packet.(TimeCluster); ok {
+			c.Update(ctx, tc, now)
+		}
+	}
+	return nil
+}
+
+// Close does nothing
+func (c *ClockMonitor) Close() error {
+	return nil
+}
+
+// Update records a TimeCluster received at host time
+func (c *ClockMonitor) Update(ctx context.Context, tc TimeCluster, host time.Time) {
+	utc, err := DecodeMeterTime(tc.UTCTime)
+	if err != nil {
+		return
+	}
+	meter := NormalizeMac(tc.MeterMacId)
+	offset := utc.Sub(host).Seconds()
+
+	var alerts []Alert
+	c.mu.Lock()
+	s := c.meters[meter]
+	if s == nil {
+		s = &clockState{offsets: make(map[time.Duration]bool)}
+		c.meters[meter] = s
+	}
+
+	if len(s.samples) > 0 {
+		predicted, _ := fit(s.samples, host)
+		if d := offset - predicted; math.Abs(d) > c.jump().Seconds() {
+			alerts = append(alerts, Alert{
+				Rule:    RuleClockJump,
+				Meter:   meter,
+				State:   Firing,
+				Message: fmt.Sprintf("meter clock moved %v", seconds(d)),
+				Value:   d,
+				Started: host,
+			})
+			s.samples = nil
+		}
+	}
+	s.samples = append(s.samples, clockSample{host, offset})
+	cutoff := host.Add(-c.window())
+	for len(s.samples) > 2 && s.samples[0].host.Before(cutoff) {
+		s.samples = s.samples[1:]
+	}
+
+	if local, err := DecodeMeterTime(tc.LocalTime); err == nil {
+		// Zones are whole quarter hours; round away the second the
+		// two times might straddle
+		u := local.Sub(utc).Round(15 * time.Minute)
+		if len(s.offsets) > 0 && u != s.utcOffset {
+			d := u - s.utcOffset
+			if d != time.Hour && d != -time.Hour {
+				alerts = append(alerts, Alert{
+					Rule:    RuleUTCOffsetJump,
+					Meter:   meter,
+					State:   Firing,
+					Message: fmt.Sprintf("meter utc offset changed from %v to %v", s.utcOffset, u),
+					Value:   d.Seconds(),
+					Started: host,
+				})
+				// A new zone; forget the old one's offsets
+				s.offsets = make(map[time.Duration]bool)
+			}
+		}
+		s.utcOffset = u
+		s.offsets[u] = true
+	}
+	c.mu.Unlock()
+
+	for _, a := range alerts {
+		for _, n := range c.notifiers {
+			if err := n.Notify(ctx, a); err != nil && c.Errors != nil {
+				c.Errors(err)
+			}
+		}
+	}
+}
+
+// seconds turns float seconds into a Duration for printing
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// fit returns the offset, in seconds, that a least squares line
+// through samples gives at t, and the line's slope in seconds per
+// second
+func fit(samples []clockSample, t time.Time) (offset, slope float64) {
+	n := float64(len(samples))
+	t0 := samples[0].host
+	var sx, sy, sxx, sxy float64
+	for _, s := range samples {
+		x := s.host.Sub(t0).Seconds()
+		sx += x
+		sy += s.offset
+		sxx += x * x
+		sxy += x * s.offset
+	}
+	if d := n*sxx - sx*sx; d > 0 {
+		slope = (n*sxy - sx*sy) / d
+	}
+	intercept := (sy - slope*sx) / n
+	return intercept + slope*t.Sub(t0).Seconds(), slope
+}
+
+// Estimate returns what is known about a meter's clock at host time now
+func (c *ClockMonitor) Estimate(meter string, now time.Time) (ClockEstimate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	meter = NormalizeMac(meter)
+	s, ok := c.meters[meter]
+	if !ok || len(s.samples) == 0 {
+		return ClockEstimate{}, false
+	}
+	offset, slope := fit(s.samples, now)
+	e := ClockEstimate{
+		MeterMacId: meter,
+		Offset:     seconds(offset).Round(time.Millisecond),
+		Drift:      slope * 86400,
+		UTCOffset:  s.utcOffset,
+		Samples:    len(s.samples),
+		Updated:    s.samples[len(s.samples)-1].host,
+	}
+	first := true
+	for u := range s.offsets {
+		if first || u < e.StandardOffset {
+			e.StandardOffset = u
+		}
+		first = false
+	}
+	for u := range s.offsets {
+		if u-e.StandardOffset == time.Hour {
+			e.ObservesDST = true
+		}
+	}
+	e.InDST = e.ObservesDST && e.UTCOffset != e.StandardOffset
+	return e, true
+}
+
+// Meters returns the mac ids of the meters seen so far, in order
+func (c *ClockMonitor) Meters() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make([]string, 0, len(c.meters))
+	for k := range c.meters {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Correct returns f with its time moved from the meter's clock to the
+// host's.  Fragments from meters with no estimate, or without a time,
+// are returned unchanged.
+func (c *ClockMonitor) Correct(f Fragment) Fragment {
+	if f.Time.IsZero() {
+		return f
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.meters[NormalizeMac(f.MeterMacId)]
+	if !ok || len(s.samples) == 0 {
+		return f
+	}
+	// The offset is fitted against host time, but a second's error in
+	// where it is evaluated is far below the drift's resolution
+	offset, _ := fit(s.samples, f.Time)
+	f.Time = f.Time.Add(-seconds(offset)).Round(time.Second)
+	return f
+}
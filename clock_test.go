@@ -0,0 +1,64 @@
+package rainforestCommon
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClockMonitor(t *testing.T) {
+	var alerts []Alert
+	c := NewClockMonitor(NotifierFunc(func(ctx context.Context, a Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	}))
+	hex := func(t time.Time) string {
+		s, _ := EncodeMeterTime(t)
+		return s
+	}
+	// The meter is 20 seconds ahead and gains 10 seconds a day, at
+	// UTC-8 and then UTC-7
+	host := targetTimeU
+	for i := 0; i <= 48; i++ {
+		h := host.Add(time.Duration(i) * time.Hour)
+		utc := h.Add(20*time.Second + time.Duration(float64(i)*10/24*float64(time.Second)))
+		zone := -8 * time.Hour
+		if i >= 24 {
+			zone = -7 * time.Hour
+		}
+		c.Update(context.Background(), TimeCluster{MeterMacId: "0x01", UTCTime: hex(utc), LocalTime: hex(utc.Add(zone))}, h)
+	}
+	if len(alerts) != 0 {
+		t.Error("Expected no alerts for drift and DST got ", alerts)
+	}
+	now := host.Add(48 * time.Hour)
+	e, ok := c.Estimate("0x01", now)
+	if !ok {
+		t.Fatal("Expected an estimate")
+	}
+	if e.Offset < 39*time.Second || e.Offset > 41*time.Second {
+		t.Error("Expected an offset of 40s got ", e.Offset)
+	}
+	if e.Drift < 9.5 || e.Drift > 10.5 {
+		t.Error("Expected a drift of 10s a day got ", e.Drift)
+	}
+	if e.StandardOffset != -8*time.Hour || !e.ObservesDST || !e.InDST || e.Zone().String() != "UTC-07:00" {
+		t.Error("Expected UTC-8 with DST got ", e)
+	}
+
+	f := Fragment{MeterMacId: "0x01", Time: now.Add(40 * time.Second)}
+	if got := c.Correct(f).Time; got.Sub(now) > time.Second || now.Sub(got) > time.Second {
+		t.Error("Expected the corrected time ", now, " got ", got)
+	}
+
+	// The meter's clock is set back five minutes, and its zone changed
+	later := now.Add(time.Hour)
+	set := later.Add(-5 * time.Minute)
+	c.Update(context.Background(), TimeCluster{MeterMacId: "0x01", UTCTime: hex(set), LocalTime: hex(set.Add(-5 * time.Hour))}, later)
+	if len(alerts) != 2 || alerts[0].Rule != RuleClockJump || alerts[1].Rule != RuleUTCOffsetJump {
+		t.Fatal("Expected a clock jump and a utc offset jump got ", alerts)
+	}
+	if e, _ := c.Estimate("0x01", later); e.Offset != -5*time.Minute || e.Samples != 1 || e.ObservesDST {
+		t.Error("Expected the history to be reset got ", e)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// appliances prints the appliance events found in the demand in
+// capture files, grouped by power, as json
+func appliances(args []string) error {
+	fs := flag.NewFlagSet("appliances", flag.ExitOnError)
+	meters := fs.String("meter", "", "comma separated meter mac ids")
+	since := fs.String("since", "", "only fragments at or after this time")
+	until := fs.String("until", "", "only fragments before this time")
+	minStep := fs.Float64("min-step", 0.3, "smallest change in kW counted")
+	labels := fs.String("label", "", "names of appliances by kW, e.g. dryer=4.5,well pump=1.1")
+	fs.Parse(args)
+
+	filter, err := makeFilter("InstantaneousDemand", *meters, *since, *until)
+	if err != nil {
+		return err
+	}
+	d := &rf.ApplianceDetector{MinStep: *minStep}
+	if d.Labels, err = parseLabels(*labels); err != nil {
+		return err
+	}
+
+	frags, err := readFragments(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	events := d.Detect(frags)
+	clusters := d.Cluster(events)
+	return printJSON(struct {
+		Clusters []rf.ApplianceCluster `json:"clusters"`
+		Events   []rf.ApplianceEvent   `json:"events"`
+	}{clusters, events})
+}
+
+// parseLabels reads a comma separated list of name=kW
+func parseLabels(s string) ([]rf.ApplianceLabel, error) {
+	var labels []rf.ApplianceLabel
+	for _, v := range splitList(s) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad label %q, want name=kW", v)
+		}
+		kw, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, rf.ApplianceLabel{Name: strings.TrimSpace(parts[0]), KW: kw})
+	}
+	return labels, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// baseload prints the always on demand of each meter in capture files,
+// as json
+func baseload(args []string) error {
+	fs := flag.NewFlagSet("baseload", flag.ExitOnError)
+	meters := fs.String("meter", "", "comma separated meter mac ids")
+	night := fs.String("night", "01:00-05:00", "when the house is asleep")
+	zone := fs.String("zone", "UTC", "time zone of the night, e.g. America/Denver")
+	pct := fs.Float64("percentile", 10, "percentile of each night's demand taken as its baseload")
+	price := fs.Float64("price", 0, "cost per kWh, instead of the meter's price")
+	fs.Parse(args)
+
+	filter, err := makeFilter("", *meters, "", "")
+	if err != nil {
+		return err
+	}
+	b := &rf.Baseload{Percentile: *pct, Price: *price}
+	if b.Night, err = rf.ParseWindow(*night); err != nil {
+		return err
+	}
+	if b.Location, err = time.LoadLocation(*zone); err != nil {
+		return err
+	}
+
+	frags, err := readFragments(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	return printJSON(b.Report(frags))
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// battery prints what a battery would have done with each meter's
+// demand, and saved, as json
+func battery(args []string) error {
+	fs := flag.NewFlagSet("battery", flag.ExitOnError)
+	meters := fs.String("meter", "", "comma separated meter mac ids")
+	since := fs.String("since", "", "only fragments at or after this time")
+	until := fs.String("until", "", "only fragments before this time")
+	capacity := fs.Float64("capacity", 13.5, "usable kWh")
+	power := fs.Float64("power", 5, "charge and discharge limit in kW")
+	efficiency := fs.Float64("efficiency", 0.9, "round trip efficiency")
+	reserve := fs.Float64("reserve", 0, "fraction of the capacity kept in reserve")
+	strategy := fs.String("strategy", rf.StrategySelfConsumption, "arbitrage, peak_shaving or self_consumption")
+	shaveAbove := fs.Float64("shave-above", 0, "kW peak shaving holds demand to; the peak less -power if 0")
+	step := fs.Duration("step", 15*time.Minute, "interval demand is averaged over")
+	plans := fs.String("plans", "", "json file of tariffs to price with, instead of the meter's price")
+	plan := fs.String("plan", "", "name of the tariff in -plans; the first if empty")
+	zone := fs.String("zone", "UTC", "time zone of days and the tariff's windows, e.g. America/Denver")
+	fs.Parse(args)
+
+	filter, err := makeFilter("", *meters, *since, *until)
+	if err != nil {
+		return err
+	}
+	b := &rf.Battery{CapacityKWh: *capacity, PowerKW: *power, Efficiency: *efficiency,
+		Reserve: *reserve, Strategy: *strategy, ShaveAbove: *shaveAbove, Step: *step}
+	if b.Location, err = time.LoadLocation(*zone); err != nil {
+		return err
+	}
+	if *plans != "" {
+		if b.Tariff, err = readTariff(*plans, *plan); err != nil {
+			return err
+		}
+	}
+
+	frags, err := readFragments(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	sims, err := b.Simulate(frags)
+	if err != nil {
+		return err
+	}
+	return printJSON(sims)
+}
+
+// readTariff reads the tariff called name, or the first, from a json
+// file of tariffs
+func readTariff(file, name string) (*rf.Tariff, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	tariffs, err := rf.ReadTariffs(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	for i := range tariffs {
+		if name == "" || tariffs[i].Name == name {
+			return &tariffs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no tariff %q in %s", name, file)
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// carbon prints the emissions of each meter's use by interval, day or
+// month, in the same formats as decode
+func carbon(args []string) error {
+	fs := flag.NewFlagSet("carbon", flag.ExitOnError)
+	format := fs.String("format", rf.FormatText, "output format: text, json or csv")
+	meters := fs.String("meter", "", "comma separated meter mac ids")
+	since := fs.String("since", "", "only fragments at or after this time")
+	until := fs.String("until", "", "only fragments before this time")
+	intensity := fs.String("intensity", "", "csv of time,gCO2e/kWh, hourly or marginal")
+	by := fs.String("by", "day", "interval, day or month")
+	clean := fs.Float64("clean", 25, "percentage of each day's hours counted as the cleanest")
+	zone := fs.String("zone", "UTC", "time zone days and months start in, e.g. America/Denver")
+	fs.Parse(args)
+
+	if *intensity == "" {
+		return errors.New("-intensity is needed")
+	}
+	filter, err := makeFilter("", *meters, *since, *until)
+	if err != nil {
+		return err
+	}
+	c := &rf.CarbonAccount{Clean: *clean}
+	if c.Location, err = time.LoadLocation(*zone); err != nil {
+		return err
+	}
+	file, err := os.Open(*intensity)
+	if err != nil {
+		return err
+	}
+	c.Intensity, err = rf.ReadCarbonIntensity(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	frags, err := readFragments(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	intervals := c.Intervals(frags)
+	var records []rf.Record
+	switch *by {
+	case "interval":
+		for _, i := range intervals {
+			records = append(records, i)
+		}
+	case "day", "month":
+		totals := c.Days(intervals)
+		if *by == "month" {
+			totals = c.Months(intervals)
+		}
+		for _, t := range totals {
+			records = append(records, t)
+		}
+	default:
+		return fmt.Errorf("bad -by %q, want interval, day or month", *by)
+	}
+
+	w, err := rf.NewRecordWriter(os.Stdout, *format)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err = w.Write(r); err != nil {
+			break
+		}
+	}
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// charging prints the EV charging sessions found in capture files, and
+// their monthly totals, as json
+func charging(args []string) error {
+	fs := flag.NewFlagSet("charging", flag.ExitOnError)
+	meters := fs.String("meter", "", "comma separated meter mac ids")
+	since := fs.String("since", "", "only fragments at or after this time")
+	until := fs.String("until", "", "only fragments before this time")
+	minKW := fs.Float64("min-kw", 3, "smallest charging power in kW")
+	zone := fs.String("zone", "UTC", "time zone of the tariff and months, e.g. America/Denver")
+	peak := fs.String("peak", "", "comma separated peak windows, e.g. 17:00-21:00; the meter's price is used if empty")
+	weekends := fs.Bool("weekends", false, "peak windows apply on weekends too")
+	peakPrice := fs.Float64("peak-price", 0, "price per kWh on peak")
+	offPeakPrice := fs.Float64("off-peak-price", 0, "price per kWh off peak")
+	fs.Parse(args)
+
+	filter, err := makeFilter("", *meters, *since, *until)
+	if err != nil {
+		return err
+	}
+	c := &rf.ChargingDetector{MinKW: *minKW}
+	if c.Location, err = time.LoadLocation(*zone); err != nil {
+		return err
+	}
+	if *peak != "" {
+		c.Tariff = &rf.TimeOfUse{Location: c.Location, Weekends: *weekends, PeakPrice: *peakPrice, OffPeakPrice: *offPeakPrice}
+		for _, s := range splitList(*peak) {
+			w, err := rf.ParseWindow(s)
+			if err != nil {
+				return err
+			}
+			c.Tariff.Peak = append(c.Tariff.Peak, w)
+		}
+	}
+
+	frags, err := readFragments(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	sessions := c.Sessions(frags)
+	return printJSON(struct {
+		Sessions []rf.ChargingSession `json:"sessions"`
+		Months   []rf.ChargingMonth   `json:"months"`
+	}{sessions, c.Months(sessions)})
+}
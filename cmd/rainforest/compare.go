@@ -0,0 +1,88 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// compare prints the weather normalized change in each meter's use
+// between two periods, as json
+func compare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	meters := fs.String("meter", "", "comma separated meter mac ids")
+	weather := fs.String("weather", "", "csv of date,temperature or date,min,max covering both periods")
+	normal := fs.String("normal", "", "csv of typical weather; both periods' weather if empty")
+	baseTemp := fs.Float64("base-temp", 18, "temperature degree days are counted from")
+	zone := fs.String("zone", "UTC", "time zone days start in, e.g. America/Denver")
+	before := fs.String("before", "", "first period as start,end dates, e.g. 2015-01-01,2015-02-01")
+	after := fs.String("after", "", "second period as start,end dates")
+	fs.Parse(args)
+
+	if *weather == "" {
+		return errors.New("-weather is needed")
+	}
+	filter, err := makeFilter("", *meters, "", "")
+	if err != nil {
+		return err
+	}
+	n := &rf.Normalizer{BaseTemp: *baseTemp}
+	if n.Location, err = time.LoadLocation(*zone); err != nil {
+		return err
+	}
+	if n.Weather, err = readWeather(*weather); err != nil {
+		return err
+	}
+	if *normal != "" {
+		if n.Normal, err = readWeather(*normal); err != nil {
+			return err
+		}
+	}
+	b, err := parseSpan(*before, n.Location)
+	if err != nil {
+		return err
+	}
+	a, err := parseSpan(*after, n.Location)
+	if err != nil {
+		return err
+	}
+
+	frags, err := readFragments(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	return printJSON(n.Compare(frags, b, a))
+}
+
+// readWeather reads a weather csv file
+func readWeather(name string) (rf.Weather, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return rf.ReadWeather(file)
+}
+
+// parseSpan reads start,end dates
+func parseSpan(s string, loc *time.Location) (rf.Span, error) {
+	dates := splitList(s)
+	if len(dates) != 2 {
+		return rf.Span{}, fmt.Errorf("bad period %q, want start,end dates", s)
+	}
+	var span rf.Span
+	var err error
+	if span.Start, err = time.ParseInLocation("2006-01-02", dates[0], loc); err != nil {
+		return span, err
+	}
+	span.End, err = time.ParseInLocation("2006-01-02", dates[1], loc)
+	return span, err
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// decode prints every fragment in the named files
+func decode(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	format := fs.String("format", rf.FormatText, "output format: text, json or csv")
+	fs.Parse(args)
+
+	w, err := rf.NewRecordWriter(os.Stdout, *format)
+	if err != nil {
+		return err
+	}
+	err = eachFragment(fs.Args(), func(f rf.Fragment) error {
+		return w.Write(f)
+	})
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// eachFragment calls fn with every fragment in the named files, or in
+// standard input if there are none
+func eachFragment(files []string, fn func(rf.Fragment) error) error {
+	if len(files) == 0 {
+		return decodeReader(os.Stdin, "stdin", fn)
+	}
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = decodeReader(file, name, fn)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFragments returns the fragments in the named files that pass
+// filter
+func readFragments(files []string, filter rf.Filter) ([]rf.Fragment, error) {
+	var frags []rf.Fragment
+	err := eachFragment(files, func(f rf.Fragment) error {
+		if filter.Match(f) {
+			frags = append(frags, f)
+		}
+		return nil
+	})
+	return frags, err
+}
+
+// printJSON writes v to standard output as indented json
+func printJSON(v interface{}) error {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+func decodeReader(r io.Reader, name string, fn func(rf.Fragment) error) error {
+	d := rf.NewDecoder(r)
+	for {
+		f, err := d.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// forecast prints each meter's projected use and cost to the end of
+// the billing period, as json
+func forecast(args []string) error {
+	fs := flag.NewFlagSet("forecast", flag.ExitOnError)
+	meters := fs.String("meter", "", "comma separated meter mac ids")
+	billingDay := fs.Int("billing-day", 1, "day of the month the billing period starts, or the last day in shorter months")
+	zone := fs.String("zone", "UTC", "time zone of the billing period, e.g. America/Denver")
+	price := fs.Float64("price", 0, "cost per kWh, instead of the meter's price")
+	weather := fs.String("weather", "", "csv of date,temperature or date,min,max")
+	baseTemp := fs.Float64("base-temp", 18, "temperature degree days are counted from")
+	budget := fs.Float64("budget", 0, "most the period should cost")
+	now := fs.String("now", "", "time to forecast from, instead of the last reading")
+	fs.Parse(args)
+
+	filter, err := makeFilter("", *meters, "", "")
+	if err != nil {
+		return err
+	}
+	f := rf.NewForecaster()
+	f.BillingDay, f.Price, f.BaseTemp, f.Budget = *billingDay, *price, *baseTemp, *budget
+	if f.Location, err = time.LoadLocation(*zone); err != nil {
+		return err
+	}
+	if *weather != "" {
+		if f.Weather, err = readWeather(*weather); err != nil {
+			return err
+		}
+	}
+
+	frags, err := readFragments(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	at, err := lastTime(frags, *now)
+	if err != nil {
+		return err
+	}
+	f.Now = func() time.Time { return at }
+	return printJSON(f.Forecast(frags))
+}
+
+// lastTime parses s, or if it is empty returns the time of the latest
+// fragment, so that captures are looked at as of when they ended
+func lastTime(frags []rf.Fragment, s string) (time.Time, error) {
+	if s != "" {
+		return time.Parse(time.RFC3339, s)
+	}
+	var last time.Time
+	for _, f := range frags {
+		if f.Time.After(last) {
+			last = f.Time
+		}
+	}
+	if last.IsZero() {
+		return time.Now(), nil
+	}
+	return last, nil
+}
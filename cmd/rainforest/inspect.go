@@ -0,0 +1,146 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// inspect prints the fragments in capture files that pass a filter,
+// or a summary of them
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	format := fs.String("format", rf.FormatText, "output format: text, json or csv")
+	types := fs.String("type", "", "comma separated fragment types, e.g. InstantaneousDemand,PriceCluster")
+	meters := fs.String("meter", "", "comma separated meter mac ids")
+	since := fs.String("since", "", "only fragments at or after this time")
+	until := fs.String("until", "", "only fragments before this time")
+	summary := fs.Bool("summary", false, "print counts by fragment type and meter instead of the fragments")
+	fs.Parse(args)
+
+	filter, err := makeFilter(*types, *meters, *since, *until)
+	if err != nil {
+		return err
+	}
+
+	if *summary {
+		return summarize(fs.Args(), filter)
+	}
+
+	w, err := rf.NewRecordWriter(os.Stdout, *format)
+	if err != nil {
+		return err
+	}
+	err = eachFragment(fs.Args(), func(f rf.Fragment) error {
+		if !filter.Match(f) {
+			return nil
+		}
+		return w.Write(f)
+	})
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func makeFilter(types, meters, since, until string) (rf.Filter, error) {
+	var filter rf.Filter
+	var err error
+	filter.Names = splitList(types)
+	filter.Meters = splitList(meters)
+	if since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, err
+		}
+	}
+	if until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+type summaryKey struct {
+	name  string
+	meter string
+}
+
+type summaryRow struct {
+	count       int
+	first, last time.Time
+}
+
+func summarize(files []string, filter rf.Filter) error {
+	rows := make(map[summaryKey]*summaryRow)
+	err := eachFragment(files, func(f rf.Fragment) error {
+		if !filter.Match(f) {
+			return nil
+		}
+		k := summaryKey{f.Name, f.MeterMacId}
+		r := rows[k]
+		if r == nil {
+			r = &summaryRow{}
+			rows[k] = r
+		}
+		r.count++
+		if !f.Time.IsZero() {
+			if r.first.IsZero() || f.Time.Before(r.first) {
+				r.first = f.Time
+			}
+			if f.Time.After(r.last) {
+				r.last = f.Time
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]summaryKey, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].meter < keys[j].meter
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FRAGMENT\tMETER\tCOUNT\tFIRST\tLAST")
+	for _, k := range keys {
+		r := rows[k]
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", k.name, k.meter, r.count, formatTime(r.first), formatTime(r.last))
+	}
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
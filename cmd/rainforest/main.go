@@ -0,0 +1,65 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+// Command rainforest decodes, follows and inspects the xml written by
+// Rainforest Eagle and RAVEn devices.
+//
+// Usage:
+//
+//	rainforest decode [-format text|json|csv] [file ...]
+//	rainforest tail [-format text|json|csv] -serial /dev/ttyUSB0
+//	rainforest tail [-format text|json|csv] -listen :8080
+//	rainforest inspect [-type names] [-meter macs] [-since t] [-until t] [-summary] file ...
+//	rainforest quality [-type names] [-meter macs] [-interval type=d,...] [-max-demand kW] file ...
+//	rainforest baseload [-meter macs] [-night 01:00-05:00] [-zone tz] [-percentile p] [-price p] file ...
+//	rainforest appliances [-meter macs] [-since t] [-until t] [-min-step kW] [-label name=kW,...] file ...
+//	rainforest charging [-meter macs] [-since t] [-until t] [-min-kw kW] [-zone tz] [-peak windows] [-peak-price p] [-off-peak-price p] file ...
+//	rainforest forecast [-meter macs] [-billing-day n] [-zone tz] [-price p] [-weather csv] [-base-temp t] [-budget b] [-now t] file ...
+//	rainforest compare -weather csv -before start,end -after start,end [-meter macs] [-normal csv] [-base-temp t] [-zone tz] file ...
+//	rainforest tariffs -plans json [-meter macs] [-since t] [-until t] [-zone tz] file ...
+//	rainforest battery [-strategy s] [-capacity kWh] [-power kW] [-efficiency e] [-reserve r] [-shave-above kW] [-plans json [-plan name]] [-meter macs] [-since t] [-until t] [-zone tz] file ...
+//	rainforest carbon -intensity csv [-by interval|day|month] [-format text|json|csv] [-clean pct] [-meter macs] [-since t] [-until t] [-zone tz] file ...
+//
+// Files are read from standard input when none are given.  Times are
+// RFC 3339, e.g. 2015-03-14T09:26:53Z.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+var commands = map[string]func(args []string) error{
+	"decode":     decode,
+	"tail":       tail,
+	"inspect":    inspect,
+	"quality":    quality,
+	"baseload":   baseload,
+	"appliances": appliances,
+	"charging":   charging,
+	"forecast":   forecast,
+	"compare":    compare,
+	"tariffs":    tariffs,
+	"battery":    battery,
+	"carbon":     carbon,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: rainforest decode|tail|inspect|quality|baseload|appliances|charging|forecast|compare|tariffs|battery|carbon [flags] [file ...]\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := cmd(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "rainforest %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// quality prints a data quality report for each meter in capture
+// files, as json
+func quality(args []string) error {
+	fs := flag.NewFlagSet("quality", flag.ExitOnError)
+	types := fs.String("type", "", "comma separated fragment types, e.g. InstantaneousDemand,PriceCluster")
+	meters := fs.String("meter", "", "comma separated meter mac ids")
+	since := fs.String("since", "", "only fragments at or after this time")
+	until := fs.String("until", "", "only fragments before this time")
+	intervals := fs.String("interval", "", "expected intervals by type, e.g. InstantaneousDemand=8s,CurrentSummationDelivered=4m")
+	maxDemand := fs.Float64("max-demand", 100, "largest plausible demand in kW")
+	fs.Parse(args)
+
+	filter, err := makeFilter(*types, *meters, *since, *until)
+	if err != nil {
+		return err
+	}
+	q := &rf.QualityCheck{MaxDemand: *maxDemand}
+	if q.Intervals, err = parseIntervals(*intervals); err != nil {
+		return err
+	}
+
+	frags, err := readFragments(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	return printJSON(q.Report(frags))
+}
+
+// parseIntervals reads a comma separated list of type=duration
+func parseIntervals(s string) (map[string]time.Duration, error) {
+	intervals := make(map[string]time.Duration)
+	for _, v := range splitList(s) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad interval %q, want type=duration", v)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		intervals[strings.TrimSpace(parts[0])] = d
+	}
+	return intervals, nil
+}
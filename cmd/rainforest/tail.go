@@ -0,0 +1,87 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// tail prints fragments as they arrive from a RAVEn or the eagle's
+// uploader
+func tail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	format := fs.String("format", rf.FormatText, "output format: text, json or csv")
+	serial := fs.String("serial", "", "RAVEn serial port, e.g. /dev/ttyUSB0")
+	listen := fs.String("listen", "", "address to accept uploader posts on, e.g. :8080")
+	fs.Parse(args)
+
+	if (*serial == "") == (*listen == "") {
+		return errors.New("Exactly one of -serial and -listen is required")
+	}
+	w, err := rf.NewRecordWriter(os.Stdout, *format)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	frags := make(chan rf.Fragment, 16)
+	done := make(chan error, 1)
+	warn := func(err error) {
+		fmt.Fprintf(os.Stderr, "rainforest tail: %v\n", err)
+	}
+
+	if *serial != "" {
+		raven, err := rf.OpenRaven(*serial)
+		if err != nil {
+			return err
+		}
+		go func() {
+			<-ctx.Done()
+			raven.Close()
+		}()
+		go func() {
+			done <- rf.ReadFragments(ctx, raven, frags, warn)
+		}()
+	} else {
+		up := rf.NewUploader(16)
+		up.Errors = warn
+		frags = up.Fragments
+		srv := &http.Server{Addr: *listen, Handler: up}
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+		go func() {
+			done <- srv.ListenAndServe()
+		}()
+	}
+
+	for {
+		select {
+		case f := <-frags:
+			if err := w.Write(f); err != nil {
+				return err
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		case err := <-done:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// tariffs prints what each meter's use would have cost on each of a
+// set of rate plans, cheapest first, as json
+func tariffs(args []string) error {
+	fs := flag.NewFlagSet("tariffs", flag.ExitOnError)
+	meters := fs.String("meter", "", "comma separated meter mac ids")
+	since := fs.String("since", "", "only fragments at or after this time")
+	until := fs.String("until", "", "only fragments before this time")
+	plans := fs.String("plans", "", "json file of the tariffs to compare")
+	zone := fs.String("zone", "UTC", "time zone of the tariffs' windows and months, e.g. America/Denver")
+	fs.Parse(args)
+
+	if *plans == "" {
+		return errors.New("-plans is needed")
+	}
+	filter, err := makeFilter("", *meters, *since, *until)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(*zone)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(*plans)
+	if err != nil {
+		return err
+	}
+	t, err := rf.ReadTariffs(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	frags, err := readFragments(fs.Args(), filter)
+	if err != nil {
+		return err
+	}
+	return printJSON(rf.CompareTariffs(frags, t, loc))
+}
@@ -0,0 +1,273 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// A section is one [[input]], [[output]] or [[rule]] table from the
+// config file
+type section map[string]interface{}
+
+// A config is the parsed config file
+type config struct {
+	inputs  []section
+	outputs []section
+	rules   []section
+}
+
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig reads the subset of TOML the daemon needs: [[input]],
+// [[output]] and [[rule]] tables holding strings, numbers, booleans and
+// one line arrays.
+func parseConfig(r io.Reader) (*config, error) {
+	cfg := &config{}
+	var cur section
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			cur = make(section)
+			switch line {
+			case "[[input]]":
+				cfg.inputs = append(cfg.inputs, cur)
+			case "[[output]]":
+				cfg.outputs = append(cfg.outputs, cur)
+			case "[[rule]]":
+				cfg.rules = append(cfg.rules, cur)
+			default:
+				return nil, fmt.Errorf("%d: unknown table %s", lineNo, line)
+			}
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%d: expected key = value", lineNo)
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("%d: key outside of a table", lineNo)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if _, dup := cur[key]; dup {
+			return nil, fmt.Errorf("%d: duplicate key %s", lineNo, key)
+		}
+		v, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s: %v", lineNo, key, err)
+		}
+		cur[key] = v
+	}
+	return cfg, scanner.Err()
+}
+
+// stripComment removes a # comment that isn't inside a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		return s[1 : len(s)-1], nil
+	case s[0] == '[':
+		if s[len(s)-1] != ']' {
+			return nil, fmt.Errorf("arrays must be on one line")
+		}
+		var list []interface{}
+		for _, item := range splitArray(s[1 : len(s)-1]) {
+			v, err := parseValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	}
+	if i, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("can't parse %s", s)
+}
+
+// splitArray splits the inside of an array at commas outside strings
+func splitArray(s string) []string {
+	var result []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			result = append(result, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		result = append(result, last)
+	}
+	return result
+}
+
+// key identifies a section by its contents, so a reload can tell which
+// inputs and outputs are unchanged
+func (s section) key() string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%#v;", k, s[k])
+	}
+	return b.String()
+}
+
+func (s section) str(key, def string) (string, error) {
+	v, ok := s[key]
+	if !ok {
+		return def, nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", key)
+	}
+	return str, nil
+}
+
+// required is str for keys that must be present
+func (s section) required(key string) (string, error) {
+	v, err := s.str(key, "")
+	if err == nil && v == "" {
+		err = fmt.Errorf("%s is required", key)
+	}
+	return v, err
+}
+
+func (s section) integer(key string, def int) (int, error) {
+	v, ok := s[key]
+	if !ok {
+		return def, nil
+	}
+	i, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%s must be an integer", key)
+	}
+	return int(i), nil
+}
+
+func (s section) boolean(key string) (bool, error) {
+	v, ok := s[key]
+	if !ok {
+		return false, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s must be true or false", key)
+	}
+	return b, nil
+}
+
+func (s section) strs(key string) ([]string, error) {
+	v, ok := s[key]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be an array of strings", key)
+	}
+	var result []string
+	for _, item := range list {
+		str, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be an array of strings", key)
+		}
+		result = append(result, str)
+	}
+	return result, nil
+}
+
+func (s section) duration(key string, def time.Duration) (time.Duration, error) {
+	str, err := s.str(key, "")
+	if err != nil || str == "" {
+		return def, err
+	}
+	return time.ParseDuration(str)
+}
+
+// filter returns the types and meters keys as a fragment filter
+func (s section) filter() (rf.Filter, error) {
+	var f rf.Filter
+	var err error
+	if f.Names, err = s.strs("types"); err != nil {
+		return f, err
+	}
+	f.Meters, err = s.strs("meters")
+	return f, err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+# comment
+[[input]]
+type = "poller"
+url = "http://eagle/cgi-bin/post_manager"  # trailing comment
+interval = "10s"
+commands = ["get_instantaneous_demand", 'get_price']
+
+[[output]]
+type = "file"
+dir = "/tmp/#notacomment"
+types = ["InstantaneousDemand"]
+`
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.inputs) != 1 || len(cfg.outputs) != 1 {
+		t.Fatal("Expected 1 input and 1 output got ", len(cfg.inputs), " ", len(cfg.outputs))
+	}
+	in := cfg.inputs[0]
+	if d, _ := in.duration("interval", 0); d != 10*time.Second {
+		t.Error("Expected 10s got ", d)
+	}
+	if c, _ := in.strs("commands"); len(c) != 2 || c[1] != "get_price" {
+		t.Error("Expected 2 commands got ", c)
+	}
+	out := cfg.outputs[0]
+	if dir, _ := out.str("dir", ""); dir != "/tmp/#notacomment" {
+		t.Error("Expected /tmp/#notacomment got ", dir)
+	}
+	if f, _ := out.filter(); len(f.Names) != 1 {
+		t.Error("Expected a types filter got ", f)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, bad := range []string{
+		"type = \"file\"",
+		"[input]\ntype = \"file\"",
+		"[[output]]\ntype",
+		"[[output]]\ntype = \"a\"\ntype = \"b\"",
+		"[[output]]\ntypes = [\"a\",\n\"b\"]",
+	} {
+		if _, err := parseConfig(strings.NewReader(bad)); err == nil {
+			t.Error("Expected an error for ", bad)
+		}
+	}
+}
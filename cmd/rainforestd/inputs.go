@@ -0,0 +1,174 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// An input runs until ctx is done, sending the fragments it receives
+// to out
+type input func(ctx context.Context, out chan<- rf.Fragment) error
+
+// newInput builds the input described by a config section
+func newInput(s section) (input, error) {
+	kind, err := s.required("type")
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "uploader":
+		return uploaderInput(s)
+	case "raven":
+		return ravenInput(s)
+	case "poller":
+		return pollerInput(s)
+	}
+	return nil, fmt.Errorf("unknown input type %s", kind)
+}
+
+// uploaderInput accepts posts from the eagle's cloud uploader
+func uploaderInput(s section) (input, error) {
+	listen, err := s.required("listen")
+	if err != nil {
+		return nil, err
+	}
+	path, err := s.str("path", "/")
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, out chan<- rf.Fragment) error {
+		up := rf.NewUploader(0)
+		up.Errors = func(err error) {
+			log.Printf("uploader %s: %v", listen, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle(path, up)
+		srv := &http.Server{Addr: listen, Handler: mux}
+		// Fragments are forwarded until the server has shut down, so
+		// that handlers still sending don't block forever
+		forwarded := make(chan struct{})
+		defer func() { <-forwarded }()
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stopped := make(chan struct{})
+		go func() {
+			defer close(forwarded)
+			for {
+				select {
+				case f := <-up.Fragments:
+					select {
+					case out <- f:
+					case <-stopped:
+						return
+					}
+				case <-stopped:
+					return
+				}
+			}
+		}()
+		go func() {
+			defer close(stopped)
+			<-ctx.Done()
+			shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if srv.Shutdown(shutdown) != nil {
+				// Closing the connections cancels the requests still
+				// waiting
+				srv.Close()
+			}
+		}()
+		err := srv.ListenAndServe()
+		if err == http.ErrServerClosed {
+			return ctx.Err()
+		}
+		return err
+	}, nil
+}
+
+// ravenInput reads a RAVEn's serial port
+func ravenInput(s section) (input, error) {
+	port, err := s.required("port")
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, out chan<- rf.Fragment) error {
+		raven, err := rf.OpenRaven(port)
+		if err != nil {
+			return err
+		}
+		go func() {
+			<-ctx.Done()
+			raven.Close()
+		}()
+		err = rf.ReadFragments(ctx, raven, out, func(err error) {
+			log.Printf("raven %s: %v", port, err)
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}, nil
+}
+
+// pollerInput polls an eagle's local api
+func pollerInput(s section) (input, error) {
+	url, err := s.required("url")
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.str("user", "")
+	if err != nil {
+		return nil, err
+	}
+	password, err := s.str("password", "")
+	if err != nil {
+		return nil, err
+	}
+	mac, err := s.str("mac", "")
+	if err != nil {
+		return nil, err
+	}
+	interval, err := s.duration("interval", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	commands, err := s.strs("commands")
+	if err != nil {
+		return nil, err
+	}
+	if len(commands) == 0 {
+		commands = []string{"get_instantaneous_demand"}
+	}
+	api, err := s.str("api", "legacy")
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: interval}
+	var commander rf.Commander
+	switch api {
+	case "legacy":
+		commander = &rf.LocalClient{URL: url, User: user, Password: password, Client: client}
+	case "eagle200":
+		device, err := s.str("device_mac", "")
+		if err != nil {
+			return nil, err
+		}
+		commander = &rf.Eagle200Client{URL: url, User: user, Password: password, MacId: device, Client: client}
+	default:
+		return nil, fmt.Errorf("api must be legacy or eagle200")
+	}
+	return func(ctx context.Context, out chan<- rf.Fragment) error {
+		return rf.Poll(ctx, commander, mac, commands, interval, out, func(err error) {
+			log.Printf("poller %s: %v", url, err)
+		})
+	}, nil
+}
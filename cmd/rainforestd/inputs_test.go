@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+const demandPost = `<rainforest>
+<InstantaneousDemand>
+  <MeterMacId>0x01</MeterMacId>
+  <Demand>0x0007d0</Demand>
+  <Multiplier>0x00000001</Multiplier>
+  <Divisor>0x000003e8</Divisor>
+</InstantaneousDemand>
+<InstantaneousDemand>
+  <MeterMacId>0x01</MeterMacId>
+  <Demand>0x0003e8</Demand>
+  <Multiplier>0x00000001</Multiplier>
+  <Divisor>0x000003e8</Divisor>
+</InstantaneousDemand>
+<InstantaneousDemand>
+  <MeterMacId>0x01</MeterMacId>
+  <Demand>0x0001f4</Demand>
+  <Multiplier>0x00000001</Multiplier>
+  <Divisor>0x000003e8</Divisor>
+</InstantaneousDemand>
+</rainforest>`
+
+func TestUploaderShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := l.Addr().String()
+	l.Close()
+
+	cfg, err := parseConfig(strings.NewReader(`
+[[input]]
+type = "uploader"
+listen = "` + listen + `"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := newInput(cfg.inputs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan rf.Fragment)
+	done := make(chan error, 1)
+	go func() { done <- in(ctx, out) }()
+
+	posted := make(chan int, 1)
+	go func() {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Post("http://"+listen+"/", "text/xml", strings.NewReader(demandPost)); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			posted <- 0
+			return
+		}
+		resp.Body.Close()
+		posted <- resp.StatusCode
+	}()
+
+	// Stop while the post is still being forwarded, then keep reading
+	// as the daemon does until its inputs return
+	select {
+	case <-out:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a fragment")
+	}
+	cancel()
+	go func() {
+		for range out {
+		}
+	}()
+
+	select {
+	case code := <-posted:
+		if code != http.StatusOK {
+			t.Error("Expected the post to succeed got ", code)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Expected the post to finish")
+	}
+	select {
+	case <-done:
+		close(out)
+	case <-time.After(3 * time.Second):
+		t.Error("Expected the input to return")
+	}
+}
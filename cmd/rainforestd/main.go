@@ -0,0 +1,326 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+// Command rainforestd reads fragments from eagles and RAVEns and sends
+// them on to Prometheus, InfluxDB, MQTT, files and webhooks.
+//
+// The config file is a subset of TOML with one [[input]] table per
+// source and one [[output]] table per destination:
+//
+//	[[input]]
+//	type = "uploader"          # posts from the eagle's cloud uploader
+//	listen = ":8080"
+//
+//	[[input]]
+//	type = "raven"             # a RAVEn usb stick
+//	port = "/dev/ttyUSB0"
+//
+//	[[input]]
+//	type = "poller"            # the eagle's local api
+//	url = "http://192.168.1.10/cgi-bin/post_manager"
+//	user = "cloud id"
+//	password = "install code"
+//	mac = "0x00135001000056ab"
+//	interval = "30s"
+//	commands = ["get_instantaneous_demand"]
+//	api = "legacy"             # or "eagle200" for an Eagle-200
+//	device_mac = "0xd8d5b9000000abcd"   # an Eagle-200's own mac id
+//
+//	[[output]]
+//	type = "prometheus"
+//	listen = ":9525"
+//
+//	[[output]]
+//	type = "influxdb"
+//	url = "http://localhost:8086/write?db=energy"
+//
+//	[[output]]
+//	type = "mqtt"
+//	broker = "localhost:1883"
+//	topic = "rainforest"
+//
+//	[[output]]
+//	type = "file"
+//	dir = "/var/lib/rainforest"
+//
+//	[[output]]
+//	type = "webhook"
+//	url = "https://example.com/hook"
+//	secret = "shared secret"   # signs each post with HMAC-SHA256
+//	dead_letter = "/var/lib/rainforest/hook.dead"
+//	alerts = true              # also post alerts from the rules
+//	types = ["PriceCluster"]   # only these fragment types
+//	meters = ["0x00135001000056ab"]
+//
+// Any output may have types and meters filters.  Outputs other than
+// prometheus queue fragments so a slow destination doesn't hold up the
+// others; these keys, all optional, control the queue:
+//
+//	name = "archive"           # shown in logs and the sink metrics
+//	queue_size = 1000          # fragments held in memory
+//	batch_size = 100           # most fragments per write
+//	batch_delay = "5s"         # how long to wait for a batch to fill
+//	policy = "drop-oldest"     # or "block" when the queue is full
+//	spool_dir = "/var/spool/rainforest/archive"
+//	max_retries = 0            # 0 retries forever
+//
+// The prometheus output also serves queue depth, drop and retry counts
+// for every other output.
+//
+// Each [[rule]] table raises an alert, written to the log and posted to
+// webhooks with alerts = true, when its condition holds; see
+// rainforestCommon.ParseRule for the syntax:
+//
+//	[[rule]]
+//	name = "high demand"
+//	when = "InstantaneousDemand > 5 for 10m"
+//	severity = "warning"
+//	meters = ["0x00135001000056ab"]
+//
+// Sending SIGHUP makes rainforestd reread the config file; inputs and
+// outputs whose settings haven't changed keep running, so no readings
+// are lost.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// A route is an output and the fragments it wants
+type route struct {
+	key    string
+	name   string
+	sink   rf.Sink
+	filter rf.Filter
+}
+
+// A runningInput is an input and the means to stop it
+type runningInput struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type daemon struct {
+	frags chan rf.Fragment
+
+	mu     sync.RWMutex
+	routes []*route
+
+	// inputs is only used by the goroutine running main
+	inputs map[string]*runningInput
+}
+
+func main() {
+	configPath := flag.String("config", "/etc/rainforestd.toml", "config file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d := &daemon{
+		frags:  make(chan rf.Fragment, 256),
+		inputs: make(map[string]*runningInput),
+	}
+	if err := d.apply(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	routed := make(chan struct{})
+	go func() {
+		d.route()
+		close(routed)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		cfg, err := loadConfig(*configPath)
+		if err == nil {
+			err = d.apply(cfg)
+		}
+		if err != nil {
+			log.Printf("reload: %v; keeping the old config", err)
+			continue
+		}
+		log.Printf("reloaded %s", *configPath)
+	}
+
+	// Stop the inputs and route what they sent before closing the
+	// outputs, so nothing queued is lost
+	for key, running := range d.inputs {
+		running.cancel()
+		<-running.done
+		delete(d.inputs, key)
+	}
+	close(d.frags)
+	<-routed
+	d.apply(&config{})
+}
+
+// apply starts and stops inputs and outputs to match cfg.  Nothing is
+// changed if any part of cfg is invalid.
+func (d *daemon) apply(cfg *config) error {
+	d.mu.RLock()
+	old := make(map[string]*route)
+	for _, r := range d.routes {
+		old[r.key] = r
+	}
+	d.mu.RUnlock()
+
+	// Build everything new before touching what is running
+	var routes []*route
+	var created []*route
+	fail := func(err error) error {
+		for _, r := range created {
+			r.sink.Close()
+		}
+		return err
+	}
+	for i, s := range cfg.outputs {
+		key := s.key()
+		if r, ok := old[key]; ok {
+			routes = append(routes, r)
+			delete(old, key)
+			continue
+		}
+		kind, _ := s.str("type", "")
+		name, err := s.str("name", fmt.Sprintf("%s-%d", kind, i+1))
+		if err != nil {
+			return fail(err)
+		}
+		filter, err := s.filter()
+		if err != nil {
+			return fail(err)
+		}
+		sink, err := newOutput(s, name, d.stats)
+		if err != nil {
+			return fail(fmt.Errorf("%s: %v", name, err))
+		}
+		r := &route{key: key, name: name, sink: sink, filter: filter}
+		routes = append(routes, r)
+		created = append(created, r)
+	}
+	if len(cfg.rules) > 0 {
+		webhooks, err := alertWebhooks(cfg.outputs)
+		if err != nil {
+			return fail(err)
+		}
+		key := rulesKey(cfg.rules, webhooks)
+		if r, ok := old[key]; ok {
+			routes = append(routes, r)
+			delete(old, key)
+		} else {
+			sink, err := newRules(cfg.rules, webhooks)
+			if err != nil {
+				return fail(err)
+			}
+			r := &route{key: key, name: "rules", sink: sink}
+			routes = append(routes, r)
+			created = append(created, r)
+		}
+	}
+	inputs := make(map[string]input)
+	for _, s := range cfg.inputs {
+		key := s.key()
+		if _, ok := d.inputs[key]; ok {
+			inputs[key] = nil
+			continue
+		}
+		in, err := newInput(s)
+		if err != nil {
+			return fail(err)
+		}
+		inputs[key] = in
+	}
+
+	// Swap the outputs; routing waits for the swap, so no fragment
+	// is lost between the old outputs and the new
+	d.mu.Lock()
+	d.routes = routes
+	d.mu.Unlock()
+	for _, r := range old {
+		if err := r.sink.Close(); err != nil {
+			log.Printf("closing %s: %v", r.name, err)
+		}
+	}
+
+	for key, running := range d.inputs {
+		if _, ok := inputs[key]; !ok {
+			running.cancel()
+			<-running.done
+			delete(d.inputs, key)
+		}
+	}
+	for key, in := range inputs {
+		if in != nil {
+			d.inputs[key] = d.start(in)
+		}
+	}
+	return nil
+}
+
+// start runs an input, restarting it after a pause if it fails
+func (d *daemon) start(in input) *runningInput {
+	ctx, cancel := context.WithCancel(context.Background())
+	running := &runningInput{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(running.done)
+		for {
+			err := in(ctx, d.frags)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("input stopped: %v; restarting", err)
+			select {
+			case <-time.After(10 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return running
+}
+
+// route sends each fragment to the outputs that want it
+func (d *daemon) route() {
+	for f := range d.frags {
+		d.mu.RLock()
+		for _, r := range d.routes {
+			if !r.filter.Match(f) {
+				continue
+			}
+			if err := r.sink.Write(context.Background(), []rf.Fragment{f}); err != nil {
+				log.Printf("%s: %v", r.name, err)
+			}
+		}
+		d.mu.RUnlock()
+	}
+}
+
+// stats returns the queue counters of the buffered outputs
+func (d *daemon) stats() map[string]rf.BufferStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	result := make(map[string]rf.BufferStats)
+	for _, r := range d.routes {
+		if b, ok := r.sink.(*rf.BufferedSink); ok {
+			result[r.name] = b.Stats()
+		}
+	}
+	return result
+}
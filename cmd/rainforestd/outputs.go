@@ -0,0 +1,249 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// newOutput builds the sink described by a config section.  Sinks
+// other than prometheus, which only keeps the latest readings in
+// memory, are wrapped in a BufferedSink.
+func newOutput(s section, name string, stats func() map[string]rf.BufferStats) (rf.Sink, error) {
+	kind, err := s.required("type")
+	if err != nil {
+		return nil, err
+	}
+	if kind == "prometheus" {
+		return prometheusOutput(s, stats)
+	}
+	opts, err := bufferOptions(s)
+	if err != nil {
+		return nil, err
+	}
+	opts.Errors = func(err error) {
+		log.Printf("%s: %v", name, err)
+	}
+	var sink rf.Sink
+	switch kind {
+	case "influxdb":
+		sink, err = influxOutput(s)
+	case "mqtt":
+		sink, err = mqttOutput(s)
+	case "file":
+		sink, err = fileOutput(s)
+	case "webhook":
+		sink, err = webhookOutput(s)
+	default:
+		err = fmt.Errorf("unknown output type %s", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rf.NewBufferedSink(sink, opts)
+}
+
+// bufferOptions reads the queueing settings common to all outputs
+func bufferOptions(s section) (rf.BufferOptions, error) {
+	var opts rf.BufferOptions
+	var err error
+	if opts.QueueSize, err = s.integer("queue_size", 0); err != nil {
+		return opts, err
+	}
+	if opts.BatchSize, err = s.integer("batch_size", 0); err != nil {
+		return opts, err
+	}
+	if opts.BatchDelay, err = s.duration("batch_delay", 0); err != nil {
+		return opts, err
+	}
+	if opts.MaxRetries, err = s.integer("max_retries", 0); err != nil {
+		return opts, err
+	}
+	if opts.SpoolDir, err = s.str("spool_dir", ""); err != nil {
+		return opts, err
+	}
+	policy, err := s.str("policy", "drop-oldest")
+	if err != nil {
+		return opts, err
+	}
+	switch policy {
+	case "drop-oldest":
+		opts.Policy = rf.DropOldest
+	case "block":
+		opts.Policy = rf.Block
+	default:
+		return opts, fmt.Errorf("policy must be drop-oldest or block")
+	}
+	return opts, nil
+}
+
+// A prometheusServer serves a Prometheus exporter until it is closed
+type prometheusServer struct {
+	*rf.Prometheus
+	listen string
+	mux    *http.ServeMux
+}
+
+func (p *prometheusServer) Close() error {
+	promListeners.Lock()
+	defer promListeners.Unlock()
+	l := promListeners.m[p.listen]
+	if l == nil {
+		return nil
+	}
+	for i, u := range l.users {
+		if u == p {
+			l.users = append(l.users[:i], l.users[i+1:]...)
+			break
+		}
+	}
+	if len(l.users) > 0 {
+		return nil
+	}
+	delete(promListeners.m, p.listen)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.srv.Shutdown(ctx)
+}
+
+// A promListener is an address the prometheus outputs listen on.  The
+// newest output using it answers, so a reload that changes an output's
+// other settings hands the port over rather than trying to bind it
+// twice, and one that is rolled back hands it back.
+type promListener struct {
+	srv   *http.Server
+	users []*prometheusServer
+}
+
+func (l *promListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	promListeners.Lock()
+	var p *prometheusServer
+	if len(l.users) > 0 {
+		p = l.users[len(l.users)-1]
+	}
+	promListeners.Unlock()
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	p.mux.ServeHTTP(w, r)
+}
+
+var promListeners = struct {
+	sync.Mutex
+	m map[string]*promListener
+}{m: make(map[string]*promListener)}
+
+func prometheusOutput(s section, stats func() map[string]rf.BufferStats) (rf.Sink, error) {
+	listen, err := s.required("listen")
+	if err != nil {
+		return nil, err
+	}
+	path, err := s.str("path", "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	p := &prometheusServer{Prometheus: rf.NewPrometheus(), listen: listen, mux: http.NewServeMux()}
+	p.Stats = stats
+	p.mux.Handle(path, p.Prometheus)
+
+	promListeners.Lock()
+	defer promListeners.Unlock()
+	l := promListeners.m[listen]
+	if l == nil {
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			return nil, err
+		}
+		l = &promListener{}
+		l.srv = &http.Server{Handler: l}
+		go func() {
+			if err := l.srv.Serve(ln); err != http.ErrServerClosed {
+				log.Printf("prometheus %s: %v", listen, err)
+			}
+		}()
+		promListeners.m[listen] = l
+	}
+	l.users = append(l.users, p)
+	return p, nil
+}
+
+func influxOutput(s section) (rf.Sink, error) {
+	var i rf.Influx
+	var err error
+	if i.URL, err = s.required("url"); err != nil {
+		return nil, err
+	}
+	if i.Token, err = s.str("token", ""); err != nil {
+		return nil, err
+	}
+	i.Client = &http.Client{Timeout: 30 * time.Second}
+	return &i, nil
+}
+
+func mqttOutput(s section) (rf.Sink, error) {
+	var m rf.MQTT
+	var err error
+	if m.Broker, err = s.required("broker"); err != nil {
+		return nil, err
+	}
+	if m.Topic, err = s.str("topic", "rainforest"); err != nil {
+		return nil, err
+	}
+	if m.ClientId, err = s.str("client_id", "rainforestd"); err != nil {
+		return nil, err
+	}
+	if m.User, err = s.str("user", ""); err != nil {
+		return nil, err
+	}
+	if m.Password, err = s.str("password", ""); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func fileOutput(s section) (rf.Sink, error) {
+	dir, err := s.required("dir")
+	if err != nil {
+		return nil, err
+	}
+	return &rf.FileStore{Dir: dir}, nil
+}
+
+func webhookOutput(s section) (rf.Sink, error) {
+	h, err := newWebhook(s)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// newWebhook reads a webhook's settings; it is used both for the
+// webhook output and to send it alerts
+func newWebhook(s section) (*rf.Webhook, error) {
+	h := &rf.Webhook{Client: &http.Client{Timeout: 30 * time.Second}}
+	var err error
+	if h.URL, err = s.required("url"); err != nil {
+		return nil, err
+	}
+	if h.Secret, err = s.str("secret", ""); err != nil {
+		return nil, err
+	}
+	if h.DeadLetter, err = s.str("dead_letter", ""); err != nil {
+		return nil, err
+	}
+	if h.MaxAttempts, err = s.integer("max_attempts", 0); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func prometheusSection(t *testing.T, listen, path string) section {
+	cfg, err := parseConfig(strings.NewReader("[[output]]\ntype = \"prometheus\"\nlisten = \"" + listen + "\"\npath = \"" + path + "\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.outputs[0]
+}
+
+func get(t *testing.T, url string) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPrometheusReload(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	old, err := prometheusOutput(prometheusSection(t, addr, "/a"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A reload that changes the path takes over the port
+	next, err := prometheusOutput(prometheusSection(t, addr, "/b"), nil)
+	if err != nil {
+		t.Fatal("Expected the new output to share the port got ", err)
+	}
+	old.Close()
+	if code := get(t, "http://"+addr+"/b"); code != http.StatusOK {
+		t.Error("Expected /b to be served got ", code)
+	}
+	if code := get(t, "http://"+addr+"/a"); code != http.StatusNotFound {
+		t.Error("Expected /a to be gone got ", code)
+	}
+	next.Close()
+
+	// A port something else holds is an error, not a log line
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if p, err := prometheusOutput(prometheusSection(t, ln.Addr().String(), "/metrics"), nil); err == nil {
+		p.Close()
+		t.Error("Expected an error binding a port in use")
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+// An alertSink is a rules engine that checks for absences and
+// long-held conditions until it is closed
+type alertSink struct {
+	*rf.Engine
+	cancel context.CancelFunc
+	queue  *alertQueue
+}
+
+func (a *alertSink) Close() error {
+	a.cancel()
+	a.queue.close(10 * time.Second)
+	return a.Engine.Close()
+}
+
+// An alertQueue passes alerts on to notifiers from a goroutine of its
+// own, as a BufferedSink does fragments, so that a slow or unreachable
+// webhook doesn't hold up routing.  Alerts that don't fit are dropped.
+type alertQueue struct {
+	notifiers []rf.Notifier
+	alerts    chan rf.Alert
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newAlertQueue(size int, notifiers ...rf.Notifier) *alertQueue {
+	q := &alertQueue{
+		notifiers: notifiers,
+		alerts:    make(chan rf.Alert, size),
+		done:      make(chan struct{}),
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	go q.run()
+	return q
+}
+
+func (q *alertQueue) Notify(ctx context.Context, a rf.Alert) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return rf.ErrClosed
+	}
+	select {
+	case q.alerts <- a:
+		return nil
+	default:
+		return fmt.Errorf("alert queue full; dropped %s %s", a.Rule, a.State)
+	}
+}
+
+func (q *alertQueue) run() {
+	defer close(q.done)
+	for a := range q.alerts {
+		for _, n := range q.notifiers {
+			if err := n.Notify(q.ctx, a); err != nil {
+				log.Printf("rules: %v", err)
+			}
+		}
+	}
+}
+
+// close delivers what is queued, giving up on it after timeout
+func (q *alertQueue) close(timeout time.Duration) {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.alerts)
+	}
+	q.mu.Unlock()
+	select {
+	case <-q.done:
+	case <-time.After(timeout):
+		q.cancel()
+		<-q.done
+	}
+	q.cancel()
+}
+
+// alertWebhooks returns the webhook outputs that asked for alerts
+func alertWebhooks(outputs []section) ([]section, error) {
+	var result []section
+	for _, s := range outputs {
+		if kind, _ := s.str("type", ""); kind != "webhook" {
+			continue
+		}
+		alerts, err := s.boolean("alerts")
+		if err != nil {
+			return nil, err
+		}
+		if alerts {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// rulesKey identifies a set of rule sections and the webhooks they
+// notify, so a reload can tell if they have changed
+func rulesKey(rules, webhooks []section) string {
+	var keys []string
+	for _, s := range rules {
+		keys = append(keys, s.key())
+	}
+	for _, s := range webhooks {
+		keys = append(keys, s.key())
+	}
+	return "rules " + strings.Join(keys, "|")
+}
+
+// newRules builds a rules engine from the [[rule]] sections.  Alerts
+// are logged and queued to be posted to the webhooks.
+func newRules(sections, webhooks []section) (rf.Sink, error) {
+	var rules []rf.Rule
+	for i, s := range sections {
+		name, err := s.str("name", fmt.Sprintf("rule-%d", i+1))
+		if err != nil {
+			return nil, err
+		}
+		when, err := s.required("when")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		r, err := rf.ParseRule(name, when)
+		if err != nil {
+			return nil, err
+		}
+		if r.Severity, err = s.str("severity", ""); err != nil {
+			return nil, err
+		}
+		if r.Meters, err = s.strs("meters"); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	var hooks []rf.Notifier
+	for _, s := range webhooks {
+		h, err := newWebhook(s)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	queue := newAlertQueue(100, hooks...)
+	e, err := rf.NewEngine(rules, rf.LogNotifier{}, queue)
+	if err != nil {
+		queue.close(0)
+		return nil, err
+	}
+	e.Errors = func(err error) {
+		log.Printf("rules: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go e.Run(ctx, 30*time.Second)
+	return &alertSink{Engine: e, cancel: cancel, queue: queue}, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	rf "github.com/tommessick/rainforestCommon"
+)
+
+func TestRulesHangingWebhook(t *testing.T) {
+	posted := make(chan struct{}, 10)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- struct{}{}
+		<-release
+	}))
+	defer srv.Close()
+
+	cfg, err := parseConfig(strings.NewReader(`
+[[output]]
+type = "webhook"
+url = "` + srv.URL + `"
+alerts = true
+
+[[rule]]
+name = "high demand"
+when = "InstantaneousDemand > 1"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks, _ := alertWebhooks(cfg.outputs)
+	sink, err := newRules(cfg.rules, webhooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, _ := rf.NewFragment(rf.InstantaneousDemand{
+		XMLName:    xml.Name{Local: "InstantaneousDemand"},
+		MeterMacId: "0x01",
+		Demand:     "0x0007d0",
+		Multiplier: "0x00000001",
+		Divisor:    "0x000003e8",
+	})
+	start := time.Now()
+	if err := sink.Write(context.Background(), []rf.Fragment{f}); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("Expected Write not to wait for the webhook; it took ", d)
+	}
+	select {
+	case <-posted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the alert to be posted")
+	}
+
+	close(release)
+	sink.Close()
+}
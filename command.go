@@ -0,0 +1,125 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"fmt"
+	"time"
+)
+
+// The names of the commands the eagle and RAVEn accept
+const (
+	CommandGetDeviceList          = "get_device_list"
+	CommandGetNetworkInfo         = "get_network_info"
+	CommandGetInstantaneousDemand = "get_instantaneous_demand"
+	CommandGetCurrentSummation    = "get_current_summation"
+	CommandGetPrice               = "get_price"
+	CommandGetMessage             = "get_message"
+	CommandConfirmMessage         = "confirm_message"
+	CommandGetTime                = "get_time"
+	CommandGetHistoryData         = "get_history_data"
+	CommandGetFastPollStatus      = "get_fast_poll_status"
+	CommandSetFastPoll            = "set_fast_poll"
+)
+
+// The limits the meter puts on fast polling
+const (
+	MaxFastPollFrequency = 255 * time.Second
+	MaxFastPollDuration  = 15 * time.Minute
+)
+
+// GetDeviceList asks the eagle for the meters it knows
+func GetDeviceList() LocalCommand {
+	return LocalCommand{Name: CommandGetDeviceList}
+}
+
+// meterCommand returns a command that takes only a meter mac id
+func meterCommand(name, macId string) LocalCommand {
+	return LocalCommand{Name: name, MacId: macId}
+}
+
+// GetNetworkInfo asks for a NetworkInfo
+func GetNetworkInfo(macId string) LocalCommand {
+	return meterCommand(CommandGetNetworkInfo, macId)
+}
+
+// GetInstantaneousDemand asks for an InstantaneousDemand
+func GetInstantaneousDemand(macId string) LocalCommand {
+	return meterCommand(CommandGetInstantaneousDemand, macId)
+}
+
+// GetCurrentSummation asks for a CurrentSummationDelivered
+func GetCurrentSummation(macId string) LocalCommand {
+	return meterCommand(CommandGetCurrentSummation, macId)
+}
+
+// GetPrice asks for a PriceCluster
+func GetPrice(macId string) LocalCommand {
+	return meterCommand(CommandGetPrice, macId)
+}
+
+// GetMessage asks for the current MessageCluster
+func GetMessage(macId string) LocalCommand {
+	return meterCommand(CommandGetMessage, macId)
+}
+
+// ConfirmMessage tells the meter that message id has been seen
+func ConfirmMessage(macId, id string) LocalCommand {
+	c := meterCommand(CommandConfirmMessage, macId)
+	c.Id = id
+	return c
+}
+
+// GetTime asks for a TimeCluster
+func GetTime(macId string) LocalCommand {
+	return meterCommand(CommandGetTime, macId)
+}
+
+// GetFastPollStatus asks for a FastPollStatus
+func GetFastPollStatus(macId string) LocalCommand {
+	return meterCommand(CommandGetFastPollStatus, macId)
+}
+
+// GetHistoryData asks for the summations between start and end, one
+// every frequency.  A zero end means up to now, and a zero frequency
+// leaves the interval to the eagle.
+func GetHistoryData(macId string, start, end time.Time, frequency time.Duration) (LocalCommand, error) {
+	c := meterCommand(CommandGetHistoryData, macId)
+	var err error
+	if c.StartTime, err = EncodeMeterTime(start); err != nil {
+		return LocalCommand{}, err
+	}
+	if !end.IsZero() {
+		if !end.After(start) {
+			return LocalCommand{}, fmt.Errorf("History end %s is not after start %s", end, start)
+		}
+		if c.EndTime, err = EncodeMeterTime(end); err != nil {
+			return LocalCommand{}, err
+		}
+	}
+	if frequency < 0 || frequency%time.Second != 0 || frequency > 0xffff*time.Second {
+		return LocalCommand{}, fmt.Errorf("Invalid history frequency %s", frequency)
+	}
+	if frequency > 0 {
+		c.Frequency = fmt.Sprintf("0x%04x", int(frequency.Seconds()))
+	}
+	return c, nil
+}
+
+// SetFastPoll asks the meter to send demand every frequency, up to
+// MaxFastPollFrequency, for duration, up to MaxFastPollDuration.  A
+// zero duration stops fast polling.
+func SetFastPoll(macId string, frequency, duration time.Duration) (LocalCommand, error) {
+	if frequency < time.Second || frequency > MaxFastPollFrequency || frequency%time.Second != 0 {
+		return LocalCommand{}, fmt.Errorf("Invalid fast poll frequency %s", frequency)
+	}
+	if duration < 0 || duration > MaxFastPollDuration || duration%time.Minute != 0 {
+		return LocalCommand{}, fmt.Errorf("Invalid fast poll duration %s", duration)
+	}
+	c := meterCommand(CommandSetFastPoll, macId)
+	c.Frequency = fmt.Sprintf("0x%04x", int(frequency.Seconds()))
+	c.Duration = fmt.Sprintf("0x%04x", int(duration.Minutes()))
+	return c, nil
+}
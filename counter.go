@@ -0,0 +1,197 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// The kinds of CounterEvent
+const (
+	CounterWrap  = "wrap"
+	CounterReset = "reset"
+)
+
+// A CounterEvent is a summation that went backwards
+type CounterEvent struct {
+	MeterMacId string    `json:"meterMacId"`
+	Kind       string    `json:"kind"`
+	Time       time.Time `json:"time"`
+	Before     float64   `json:"before"` // kWh, as read
+	After      float64   `json:"after"`
+	Modulus    float64   `json:"modulus,omitempty"` // where a wrap happened
+}
+
+// A CounterReading is a summation with the counter's wraps and resets
+// taken out.  Corrected only ever rises.
+type CounterReading struct {
+	MeterMacId string    `json:"meterMacId"`
+	Time       time.Time `json:"time"`
+	Raw        float64   `json:"raw"` // kWh
+	Corrected  float64   `json:"corrected"`
+	Event      string    `json:"event,omitempty"`
+}
+
+// A Counter stitches each meter's SummationDelivered into a continuous
+// series.  A reading lower than the last is a wrap if the last was
+// near the top of the register and the new one near the bottom.  A
+// reading no more than Tolerance lower is jitter, and the last reading
+// stands.  Otherwise the meter is taken to have been reset or replaced,
+// with the new register starting from zero.  The register holds
+// DigitsLeft whole kWh digits or, if the meter doesn't say, 48 bits.  A
+// Counter is a Sink.
+type Counter struct {
+	// Events, if not nil, is called with each wrap and reset
+	Events func(CounterEvent)
+
+	// Tolerance is how far, in kWh, a reading may fall without being a
+	// reset.  If zero it is one and a half steps of the summation's
+	// resolution, the coarser of 10^-DigitsRight kWh and Multiplier /
+	// Divisor, so only a reading that falls back by its last digit is
+	// jitter.
+	Tolerance float64
+
+	mu     sync.Mutex
+	meters map[string]*counterState
+}
+
+type counterState struct {
+	raw    float64
+	offset float64
+	time   time.Time
+}
+
+// NewCounter returns a counter that has seen no readings
+func NewCounter() *Counter {
+	return &Counter{meters: make(map[string]*counterState)}
+}
+
+// Write adds the summations in frags
+func (c *Counter) Write(ctx context.Context, frags []Fragment) error {
+	for _, f := range frags {
+		c.Add(f)
+	}
+	return nil
+}
+
+// Close does nothing
+func (c *Counter) Close() error {
+	return nil
+}
+
+// summation returns the delivered kWh in a summation and the size of
+// its register
+func summation(f Fragment) (kwh, modulus float64, ok bool) {
+	var delivered, mult, div, left string
+	switch p := f.Packet.(type) {
+	case CurrentSummationDelivered:
+		delivered, mult, div, left = p.SummationDelivered, p.Multiplier, p.Divisor, p.DigitsLeft
+	case CurrentSummation:
+		delivered, mult, div, left = p.SummationDelivered, p.Multiplier, p.Divisor, p.DigitsLeft
+	default:
+		return 0, 0, false
+	}
+	kwh, ok = scaled(delivered, mult, div)
+	if !ok || math.IsInf(kwh, 0) || math.IsNaN(kwh) {
+		return 0, 0, false
+	}
+	if digits := getval(left); digits > 0 {
+		modulus = math.Pow10(digits)
+	} else {
+		modulus, _ = scaled("0x1000000000000", mult, div)
+	}
+	return kwh, modulus, true
+}
+
+// summationStep returns the resolution of a summation in kWh
+func summationStep(f Fragment) float64 {
+	var mult, div, right string
+	switch p := f.Packet.(type) {
+	case CurrentSummationDelivered:
+		mult, div, right = p.Multiplier, p.Divisor, p.DigitsRight
+	case CurrentSummation:
+		mult, div, right = p.Multiplier, p.Divisor, p.DigitsRight
+	}
+	step, ok := scaled("0x1", mult, div)
+	if !ok || math.IsInf(step, 0) || math.IsNaN(step) {
+		step = 0
+	}
+	if digits := getval(right); digits >= 0 {
+		step = math.Max(step, math.Pow10(-digits))
+	}
+	return step
+}
+
+// Add adds one summation and returns its corrected reading.  ok is
+// false for fragments that aren't summations, and for readings older
+// than the meter's last, which are skipped.
+func (c *Counter) Add(f Fragment) (r CounterReading, ok bool) {
+	kwh, modulus, ok := summation(f)
+	if !ok || f.Time.IsZero() {
+		return CounterReading{}, false
+	}
+	meter := NormalizeMac(f.MeterMacId)
+	r = CounterReading{MeterMacId: meter, Time: f.Time, Raw: kwh}
+
+	tolerance := c.Tolerance
+	if tolerance <= 0 {
+		tolerance = 1.5 * summationStep(f)
+	}
+	var event *CounterEvent
+	c.mu.Lock()
+	s := c.meters[meter]
+	switch {
+	case s == nil:
+		s = &counterState{}
+		c.meters[meter] = s
+	case f.Time.Before(s.time):
+		c.mu.Unlock()
+		return CounterReading{}, false
+	case kwh < s.raw:
+		event = &CounterEvent{MeterMacId: meter, Time: f.Time, Before: s.raw, After: kwh}
+		switch {
+		case s.raw >= 0.9*modulus && kwh < 0.1*modulus:
+			event.Kind = CounterWrap
+			event.Modulus = modulus
+			s.offset += modulus
+		case s.raw-kwh <= tolerance:
+			// Jitter; keep the higher reading
+			event = nil
+			kwh = s.raw
+		default:
+			event.Kind = CounterReset
+			s.offset += s.raw
+		}
+		if event != nil {
+			r.Event = event.Kind
+		}
+	}
+	s.raw, s.time = kwh, f.Time
+	r.Corrected = kwh + s.offset
+	c.mu.Unlock()
+
+	if event != nil && c.Events != nil {
+		c.Events(*event)
+	}
+	return r, true
+}
+
+// Stitch returns the corrected readings for the summations in frags,
+// which should be in time order, and the wraps and resets found
+func Stitch(frags []Fragment) ([]CounterReading, []CounterEvent) {
+	var events []CounterEvent
+	c := NewCounter()
+	c.Events = func(e CounterEvent) { events = append(events, e) }
+	var readings []CounterReading
+	for _, f := range frags {
+		if r, ok := c.Add(f); ok {
+			readings = append(readings, r)
+		}
+	}
+	return readings, events
+}
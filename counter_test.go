@@ -0,0 +1,113 @@
+package rainforestCommon
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestStitch(t *testing.T) {
+	var frags []Fragment
+	add := func(minutes int, wh int) {
+		stamp, _ := EncodeMeterTime(targetTimeU.Add(time.Duration(minutes) * time.Minute))
+		f, _ := NewFragment(CurrentSummationDelivered{
+			XMLName:            xml.Name{Local: "CurrentSummationDelivered"},
+			MeterMacId:         "0x01",
+			TimeStamp:          stamp,
+			SummationDelivered: fmt.Sprintf("0x%016x", wh),
+			Multiplier:         "0x00000001",
+			Divisor:            "0x000003e8",
+			DigitsLeft:         "0x03",
+		})
+		frags = append(frags, f)
+	}
+	// A three digit register wraps at 1000 kWh, then the meter is
+	// replaced
+	add(0, 998000)
+	add(15, 999500)
+	add(30, 1000)
+	add(45, 3000)
+	add(50, 2000)
+	// The 45 minute reading arrives late and is skipped
+	frags[3], frags[4] = frags[4], frags[3]
+	add(60, 500)
+	add(75, 1500)
+
+	readings, events := Stitch(frags)
+	want := []float64{998, 999.5, 1001, 1002, 1002.5, 1003.5}
+	if len(readings) != len(want) {
+		t.Fatal("Expected ", want, " got ", readings)
+	}
+	for i, w := range want {
+		if readings[i].Corrected != w {
+			t.Error("Expected ", w, " got ", readings[i])
+		}
+	}
+	if len(events) != 2 || events[0].Kind != CounterWrap || events[0].Modulus != 1000 || events[1].Kind != CounterReset {
+		t.Error("Expected a wrap and a reset got ", events)
+	}
+	if readings[2].Event != CounterWrap || readings[4].Event != CounterReset {
+		t.Error("Expected the readings to be marked got ", readings)
+	}
+}
+
+func TestCounterJitter(t *testing.T) {
+	var frags []Fragment
+	for i, wh := range []int{100000, 99999, 100000, 100500} {
+		stamp, _ := EncodeMeterTime(targetTimeU.Add(time.Duration(i) * time.Minute))
+		f, _ := NewFragment(CurrentSummationDelivered{
+			XMLName:            xml.Name{Local: "CurrentSummationDelivered"},
+			MeterMacId:         "0x01",
+			TimeStamp:          stamp,
+			SummationDelivered: fmt.Sprintf("0x%016x", wh),
+			Multiplier:         "0x00000001",
+			Divisor:            "0x000003e8",
+		})
+		frags = append(frags, f)
+	}
+	// A reading a watt hour low is jitter, not a reset
+	readings, events := Stitch(frags)
+	want := []float64{100, 100, 100, 100.5}
+	if len(readings) != len(want) || len(events) != 0 {
+		t.Fatal("Expected ", want, " and no events got ", readings, " ", events)
+	}
+	for i, w := range want {
+		if readings[i].Corrected != w {
+			t.Error("Expected ", w, " got ", readings[i])
+		}
+	}
+	if readings[1].Raw != 99.999 {
+		t.Error("Expected the raw reading to be kept got ", readings[1])
+	}
+}
+
+func TestCounterSmallReset(t *testing.T) {
+	var frags []Fragment
+	for i, wh := range []int{500, 800, 100, 300} {
+		stamp, _ := EncodeMeterTime(targetTimeU.Add(time.Duration(i) * time.Minute))
+		f, _ := NewFragment(CurrentSummationDelivered{
+			XMLName:            xml.Name{Local: "CurrentSummationDelivered"},
+			MeterMacId:         "0x01",
+			TimeStamp:          stamp,
+			SummationDelivered: fmt.Sprintf("0x%016x", wh),
+			Multiplier:         "0x00000001",
+			Divisor:            "0x000003e8",
+			DigitsRight:        "0x03",
+		})
+		frags = append(frags, f)
+	}
+	// A new meter under a kWh in is still a reset at watt hour
+	// resolution
+	readings, events := Stitch(frags)
+	want := []float64{0.5, 0.8, 0.9, 1.1}
+	if len(readings) != len(want) || len(events) != 1 || events[0].Kind != CounterReset {
+		t.Fatal("Expected ", want, " and a reset got ", readings, " ", events)
+	}
+	for i, w := range want {
+		if math.Abs(readings[i].Corrected-w) > 1e-9 {
+			t.Error("Expected ", w, " got ", readings[i])
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The formats of uploader post
+const (
+	EnvelopeLegacy   = "legacy"
+	EnvelopeEagle200 = "eagle200"
+)
+
+// An Envelope is the rainforest element an uploader post wraps its
+// fragments in.  Legacy eagles send macId and a timestamp in seconds,
+// e.g. 1426325213s; Eagle-200s also send version and give the
+// timestamp in milliseconds, e.g. 1426325213000ms.
+type Envelope struct {
+	Format    string // "" for bare fragments, as from a RAVEn
+	MacId     string
+	Version   string
+	Timestamp time.Time
+}
+
+// newEnvelope reads the attributes of a rainforest element
+func newEnvelope(start xml.StartElement) Envelope {
+	e := Envelope{Format: EnvelopeLegacy}
+	for _, a := range start.Attr {
+		switch a.Name.Local {
+		case "macId":
+			e.MacId = a.Value
+		case "version":
+			e.Version = a.Value
+			e.Format = EnvelopeEagle200
+		case "timestamp":
+			e.Timestamp = envelopeTime(a.Value)
+		}
+	}
+	return e
+}
+
+// envelopeTime parses an envelope timestamp, or returns the zero time
+func envelopeTime(s string) time.Time {
+	unit := time.Second
+	switch {
+	case strings.HasSuffix(s, "ms"):
+		s, unit = strings.TrimSuffix(s, "ms"), time.Millisecond
+	case strings.HasSuffix(s, "s"):
+		s = strings.TrimSuffix(s, "s")
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, 0).Add(time.Duration(v) * unit).UTC()
+}
+
+// A Decoder reads fragments from a stream of xml.  The stream may be
+// an uploader post, where the fragments are wrapped in a rainforest
+// element, or the bare fragments written by a RAVEn on its serial port.
+// Elements that aren't fragments are treated as wrappers, so fragments
+// nested inside them are still found.
+//
+// Fragments in an Eagle-200 post may leave out DeviceMacId or
+// TimeStamp; the decoder fills them in from the envelope so they
+// decode the same as a legacy eagle's.
+type Decoder struct {
+	d    *xml.Decoder
+	env  Envelope // the rainforest element we are inside
+	last Envelope
+}
+
+// NewDecoder returns a decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{d: xml.NewDecoder(r)}
+}
+
+// Next returns the next fragment in the stream.  It returns io.EOF
+// when the stream is exhausted.
+func (d *Decoder) Next() (Fragment, error) {
+	for {
+		tok, err := d.d.Token()
+		if err != nil {
+			return Fragment{}, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "rainforest" {
+				d.env = newEnvelope(t)
+				d.last = d.env
+				continue
+			}
+			p, err := newPacket(t.Name.Local)
+			if err != nil {
+				// Descend into other wrappers
+				continue
+			}
+			if err := d.d.DecodeElement(p, &t); err != nil {
+				return Fragment{}, err
+			}
+			v := reflect.ValueOf(p).Elem()
+			if mac := v.FieldByName("DeviceMacId"); mac.IsValid() && mac.String() == "" {
+				mac.SetString(d.env.MacId)
+			}
+			f, err := NewFragment(v.Interface())
+			if err == nil && f.Time.IsZero() {
+				f.Time = d.env.Timestamp
+			}
+			return f, err
+		case xml.EndElement:
+			if t.Name.Local == "rainforest" {
+				d.env = Envelope{}
+			}
+		}
+	}
+}
+
+// Envelope returns the most recent rainforest element read by Next,
+// or an empty envelope if there hasn't been one
+func (d *Decoder) Envelope() Envelope {
+	return d.last
+}
+
+// DecodeAll reads every fragment in r
+func DecodeAll(r io.Reader) ([]Fragment, error) {
+	var result []Fragment
+	d := NewDecoder(r)
+	for {
+		f, err := d.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		result = append(result, f)
+	}
+}
+
+// DecodeUpload reads an uploader post, in either format, and returns
+// its envelope and fragments
+func DecodeUpload(r io.Reader) (Envelope, []Fragment, error) {
+	var result []Fragment
+	d := NewDecoder(r)
+	for {
+		f, err := d.Next()
+		if err == io.EOF {
+			return d.Envelope(), result, nil
+		}
+		if err != nil {
+			return d.Envelope(), result, err
+		}
+		result = append(result, f)
+	}
+}
+
+// ReadFragments decodes fragments from a live stream such as a serial
+// port and sends them to out until the stream ends or ctx is done.
+// Malformed xml, which is common when a port is opened part way through
+// a packet, is reported to errs (if not nil) and decoding restarts at
+// the next element.
+func ReadFragments(ctx context.Context, r io.Reader, out chan<- Fragment, errs func(error)) error {
+	br := bufio.NewReader(r)
+	for {
+		d := NewDecoder(br)
+		for {
+			f, err := d.Next()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			if err != nil {
+				if _, ok := err.(*xml.SyntaxError); !ok {
+					return err
+				}
+				if errs != nil {
+					errs(err)
+				}
+				break
+			}
+			select {
+			case out <- f:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
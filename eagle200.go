@@ -0,0 +1,400 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The variables of an Eagle-200 electric meter that map onto the
+// legacy packet types
+const (
+	VarInstantaneousDemand         = "zigbee:InstantaneousDemand"
+	VarCurrentSummationDelivered   = "zigbee:CurrentSummationDelivered"
+	VarCurrentSummationReceived    = "zigbee:CurrentSummationReceived"
+	VarPrice                       = "zigbee:Price"
+	VarPriceTier                   = "zigbee:PriceTier"
+	VarRateLabel                   = "zigbee:RateLabel"
+	VarMessage                     = "zigbee:Message"
+	VarMessageId                   = "zigbee:MessageId"
+	VarMessagePriority             = "zigbee:MessagePriority"
+	VarMessageConfirmationRequired = "zigbee:MessageConfirmationRequired"
+	VarMessageConfirmed            = "zigbee:MessageConfirmed"
+	VarMessageDurationInMinutes    = "zigbee:MessageDurationInMinutes"
+	VarMessageQueue                = "zigbee:MessageQueue"
+)
+
+// The model id of an electric meter in a device_list
+const ElectricMeter = "electric_meter"
+
+// An Eagle200Command is a request to the Eagle-200 local api
+type Eagle200Command struct {
+	XMLName       xml.Name                `xml:"Command"`
+	Name          string                  `xml:"Name"`
+	DeviceDetails *Eagle200DeviceDetails  `xml:",omitempty"`
+	Components    *Eagle200ComponentQuery `xml:",omitempty"`
+}
+
+// An Eagle200ComponentQuery picks the variables a device_query returns
+type Eagle200ComponentQuery struct {
+	All       string              `xml:",omitempty"`
+	Component []Eagle200Component `xml:",omitempty"`
+}
+
+// Eagle200DeviceDetails describes one device joined to an Eagle-200.
+// LastContact is in seconds since 1970, not the meter epoch.
+type Eagle200DeviceDetails struct {
+	Name             string `xml:",omitempty"`
+	HardwareAddress  string
+	Manufacturer     string `xml:",omitempty"`
+	ModelId          string `xml:",omitempty"`
+	Protocol         string `xml:",omitempty"`
+	LastContact      string `xml:",omitempty"`
+	ConnectionStatus string `xml:",omitempty"`
+	NetworkAddress   string `xml:",omitempty"`
+}
+
+// An Eagle200Component is a group of variables
+type Eagle200Component struct {
+	HardwareId string             `xml:",omitempty"`
+	FixedId    string             `xml:",omitempty"`
+	Name       string             `xml:"Name"`
+	Variables  []Eagle200Variable `xml:"Variables>Variable"`
+}
+
+// An Eagle200Variable is one reading.  Values are already scaled,
+// e.g. 0.512000 with Units kW.
+type Eagle200Variable struct {
+	Name        string
+	Value       string `xml:",omitempty"`
+	Units       string `xml:",omitempty"`
+	Description string `xml:",omitempty"`
+}
+
+// The reply to device_list
+type Eagle200DeviceList struct {
+	XMLName xml.Name                `xml:"DeviceList"`
+	Devices []Eagle200DeviceDetails `xml:"Device"`
+}
+
+// The reply to device_query
+type Eagle200Device struct {
+	XMLName       xml.Name `xml:"Device"`
+	DeviceDetails Eagle200DeviceDetails
+	Components    []Eagle200Component `xml:"Components>Component"`
+}
+
+// DeviceList returns the command that lists an Eagle-200's devices
+func DeviceList() Eagle200Command {
+	return Eagle200Command{Name: "device_list"}
+}
+
+// DeviceQuery returns the command that reads the named variables of a
+// device, or all of them if there are none
+func DeviceQuery(hardwareAddress string, variables ...string) Eagle200Command {
+	c := Eagle200Command{
+		Name:          "device_query",
+		DeviceDetails: &Eagle200DeviceDetails{HardwareAddress: hardwareAddress},
+		Components:    &Eagle200ComponentQuery{},
+	}
+	if len(variables) == 0 {
+		c.Components.All = "Y"
+		return c
+	}
+	component := Eagle200Component{Name: "Main"}
+	for _, v := range variables {
+		component.Variables = append(component.Variables, Eagle200Variable{Name: v})
+	}
+	c.Components.Component = []Eagle200Component{component}
+	return c
+}
+
+// Variable returns the value of the named variable in any component
+func (d Eagle200Device) Variable(name string) (string, bool) {
+	for _, c := range d.Components {
+		for _, v := range c.Variables {
+			if v.Name == name && v.Value != "" {
+				return v.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Time returns when the Eagle-200 last heard from the device, or the
+// zero time
+func (d Eagle200DeviceDetails) Time() time.Time {
+	v, err := strconv.ParseInt(d.LastContact, 0, 64)
+	if err != nil || v <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(v, 0).UTC()
+}
+
+// fixed turns a decimal reading into a hex count of 10^-digits units.
+// Negative values are written as 24 bit two's complement, the way the
+// meter sends demand.
+func fixed(value string, digits int) (string, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return "", false
+	}
+	v := int64(math.Round(f * math.Pow10(digits)))
+	if v < 0 {
+		v &= 0xffffff
+	}
+	return fmt.Sprintf("0x%x", v), true
+}
+
+// decimals returns the number of digits after the point in a decimal
+func decimals(value string) int {
+	value = strings.TrimSpace(value)
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		return len(value) - i - 1
+	}
+	return 0
+}
+
+// Fragments maps a device_query reply onto the legacy packet types, so
+// that it decodes the same as an older eagle's reply.  deviceMacId is
+// the mac id of the Eagle-200 itself.  Values are kept to the
+// thousandth of a kW or kWh, as older eagles send them.
+func (d Eagle200Device) Fragments(deviceMacId string) []Fragment {
+	meter := d.DeviceDetails.HardwareAddress
+	var stamp string
+	if t := d.DeviceDetails.Time(); !t.IsZero() {
+		stamp, _ = EncodeMeterTime(t)
+	}
+	var packets []interface{}
+
+	if v, ok := d.Variable(VarInstantaneousDemand); ok {
+		if demand, ok := fixed(v, 3); ok {
+			packets = append(packets, InstantaneousDemand{
+				XMLName:     xml.Name{Local: "InstantaneousDemand"},
+				DeviceMacId: deviceMacId,
+				MeterMacId:  meter,
+				TimeStamp:   stamp,
+				Demand:      formatHex(demand, hexWidth("", "Demand")),
+				Multiplier:  "0x00000001",
+				Divisor:     "0x000003e8",
+				DigitsRight: "0x03",
+			})
+		}
+	}
+
+	delivered, hasDelivered := d.Variable(VarCurrentSummationDelivered)
+	received, hasReceived := d.Variable(VarCurrentSummationReceived)
+	if hasDelivered || hasReceived {
+		p := CurrentSummationDelivered{
+			XMLName:     xml.Name{Local: "CurrentSummationDelivered"},
+			DeviceMacId: deviceMacId,
+			MeterMacId:  meter,
+			TimeStamp:   stamp,
+			Multiplier:  "0x00000001",
+			Divisor:     "0x000003e8",
+			DigitsRight: "0x03",
+		}
+		if v, ok := fixed(delivered, 3); ok {
+			p.SummationDelivered = formatHex(v, hexWidth("", "SummationDelivered"))
+		}
+		if v, ok := fixed(received, 3); ok {
+			p.SummationReceived = formatHex(v, hexWidth("", "SummationReceived"))
+		}
+		packets = append(packets, p)
+	}
+
+	if v, ok := d.Variable(VarPrice); ok {
+		digits := decimals(v)
+		if price, ok := fixed(v, digits); ok {
+			p := PriceCluster{
+				XMLName:        xml.Name{Local: "PriceCluster"},
+				DeviceMacId:    deviceMacId,
+				MeterMacId:     meter,
+				TimeStamp:      stamp,
+				Price:          formatHex(price, hexWidth("", "Price")),
+				TrailingDigits: fmt.Sprintf("0x%02x", digits),
+			}
+			if tier, ok := d.Variable(VarPriceTier); ok {
+				p.Tier = formatHex(tier, hexWidth("", "Tier"))
+			}
+			p.RateLabel, _ = d.Variable(VarRateLabel)
+			packets = append(packets, p)
+		}
+	}
+
+	if text, ok := d.Variable(VarMessage); ok {
+		p := MessageCluster{
+			XMLName:     xml.Name{Local: "MessageCluster"},
+			DeviceMacId: deviceMacId,
+			MeterMacId:  meter,
+			TimeStamp:   stamp,
+			Text:        text,
+		}
+		p.Id, _ = d.Variable(VarMessageId)
+		p.Priority, _ = d.Variable(VarMessagePriority)
+		p.ConfirmationRequired, _ = d.Variable(VarMessageConfirmationRequired)
+		p.Confirmed, _ = d.Variable(VarMessageConfirmed)
+		p.Queue, _ = d.Variable(VarMessageQueue)
+		if v, ok := d.Variable(VarMessageDurationInMinutes); ok {
+			p.Duration = formatHex(v, hexWidth("", "Duration"))
+		}
+		packets = append(packets, p)
+	}
+
+	var frags []Fragment
+	for _, p := range packets {
+		if f, err := NewFragment(p); err == nil {
+			frags = append(frags, f)
+		}
+	}
+	return frags
+}
+
+// An Eagle200Client talks to the local api of an Eagle-200.  It is a
+// Commander that accepts the legacy command names, so it can stand in
+// for a LocalClient.
+type Eagle200Client struct {
+	// URL is the eagle's api endpoint, e.g.
+	// http://192.168.1.10/cgi-bin/post_manager
+	URL string
+
+	// User and Password are the eagle's cloud id and install code
+	User     string
+	Password string
+
+	// MacId is the eagle's own mac id, put in DeviceMacId of the
+	// fragments it returns
+	MacId string
+
+	// Client is used to make requests, or http.DefaultClient if nil
+	Client *http.Client
+}
+
+// Do sends a command and decodes the reply into v
+func (e *Eagle200Client) Do(ctx context.Context, cmd Eagle200Command, v interface{}) error {
+	resp, err := postXML(ctx, e.Client, e.URL, e.User, e.Password, cmd)
+	if err != nil {
+		return fmt.Errorf("%s: %v", cmd.Name, err)
+	}
+	defer resp.Body.Close()
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", cmd.Name, err)
+	}
+	return nil
+}
+
+// DeviceList returns the devices joined to the eagle
+func (e *Eagle200Client) DeviceList(ctx context.Context) ([]Eagle200DeviceDetails, error) {
+	var list Eagle200DeviceList
+	if err := e.Do(ctx, DeviceList(), &list); err != nil {
+		return nil, err
+	}
+	return list.Devices, nil
+}
+
+// Query reads the named variables of a device, or all of them
+func (e *Eagle200Client) Query(ctx context.Context, hardwareAddress string, variables ...string) (Eagle200Device, error) {
+	var d Eagle200Device
+	err := e.Do(ctx, DeviceQuery(hardwareAddress, variables...), &d)
+	return d, err
+}
+
+// The variables read for each legacy command
+var legacyVariables = map[string][]string{
+	CommandGetInstantaneousDemand: {VarInstantaneousDemand},
+	CommandGetCurrentSummation:    {VarCurrentSummationDelivered, VarCurrentSummationReceived},
+	CommandGetPrice:               {VarPrice, VarPriceTier, VarRateLabel},
+	CommandGetMessage: {VarMessage, VarMessageId, VarMessagePriority, VarMessageConfirmationRequired,
+		VarMessageConfirmed, VarMessageDurationInMinutes, VarMessageQueue},
+}
+
+// Command runs a legacy command by reading the matching variables.  If
+// the command has no MacId the first electric meter is used.
+// get_device_list returns a MeterInfo per device and get_network_info a
+// NetworkInfo for the meter.
+func (e *Eagle200Client) Command(ctx context.Context, cmd LocalCommand) ([]Fragment, error) {
+	switch cmd.Name {
+	case CommandGetDeviceList, CommandGetNetworkInfo:
+		devices, err := e.DeviceList(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var frags []Fragment
+		for _, d := range devices {
+			var p interface{}
+			if cmd.Name == CommandGetDeviceList {
+				p = MeterInfo{
+					XMLName:     xml.Name{Local: "MeterInfo"},
+					DeviceMacId: e.MacId,
+					MeterMacId:  d.HardwareAddress,
+					Type:        d.ModelId,
+					NickName:    d.Name,
+				}
+			} else if meterFor(cmd.MacId, d) {
+				p = NetworkInfo{
+					XMLName:     xml.Name{Local: "NetworkInfo"},
+					DeviceMacId: e.MacId,
+					CoordMacId:  d.HardwareAddress,
+					Status:      d.ConnectionStatus,
+					ShortAddr:   d.NetworkAddress,
+				}
+			} else {
+				continue
+			}
+			if f, err := NewFragment(p); err == nil {
+				frags = append(frags, f)
+			}
+		}
+		return frags, nil
+	}
+
+	variables, ok := legacyVariables[cmd.Name]
+	if !ok {
+		return nil, fmt.Errorf("%s is not supported by the Eagle-200", cmd.Name)
+	}
+	mac := cmd.MacId
+	if mac == "" {
+		devices, err := e.DeviceList(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range devices {
+			if meterFor("", d) {
+				mac = d.HardwareAddress
+				break
+			}
+		}
+		if mac == "" {
+			return nil, fmt.Errorf("%s: no electric meter", cmd.Name)
+		}
+	}
+	d, err := e.Query(ctx, mac, variables...)
+	if err != nil {
+		return nil, err
+	}
+	return d.Fragments(e.MacId), nil
+}
+
+// meterFor reports whether d is the meter mac, or any electric meter
+// if mac is empty
+func meterFor(mac string, d Eagle200DeviceDetails) bool {
+	if mac != "" {
+		return SameMac(mac, d.HardwareAddress)
+	}
+	return d.ModelId == ElectricMeter
+}
+
+// Poll sends each of the named legacy commands every interval, as
+// LocalClient.Poll does
+func (e *Eagle200Client) Poll(ctx context.Context, macId string, names []string, interval time.Duration, out chan<- Fragment, errs func(error)) error {
+	return Poll(ctx, e, macId, names, interval, out, errs)
+}
@@ -0,0 +1,145 @@
+package rainforestCommon
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const eagle200DeviceList = `<DeviceList>
+  <Device>
+    <HardwareAddress>0x00135001000056ab</HardwareAddress>
+    <Manufacturer>Generic</Manufacturer>
+    <ModelId>electric_meter</ModelId>
+    <Protocol>Zigbee</Protocol>
+    <LastContact>0x5503fedd</LastContact>
+    <ConnectionStatus>Connected</ConnectionStatus>
+    <NetworkAddress>0x0000</NetworkAddress>
+  </Device>
+</DeviceList>`
+
+const eagle200Query = `<Device>
+  <DeviceDetails>
+    <Name>Power Meter</Name>
+    <HardwareAddress>0x00135001000056ab</HardwareAddress>
+    <LastContact>0x5503fedd</LastContact>
+    <ConnectionStatus>Connected</ConnectionStatus>
+  </DeviceDetails>
+  <Components>
+    <Component>
+      <HardwareId>0x0</HardwareId>
+      <FixedId>0</FixedId>
+      <Name>Main</Name>
+      <Variables>
+        <Variable>
+          <Name>zigbee:InstantaneousDemand</Name>
+          <Value>1.069000</Value>
+          <Units>kW</Units>
+        </Variable>
+        <Variable>
+          <Name>zigbee:CurrentSummationDelivered</Name>
+          <Value>20089.439000</Value>
+          <Units>kWh</Units>
+        </Variable>
+        <Variable>
+          <Name>zigbee:Price</Name>
+          <Value>0.14</Value>
+        </Variable>
+        <Variable>
+          <Name>zigbee:PriceTier</Name>
+          <Value>1</Value>
+        </Variable>
+      </Variables>
+    </Component>
+  </Components>
+</Device>`
+
+func TestEagle200(t *testing.T) {
+	var commands []Eagle200Command
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var c Eagle200Command
+		if err := xml.Unmarshal(body, &c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		commands = append(commands, c)
+		switch c.Name {
+		case "device_list":
+			w.Write([]byte(eagle200DeviceList))
+		case "device_query":
+			w.Write([]byte(eagle200Query))
+		default:
+			http.Error(w, "unknown command", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	e := &Eagle200Client{URL: srv.URL, MacId: "0xd8d5b90000001234"}
+	frags, err := e.Command(context.Background(), GetInstantaneousDemand(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 2 || commands[1].DeviceDetails.HardwareAddress != "0x00135001000056ab" ||
+		len(commands[1].Components.Component) != 1 || commands[1].Components.Component[0].Variables[0].Name != VarInstantaneousDemand {
+		t.Error("Expected a device_list then a query for demand got ", commands)
+	}
+
+	// The fragments must match the ones an older eagle sends
+	legacy, _ := DecodeAll(strings.NewReader(uploaderPost))
+	if len(frags) != 3 {
+		t.Fatal("Expected demand, summation and price got ", frags)
+	}
+	if frags[0].Name != "InstantaneousDemand" || !frags[0].Time.Equal(legacy[0].Time) || !SameMac(frags[0].MeterMacId, legacy[0].MeterMacId) {
+		t.Error("Expected the legacy demand got ", frags[0])
+	}
+	if v, _ := frags[0].Value(); v != 1.069 {
+		t.Error("Expected 1.069 kW got ", v)
+	}
+	if v, _ := frags[1].Value(); frags[1].Name != "CurrentSummationDelivered" || v != 20089.439 {
+		t.Error("Expected 20089.439 kWh got ", frags[1])
+	}
+	p, ok := frags[2].Packet.(PriceCluster)
+	if v, _ := frags[2].Value(); !ok || v != 0.14 || p.Tier != "0x01" {
+		t.Error("Expected 0.14 at tier 1 got ", frags[2])
+	}
+
+	frags, err = e.Command(context.Background(), GetNetworkInfo("0x00135001000056AB"))
+	if err != nil || len(frags) != 1 || frags[0].Packet.(NetworkInfo).JoinStatus() != StatusConnected {
+		t.Error("Expected a connected NetworkInfo got ", frags, " ", err)
+	}
+	if _, err := e.Command(context.Background(), GetTime("0x01")); err == nil {
+		t.Error("Expected get_time to be unsupported")
+	}
+}
+
+func TestDeviceQuery(t *testing.T) {
+	data, _ := xml.Marshal(DeviceQuery("0x01"))
+	want := "<Command><Name>device_query</Name><DeviceDetails><HardwareAddress>0x01</HardwareAddress></DeviceDetails>" +
+		"<Components><All>Y</All></Components></Command>"
+	if string(data) != want {
+		t.Error("Expected ", want, " got ", string(data))
+	}
+}
+
+func TestEagle200NegativeDemand(t *testing.T) {
+	if v, ok := fixed("-1.069", 3); !ok || v != "0xfffbd3" {
+		t.Error("Expected 0xfffbd3 got ", v)
+	}
+
+	var d Eagle200Device
+	if err := xml.Unmarshal([]byte(strings.Replace(eagle200Query, "1.069000", "-1.069000", 1)), &d); err != nil {
+		t.Fatal(err)
+	}
+	frags := d.Fragments("0xd8d5b90000001234")
+	if len(frags) == 0 || frags[0].Name != "InstantaneousDemand" {
+		t.Fatal("Expected demand got ", frags)
+	}
+	if v, ok := frags[0].Value(); !ok || v != -1.069 {
+		t.Error("Expected -1.069 kW got ", v)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// A Record is anything that can be written as a row of csv, such as
+// a Fragment
+type Record interface {
+	Header() []string
+	Fields() []string
+}
+
+// A RecordWriter writes records in one of the output formats
+type RecordWriter interface {
+	Write(r Record) error
+	Flush() error
+}
+
+// The output formats understood by NewRecordWriter
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// NewRecordWriter returns a writer for the named format.  text uses
+// the String method of the record, json writes one object per line and
+// csv writes a header row before the first record.
+func NewRecordWriter(w io.Writer, format string) (RecordWriter, error) {
+	switch format {
+	case FormatText, "":
+		return &textWriter{w: w}, nil
+	case FormatJSON:
+		return &jsonWriter{e: json.NewEncoder(w)}, nil
+	case FormatCSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("Unknown format %s", format)
+}
+
+type textWriter struct {
+	w io.Writer
+}
+
+func (t *textWriter) Write(r Record) error {
+	var err error
+	if s, ok := r.(fmt.Stringer); ok {
+		_, err = fmt.Fprint(t.w, s.String())
+	} else {
+		_, err = fmt.Fprintln(t.w, r.Fields())
+	}
+	return err
+}
+
+func (t *textWriter) Flush() error {
+	return nil
+}
+
+type jsonWriter struct {
+	e *json.Encoder
+}
+
+func (j *jsonWriter) Write(r Record) error {
+	return j.e.Encode(r)
+}
+
+func (j *jsonWriter) Flush() error {
+	return nil
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (c *csvWriter) Write(r Record) error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(r.Header()); err != nil {
+			return err
+		}
+	}
+	return c.w.Write(r.Fields())
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
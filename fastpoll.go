@@ -0,0 +1,311 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Window is a daily period, as offsets from midnight.  A window
+// whose End is before its Start runs past midnight, and one that ends
+// at 24:00 runs to midnight, so 00:00-24:00 is the whole day.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindow parses a window such as "17:00-21:00".  The end may be
+// 24:00.
+func ParseWindow(s string) (Window, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return Window{}, fmt.Errorf("Invalid window %q", s)
+	}
+	var w Window
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		if i == 1 && p == "24:00" {
+			w.End = 24 * time.Hour
+			continue
+		}
+		t, err := time.Parse("15:04", p)
+		if err != nil {
+			return Window{}, fmt.Errorf("Invalid window %q", s)
+		}
+		d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			w.Start = d
+		} else {
+			w.End = d
+		}
+	}
+	return w, nil
+}
+
+// Contains reports whether t, in its own location, is in the window
+func (w Window) Contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.End < w.Start {
+		return d >= w.Start || d < w.End
+	}
+	return d >= w.Start && d < w.End
+}
+
+// String returns the window as ParseWindow reads it
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", int(w.Start.Hours()), int(w.Start.Minutes())%60,
+		int(w.End.Hours()), int(w.End.Minutes())%60)
+}
+
+// MarshalText writes the window as ParseWindow reads it, so windows
+// can be kept in json
+func (w Window) MarshalText() ([]byte, error) {
+	return []byte(w.String()), nil
+}
+
+// UnmarshalText parses a window such as "17:00-21:00"
+func (w *Window) UnmarshalText(text []byte) error {
+	v, err := ParseWindow(string(text))
+	if err != nil {
+		return err
+	}
+	*w = v
+	return nil
+}
+
+// FastPollRefused is the error reported when the meter doesn't start
+// fast polling after being asked to
+type FastPollRefused struct {
+	MacId  string
+	Reason string
+}
+
+func (e *FastPollRefused) Error() string {
+	return fmt.Sprintf("meter %s refused fast poll: %s", e.MacId, e.Reason)
+}
+
+// A FastPoller keeps a meter fast polling, re-issuing set_fast_poll
+// before the meter's EndTime passes.  It learns the meter's state from
+// FastPollStatus fragments, and its demand from InstantaneousDemand
+// fragments, so it must be written the fragments read from the eagle
+// or RAVEn as well as the replies to its own commands.  It is a Sink.
+type FastPoller struct {
+	Commander Commander
+	MacId     string // the meter, or "" for the eagle's only meter
+
+	// Frequency is how often the meter should send demand, 5 seconds
+	// if zero.  Duration is how long each request lasts, and Renew is
+	// how long before the end of one a new request is sent.  They
+	// default to MaxFastPollDuration and a minute.
+	Frequency time.Duration
+	Duration  time.Duration
+	Renew     time.Duration
+
+	// Windows, if not empty, limits fast polling to those times of
+	// day in Location, or time.Local if nil
+	Windows  []Window
+	Location *time.Location
+
+	// Above, if not zero, limits fast polling to when demand is at
+	// least Above kW, and for Hold (15 minutes if zero) after it falls
+	Above float64
+	Hold  time.Duration
+
+	// Confirm is how long to wait for a FastPollStatus showing the
+	// request was accepted, 30 seconds if zero.  A refused request is
+	// tried again after Retry, 5 minutes if zero.
+	Confirm time.Duration
+	Retry   time.Duration
+
+	// Errors, if not nil, is called with failed commands and with a
+	// *FastPollRefused when the meter refuses
+	Errors func(error)
+
+	// Now returns the current time; time.Now is used if nil
+	Now func() time.Time
+
+	mu        sync.Mutex
+	end       time.Time // when the meter's fast poll ends
+	frequency time.Duration
+	above     time.Time // when demand was last above Above
+	sent      time.Time // when the pending request was sent
+	pending   bool
+	nextTry   time.Time
+}
+
+func (p *FastPoller) now() time.Time {
+	if p.Now != nil {
+		return p.Now()
+	}
+	return time.Now()
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// Write records the meter's FastPollStatus and demand
+func (p *FastPoller) Write(ctx context.Context, frags []Fragment) error {
+	var refused []error
+	now := p.now()
+	p.mu.Lock()
+	for _, f := range frags {
+		if p.MacId != "" && f.MeterMacId != "" && !SameMac(p.MacId, f.MeterMacId) {
+			continue
+		}
+		switch s := f.Packet.(type) {
+		case FastPollStatus:
+			end := fragmentTime(s.EndTime)
+			freq := time.Duration(getval(s.Frequency)) * time.Second
+			p.end, p.frequency = end, freq
+			if !p.pending {
+				continue
+			}
+			p.pending = false
+			if freq <= 0 || !end.After(now) {
+				refused = append(refused, p.refused(now, "fast poll status shows it stopped"))
+			} else if !end.After(now.Add(orDefault(p.Renew, time.Minute))) {
+				refused = append(refused, p.refused(now, "end time not extended"))
+			} else if freq > orDefault(p.Frequency, 5*time.Second) {
+				refused = append(refused, p.refused(now, fmt.Sprintf("polling every %v", freq)))
+			}
+		case InstantaneousDemand:
+			if kw, ok := f.Value(); ok && p.Above > 0 && kw >= p.Above {
+				p.above = now
+			}
+		}
+	}
+	p.mu.Unlock()
+	p.report(refused...)
+	return nil
+}
+
+// Close does nothing
+func (p *FastPoller) Close() error {
+	return nil
+}
+
+// refused records a refusal and returns its error; p.mu must be held
+func (p *FastPoller) refused(now time.Time, reason string) error {
+	p.nextTry = now.Add(orDefault(p.Retry, 5*time.Minute))
+	return &FastPollRefused{MacId: p.MacId, Reason: reason}
+}
+
+func (p *FastPoller) report(errs ...error) {
+	if p.Errors == nil {
+		return
+	}
+	for _, err := range errs {
+		p.Errors(err)
+	}
+}
+
+// Wanted reports whether fast polling is wanted at now
+func (p *FastPoller) Wanted(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.wanted(now)
+}
+
+// wanted is Wanted with p.mu held
+func (p *FastPoller) wanted(now time.Time) bool {
+	if len(p.Windows) > 0 {
+		loc := p.Location
+		if loc == nil {
+			loc = time.Local
+		}
+		in := false
+		for _, w := range p.Windows {
+			if w.Contains(now.In(loc)) {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+	if p.Above > 0 {
+		return !p.above.IsZero() && now.Sub(p.above) < orDefault(p.Hold, 15*time.Minute)
+	}
+	return true
+}
+
+// Check sends set_fast_poll if fast polling is wanted and the meter's
+// current fast poll ends within Renew
+func (p *FastPoller) Check(ctx context.Context) {
+	now := p.now()
+	var errs []error
+	p.mu.Lock()
+	if p.pending && now.Sub(p.sent) >= orDefault(p.Confirm, 30*time.Second) {
+		p.pending = false
+		errs = append(errs, p.refused(now, "no fast poll status"))
+	}
+	send := !p.pending && p.wanted(now) && !now.Before(p.nextTry) &&
+		p.end.Sub(now) < orDefault(p.Renew, time.Minute)
+	if send {
+		p.pending = true
+		p.sent = now
+	}
+	p.mu.Unlock()
+	p.report(errs...)
+	if !send {
+		return
+	}
+
+	cmd, err := SetFastPoll(p.MacId, orDefault(p.Frequency, 5*time.Second), orDefault(p.Duration, MaxFastPollDuration))
+	var frags []Fragment
+	if err == nil {
+		frags, err = p.Commander.Command(ctx, cmd)
+	}
+	if err != nil {
+		p.mu.Lock()
+		p.pending = false
+		p.nextTry = now.Add(orDefault(p.Retry, 5*time.Minute))
+		p.mu.Unlock()
+		p.report(err)
+		return
+	}
+	p.Write(ctx, frags)
+
+	// Ask for the status in case the reply didn't carry it.  A RAVEn
+	// answers both on its stream instead.  If this fails, the request
+	// is refused once Confirm passes without a status.
+	frags, err = p.Commander.Command(ctx, GetFastPollStatus(p.MacId))
+	if err != nil {
+		p.report(err)
+		return
+	}
+	p.Write(ctx, frags)
+}
+
+// Status returns when the meter's fast poll ends and how often it is
+// sending, as last reported
+func (p *FastPoller) Status() (end time.Time, frequency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.end, p.frequency
+}
+
+// Run calls Check every interval until ctx is done
+func (p *FastPoller) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.Check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package rainforestCommon
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fastPollMeter answers set_fast_poll, or refuses it
+type fastPollMeter struct {
+	now    *time.Time
+	refuse bool
+	sets   int
+	end    time.Time
+}
+
+func (m *fastPollMeter) Command(ctx context.Context, cmd LocalCommand) ([]Fragment, error) {
+	switch cmd.Name {
+	case CommandSetFastPoll:
+		m.sets++
+		if !m.refuse {
+			m.end = m.now.Add(time.Duration(getval(cmd.Duration)) * time.Minute)
+		}
+		return nil, nil
+	case CommandGetFastPollStatus:
+		s := FastPollStatus{XMLName: xml.Name{Local: "FastPollStatus"}, MeterMacId: "0x01", Frequency: "0x00", EndTime: "0x00000000"}
+		if m.end.After(*m.now) {
+			s.Frequency = "0x05"
+			s.EndTime, _ = EncodeMeterTime(m.end)
+		}
+		f, err := NewFragment(s)
+		return []Fragment{f}, err
+	}
+	return nil, fmt.Errorf("unexpected %s", cmd.Name)
+}
+
+func TestFastPoller(t *testing.T) {
+	now := time.Date(2015, time.March, 14, 16, 50, 0, 0, time.UTC)
+	m := &fastPollMeter{now: &now}
+	var errs []error
+	window, err := ParseWindow("17:00-21:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &FastPoller{
+		Commander: m,
+		MacId:     "0x01",
+		Windows:   []Window{window},
+		Location:  time.UTC,
+		Now:       func() time.Time { return now },
+		Errors:    func(err error) { errs = append(errs, err) },
+	}
+
+	p.Check(context.Background())
+	if m.sets != 0 {
+		t.Error("Expected no fast poll outside the window")
+	}
+
+	// Every minute until 17:30
+	for i := 0; i < 40; i++ {
+		now = now.Add(time.Minute)
+		p.Check(context.Background())
+	}
+	if m.sets != 3 || len(errs) != 0 {
+		t.Error("Expected a request and two renewals got ", m.sets, " ", errs)
+	}
+	if end, freq := p.Status(); !end.After(now) || freq != 5*time.Second {
+		t.Error("Expected fast poll to be running got ", end, " ", freq)
+	}
+
+	m.refuse = true
+	now = m.end.Add(-30 * time.Second)
+	p.Check(context.Background())
+	if len(errs) != 1 {
+		t.Fatal("Expected a refusal got ", errs)
+	}
+	if r, ok := errs[0].(*FastPollRefused); !ok || r.MacId != "0x01" {
+		t.Error("Expected a FastPollRefused got ", errs[0])
+	}
+	// Not asked again until Retry passes
+	now = now.Add(time.Minute)
+	p.Check(context.Background())
+	if m.sets != 4 {
+		t.Error("Expected no retry yet got ", m.sets, " requests")
+	}
+}
+
+func TestFastPollerThreshold(t *testing.T) {
+	now := targetTimeU
+	m := &fastPollMeter{now: &now}
+	p := &FastPoller{Commander: m, Above: 3, Now: func() time.Time { return now }}
+	p.Write(context.Background(), []Fragment{demandAt(1)})
+	p.Check(context.Background())
+	if m.sets != 0 {
+		t.Error("Expected no fast poll below the threshold")
+	}
+	p.Write(context.Background(), []Fragment{demandAt(4)})
+	p.Check(context.Background())
+	if m.sets != 1 {
+		t.Error("Expected fast poll above the threshold")
+	}
+	now = now.Add(20 * time.Minute)
+	if p.Wanted(now) {
+		t.Error("Expected fast poll not to be wanted once the hold passed")
+	}
+}
+
+func TestWindowAllDay(t *testing.T) {
+	w, err := ParseWindow("00:00-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hm := range [][2]int{{0, 0}, {12, 0}, {23, 59}} {
+		if at := time.Date(2015, time.March, 14, hm[0], hm[1], 59, 0, time.UTC); !w.Contains(at) {
+			t.Error("Expected the whole day to contain ", at)
+		}
+	}
+	if w.String() != "00:00-24:00" {
+		t.Error("Expected 00:00-24:00 got ", w)
+	}
+	evening, _ := ParseWindow("18:00-24:00")
+	if evening.Contains(time.Date(2015, time.March, 14, 17, 59, 0, 0, time.UTC)) || !evening.Contains(time.Date(2015, time.March, 14, 23, 30, 0, 0, time.UTC)) {
+		t.Error("Expected 18:00-24:00 to run to midnight got ", evening)
+	}
+	if _, err := ParseWindow("24:00-06:00"); err == nil {
+		t.Error("Expected 24:00 to be refused as a start")
+	}
+}
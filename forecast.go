@@ -0,0 +1,325 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The rule of the alerts a Forecaster sends
+const RuleBudget = "budget"
+
+// A Forecast projects a meter's use to the end of its billing period.
+// Low and High bound the projection at the Forecaster's Confidence.
+type Forecast struct {
+	MeterMacId    string          `json:"meterMacId"`
+	PeriodStart   time.Time       `json:"periodStart"`
+	PeriodEnd     time.Time       `json:"periodEnd"`
+	Time          time.Time       `json:"time"`
+	UsedKWh       float64         `json:"usedKWh"`
+	UsedCost      float64         `json:"usedCost"`
+	ProjectedKWh  float64         `json:"projectedKWh"`
+	LowKWh        float64         `json:"lowKWh"`
+	HighKWh       float64         `json:"highKWh"`
+	ProjectedCost float64         `json:"projectedCost"`
+	LowCost       float64         `json:"lowCost"`
+	HighCost      float64         `json:"highCost"`
+	Confidence    float64         `json:"confidence"`
+	Budget        float64         `json:"budget,omitempty"`
+	OverBudget    bool            `json:"overBudget"`
+	Model         *DegreeDayModel `json:"model,omitempty"`
+}
+
+// A Forecaster projects each meter's use and cost to the end of the
+// billing period from its history.  Each remaining hour is expected to
+// use what that hour of that day of the week has used on average.  If
+// Weather is given, a degree day model is fitted to the past days, and
+// the remaining days with weather, which may be a forecast, are
+// expected to use what the model predicts for them, spread over the
+// day as the profile is.  The spread of past days about what was
+// expected of them gives the confidence interval.
+//
+// Check sends a budget alert when the projected cost goes over Budget,
+// and resolves it when the projection comes back under.
+type Forecaster struct {
+	// BillingDay is the day of the month a billing period starts, 1 if
+	// zero, or the month's last day if it has fewer days, in Location,
+	// which is UTC if nil
+	BillingDay int
+	Location   *time.Location
+
+	// Tariff, if not nil, prices energy.  Otherwise Price is the cost
+	// per kWh or, if it is zero, the meter's last PriceCluster price.
+	Tariff *TimeOfUse
+	Price  float64
+
+	// Weather and the BaseTemp its degree days are counted from, 18 if
+	// zero
+	Weather  Weather
+	BaseTemp float64
+
+	// Confidence is the coverage of the interval, 0.9 if zero
+	Confidence float64
+
+	// Budget is the most a period should cost; zero means no alert
+	Budget float64
+
+	// Now returns the current time.  time.Now is used if nil.
+	Now func() time.Time
+
+	// Errors, if not nil, is called with errors from notifiers
+	Errors func(error)
+
+	notifiers []Notifier
+	mu        sync.Mutex
+	firing    map[string]time.Time
+}
+
+// NewForecaster returns a forecaster that sends budget alerts to
+// notifiers
+func NewForecaster(notifiers ...Notifier) *Forecaster {
+	return &Forecaster{notifiers: notifiers, firing: make(map[string]time.Time)}
+}
+
+func (f *Forecaster) now() time.Time {
+	if f.Now != nil {
+		return f.Now()
+	}
+	return time.Now()
+}
+
+func (f *Forecaster) location() *time.Location {
+	if f.Location != nil {
+		return f.Location
+	}
+	return time.UTC
+}
+
+// Period returns the billing period that t falls in.  In months too
+// short for BillingDay the period starts on the last day.
+func (f *Forecaster) Period(t time.Time) (start, end time.Time) {
+	t = t.In(f.location())
+	start = f.periodStart(t.Year(), t.Month())
+	if start.After(t) {
+		start = f.periodStart(t.Year(), t.Month()-1)
+	}
+	return start, f.periodStart(start.Year(), start.Month()+1)
+}
+
+// periodStart returns when the billing period starting in month does
+func (f *Forecaster) periodStart(year int, month time.Month) time.Time {
+	day := f.BillingDay
+	if day < 1 {
+		day = 1
+	}
+	// Day 0 of the next month is the last of this one
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, f.location())
+}
+
+// Forecast returns a forecast for each meter with summations in frags,
+// in mac id order
+func (f *Forecaster) Forecast(frags []Fragment) []Forecast {
+	now := f.now()
+	loc := f.location()
+	start, end := f.Period(now)
+	confidence := f.Confidence
+	if confidence <= 0 || confidence >= 1 {
+		confidence = 0.9
+	}
+	z := math.Sqrt2 * math.Erfinv(confidence)
+	base := f.BaseTemp
+	if base == 0 {
+		base = 18
+	}
+
+	prices := make(map[string]float64)
+	for _, fr := range frags {
+		if fr.Name == "PriceCluster" {
+			if v, ok := fr.Value(); ok {
+				prices[NormalizeMac(fr.MeterMacId)] = v
+			}
+		}
+	}
+
+	var forecasts []Forecast
+	for meter, hours := range HourlyEnergy(frags) {
+		price := func(t time.Time) float64 {
+			switch {
+			case f.Tariff != nil:
+				p, _ := f.Tariff.PriceAt(t)
+				return p
+			case f.Price != 0:
+				return f.Price
+			}
+			return prices[meter]
+		}
+		fc := Forecast{MeterMacId: meter, PeriodStart: start, PeriodEnd: end, Time: now,
+			Confidence: confidence, Budget: f.Budget}
+
+		// The average of each hour of the week, and of all hours for
+		// those never seen
+		var sums, counts [7][24]float64
+		var total float64
+		var past []EnergyHour
+		for _, h := range hours {
+			if !h.Start.Before(now) {
+				continue
+			}
+			past = append(past, h)
+			lt := h.Start.In(loc)
+			sums[lt.Weekday()][lt.Hour()] += h.KWh
+			counts[lt.Weekday()][lt.Hour()]++
+			total += h.KWh
+			if !h.Start.Before(start) {
+				fc.UsedKWh += h.KWh
+				fc.UsedCost += h.KWh * price(h.Start)
+			}
+		}
+		if len(past) == 0 {
+			continue
+		}
+		mean := total / float64(len(past))
+		var profile [7][24]float64
+		var profileDay [7]float64
+		for d := range profile {
+			for h := range profile[d] {
+				profile[d][h] = mean
+				if counts[d][h] > 0 {
+					profile[d][h] = sums[d][h] / counts[d][h]
+				}
+				profileDay[d] += profile[d][h]
+			}
+		}
+
+		// daily is what a day is expected to use: the profile's day of
+		// the week or, with a model, what the model predicts from the
+		// day's weather, adjusted by how that day of the week ran
+		// against the model
+		days := DailyEnergy(past, loc)
+		if len(f.Weather) > 0 {
+			if m, err := FitDegreeDays(days, f.Weather, base); err == nil {
+				fc.Model = &m
+			}
+		}
+		var factor [7]float64
+		if fc.Model != nil {
+			var actual, predicted [7]float64
+			for _, d := range days {
+				t, _ := time.ParseInLocation("2006-01-02", d.Date, loc)
+				if kwh, ok := fc.Model.PredictDate(f.Weather, d.Date); ok {
+					actual[t.Weekday()] += d.KWh
+					predicted[t.Weekday()] += kwh
+				}
+			}
+			for d := range factor {
+				factor[d] = 1
+				if predicted[d] > 0 {
+					factor[d] = actual[d] / predicted[d]
+				}
+			}
+		}
+		daily := func(t time.Time) float64 {
+			if fc.Model != nil {
+				if kwh, ok := fc.Model.PredictDate(f.Weather, t.Format("2006-01-02")); ok {
+					return math.Max(kwh, 0) * factor[t.Weekday()]
+				}
+			}
+			return profileDay[t.Weekday()]
+		}
+
+		// How far the past days were from what was expected of them
+		var ss float64
+		for _, d := range days {
+			t, _ := time.ParseInLocation("2006-01-02", d.Date, loc)
+			r := d.KWh - daily(t)
+			ss += r * r
+		}
+		var sigma float64
+		if len(days) > 1 {
+			sigma = math.Sqrt(ss / float64(len(days)-1))
+		}
+
+		var remaining, remainingCost float64
+		for t := now.Truncate(time.Hour); t.Before(end); t = t.Add(time.Hour) {
+			lt := t.In(loc)
+			kwh := profile[lt.Weekday()][lt.Hour()]
+			if day := profileDay[lt.Weekday()]; day > 0 {
+				kwh *= daily(lt) / day
+			}
+			// Only the rest of the current hour
+			from := t
+			if now.After(from) {
+				from = now
+			}
+			kwh *= float64(t.Add(time.Hour).Sub(from)) / float64(time.Hour)
+			remaining += kwh
+			remainingCost += kwh * price(t)
+		}
+		spread := z * sigma * math.Sqrt(end.Sub(now).Hours()/24)
+
+		fc.ProjectedKWh = fc.UsedKWh + remaining
+		fc.LowKWh = fc.UsedKWh + math.Max(remaining-spread, 0)
+		fc.HighKWh = fc.UsedKWh + remaining + spread
+		fc.ProjectedCost = fc.UsedCost + remainingCost
+		fc.LowCost, fc.HighCost = fc.ProjectedCost, fc.ProjectedCost
+		if remaining > 0 {
+			fc.LowCost = fc.UsedCost + remainingCost*(fc.LowKWh-fc.UsedKWh)/remaining
+			fc.HighCost = fc.UsedCost + remainingCost*(fc.HighKWh-fc.UsedKWh)/remaining
+		}
+		fc.OverBudget = f.Budget > 0 && fc.ProjectedCost > f.Budget
+		forecasts = append(forecasts, fc)
+	}
+	sort.Slice(forecasts, func(i, j int) bool { return forecasts[i].MeterMacId < forecasts[j].MeterMacId })
+	return forecasts
+}
+
+// Check forecasts frags and sends a budget alert for each meter whose
+// projection has gone over Budget, or come back under it
+func (f *Forecaster) Check(ctx context.Context, frags []Fragment) []Forecast {
+	forecasts := f.Forecast(frags)
+	if f.Budget <= 0 {
+		return forecasts
+	}
+	var alerts []Alert
+	f.mu.Lock()
+	if f.firing == nil {
+		f.firing = make(map[string]time.Time)
+	}
+	for _, fc := range forecasts {
+		started, firing := f.firing[fc.MeterMacId]
+		a := Alert{Rule: RuleBudget, Meter: fc.MeterMacId, Value: fc.ProjectedCost}
+		switch {
+		case fc.OverBudget && !firing:
+			f.firing[fc.MeterMacId] = fc.Time
+			a.State, a.Started = Firing, fc.Time
+			a.Message = fmt.Sprintf("projected cost %.2f is over the budget of %.2f", fc.ProjectedCost, f.Budget)
+		case !fc.OverBudget && firing:
+			delete(f.firing, fc.MeterMacId)
+			a.State, a.Started, a.Ended = Resolved, started, fc.Time
+			a.Message = fmt.Sprintf("projected cost %.2f is within the budget of %.2f", fc.ProjectedCost, f.Budget)
+		default:
+			continue
+		}
+		alerts = append(alerts, a)
+	}
+	f.mu.Unlock()
+
+	for _, a := range alerts {
+		for _, n := range f.notifiers {
+			if err := n.Notify(ctx, a); err != nil && f.Errors != nil {
+				f.Errors(err)
+			}
+		}
+	}
+	return forecasts
+}
@@ -0,0 +1,132 @@
+package rainforestCommon
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// summationsOf returns a summation from meter 0x01 every hour from
+// start for hours, using kwh(t) in the hour from t
+func summationsOf(start time.Time, hours int, kwh func(t time.Time) float64) []Fragment {
+	var frags []Fragment
+	wh := 0.0
+	for i := 0; i <= hours; i++ {
+		t := start.Add(time.Duration(i) * time.Hour)
+		stamp, _ := EncodeMeterTime(t)
+		f, _ := NewFragment(CurrentSummationDelivered{
+			XMLName:            xml.Name{Local: "CurrentSummationDelivered"},
+			MeterMacId:         "0x01",
+			TimeStamp:          stamp,
+			SummationDelivered: fmt.Sprintf("0x%016x", int64(math.Round(wh))),
+			Multiplier:         "0x00000001",
+			Divisor:            "0x000003e8",
+		})
+		frags = append(frags, f)
+		wh += kwh(t) * 1000
+	}
+	return frags
+}
+
+// hourlySummations returns a summation every hour from start for days,
+// using (base + heating HDD) kWh a day spread evenly
+func hourlySummations(start time.Time, days int, w Weather, base, heating float64) []Fragment {
+	return summationsOf(start, days*24, func(t time.Time) float64 {
+		hdd, _, _ := w.DegreeDays(t.Format("2006-01-02"), 18)
+		return (base + heating*hdd) / 24
+	})
+}
+
+func TestReadWeather(t *testing.T) {
+	w, err := ReadWeather(strings.NewReader("date,min,max\n2015-03-14,4,12\n2015-03-15, 10, 14\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdd, cdd, ok := w.DegreeDays("2015-03-14", 18); !ok || hdd != 10 || cdd != 0 {
+		t.Error("Expected 10 heating degree days got ", hdd, " ", cdd)
+	}
+	if _, err := ReadWeather(strings.NewReader("2015-03-14,cold\n")); err == nil {
+		t.Error("Expected a bad temperature to fail")
+	}
+}
+
+func TestForecaster(t *testing.T) {
+	start := time.Date(2015, time.February, 1, 0, 0, 0, 0, time.UTC)
+	w := make(Weather)
+	for d := 0; d < 60; d++ {
+		w[start.AddDate(0, 0, d).Format("2006-01-02")] = 18 - float64(d%5)*3
+	}
+	frags := hourlySummations(start, 42, w, 10, 2) // to March 15
+	now := start.AddDate(0, 0, 42)
+
+	var want, used float64
+	for d := 28; d < 59; d++ {
+		hdd, _, _ := w.DegreeDays(start.AddDate(0, 0, d).Format("2006-01-02"), 18)
+		want += 10 + 2*hdd
+		if d < 42 {
+			used += 10 + 2*hdd
+		}
+	}
+
+	var alerts []Alert
+	f := NewForecaster(NotifierFunc(func(ctx context.Context, a Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	}))
+	f.Weather, f.Price, f.Budget = w, 0.1, 50
+	f.Now = func() time.Time { return now }
+	forecasts := f.Check(context.Background(), frags)
+	if len(forecasts) != 1 {
+		t.Fatal("Expected one forecast got ", forecasts)
+	}
+	fc := forecasts[0]
+	if fc.Model == nil || math.Abs(fc.Model.Heating-2) > 1e-6 || math.Abs(fc.Model.Intercept-10) > 1e-6 {
+		t.Fatal("Expected a model of 10 + 2 HDD got ", fc.Model)
+	}
+	if math.Abs(fc.UsedKWh-used) > 1e-6 || math.Abs(fc.ProjectedKWh-want) > 1e-6 {
+		t.Error("Expected ", used, " used and ", want, " projected got ", fc.UsedKWh, " ", fc.ProjectedKWh)
+	}
+	if fc.HighKWh-fc.LowKWh > 1e-6 {
+		t.Error("Expected a narrow interval with an exact model got ", fc.LowKWh, " ", fc.HighKWh)
+	}
+	if !fc.OverBudget || len(alerts) != 1 || alerts[0].Rule != RuleBudget || alerts[0].State != Firing {
+		t.Error("Expected a budget alert got ", alerts)
+	}
+
+	// Without the weather the projection is from the weekly profile,
+	// with a wider interval
+	f.Weather, f.Budget = nil, 100
+	fc = f.Check(context.Background(), frags)[0]
+	if fc.Model != nil || fc.HighKWh-fc.LowKWh < 1 || fc.LowKWh > want || fc.HighKWh < want {
+		t.Error("Expected the interval to cover ", want, " got ", fc.LowKWh, " ", fc.HighKWh)
+	}
+	if len(alerts) != 2 || alerts[1].State != Resolved {
+		t.Error("Expected the alert to resolve got ", alerts)
+	}
+}
+
+func TestForecasterPeriodMonthEnd(t *testing.T) {
+	f := NewForecaster()
+	f.BillingDay = 31
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	for _, c := range []struct{ now, start, end string }{
+		{"2015-03-01", "2015-02-28", "2015-03-31"},
+		{"2015-03-31", "2015-03-31", "2015-04-30"},
+		{"2015-04-30", "2015-04-30", "2015-05-31"},
+		{"2015-04-29", "2015-03-31", "2015-04-30"},
+		{"2015-01-15", "2014-12-31", "2015-01-31"},
+		{"2016-02-29", "2016-02-29", "2016-03-31"},
+	} {
+		start, end := f.Period(day(c.now))
+		if !start.Equal(day(c.start)) || !end.Equal(day(c.end)) {
+			t.Errorf("%s: got %s to %s, want %s to %s", c.now, start.Format("2006-01-02"), end.Format("2006-01-02"), c.start, c.end)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Fragment is one packet sent by the eagle, along with the fields
+// that most packet types have in common.  Packet holds the decoded
+// value, e.g. an InstantaneousDemand or a PriceCluster.
+type Fragment struct {
+	Name        string
+	DeviceMacId string
+	MeterMacId  string
+	Time        time.Time
+	Packet      interface{}
+}
+
+// The packet types we know how to decode, by element name
+var packetTypes = map[string]reflect.Type{
+	"BlockPriceDetail":          reflect.TypeOf(BlockPriceDetail{}),
+	"CurrentSummation":          reflect.TypeOf(CurrentSummation{}),
+	"CurrentSummationDelivered": reflect.TypeOf(CurrentSummationDelivered{}),
+	"DeviceInfo":                reflect.TypeOf(DeviceInfo{}),
+	"FastPollStatus":            reflect.TypeOf(FastPollStatus{}),
+	"HistoryData":               reflect.TypeOf(HistoryData{}),
+	"InstantaneousDemand":       reflect.TypeOf(InstantaneousDemand{}),
+	"MessageCluster":            reflect.TypeOf(MessageCluster{}),
+	"MeterInfo":                 reflect.TypeOf(MeterInfo{}),
+	"NetworkInfo":               reflect.TypeOf(NetworkInfo{}),
+	"PriceCluster":              reflect.TypeOf(PriceCluster{}),
+	"ProfileData":               reflect.TypeOf(ProfileData{}),
+	"ScheduleInfo":              reflect.TypeOf(ScheduleInfo{}),
+	"TimeCluster":               reflect.TypeOf(TimeCluster{}),
+}
+
+// IsFragmentName reports whether name is the element name of a
+// packet type we know how to decode
+func IsFragmentName(name string) bool {
+	_, ok := packetTypes[name]
+	return ok
+}
+
+// newPacket returns a pointer to a new, empty packet of the named type
+func newPacket(name string) (interface{}, error) {
+	t, ok := packetTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown fragment %s", name)
+	}
+	p := reflect.New(t)
+	p.Elem().FieldByName("XMLName").Set(reflect.ValueOf(xml.Name{Local: name}))
+	return p.Interface(), nil
+}
+
+// NewFragment wraps a decoded packet, filling in the common fields
+func NewFragment(packet interface{}) (Fragment, error) {
+	var f Fragment
+	switch p := packet.(type) {
+	case BlockPriceDetail:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId, MeterMacId: p.MeterMacId, Time: fragmentTime(p.TimeStamp)}
+	case CurrentSummation:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId, MeterMacId: p.MeterMacId, Time: fragmentTime(p.TimeStamp)}
+	case CurrentSummationDelivered:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId, MeterMacId: p.MeterMacId, Time: fragmentTime(p.TimeStamp)}
+	case DeviceInfo:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId}
+	case FastPollStatus:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId, MeterMacId: p.MeterMacId}
+	case HistoryData:
+		f = Fragment{Name: p.XMLName.Local}
+		// A history packet is stamped with its newest summation
+		for _, s := range p.SummationList {
+			f.DeviceMacId = s.DeviceMacId
+			f.MeterMacId = s.MeterMacId
+			if t := fragmentTime(s.TimeStamp); t.After(f.Time) {
+				f.Time = t
+			}
+		}
+	case InstantaneousDemand:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId, MeterMacId: p.MeterMacId, Time: fragmentTime(p.TimeStamp)}
+	case MessageCluster:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId, MeterMacId: p.MeterMacId, Time: fragmentTime(p.TimeStamp)}
+	case MeterInfo:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId, MeterMacId: p.MeterMacId}
+	case NetworkInfo:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId}
+	case PriceCluster:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId, MeterMacId: p.MeterMacId, Time: fragmentTime(p.TimeStamp)}
+	case ProfileData:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId, MeterMacId: p.MeterMacId, Time: fragmentTime(p.EndTime)}
+	case ScheduleInfo:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId, MeterMacId: p.MeterMacId}
+	case TimeCluster:
+		f = Fragment{Name: p.XMLName.Local, DeviceMacId: p.DeviceMacId, MeterMacId: p.MeterMacId, Time: fragmentTime(p.UTCTime)}
+	default:
+		return f, fmt.Errorf("Unknown packet type %T", packet)
+	}
+	if f.Name == "" {
+		return f, fmt.Errorf("Empty %T packet", packet)
+	}
+	f.Packet = packet
+	return f, nil
+}
+
+// fragmentTime converts a packet timestamp to UTC, or returns the
+// zero time if the timestamp can't be read
+func fragmentTime(s string) time.Time {
+	t, err := DecodeMeterTime(s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Value returns the reading carried by the fragment, scaled by its
+// multiplier and divisor: kW for demand, kWh for summations and the
+// price per unit for prices.  ok is false for packet types that don't
+// carry a single reading.  Demand is negative when power is exported.
+func (f Fragment) Value() (value float64, ok bool) {
+	switch p := f.Packet.(type) {
+	case InstantaneousDemand:
+		v, ok := scaled(p.Demand, p.Multiplier, p.Divisor)
+		if !ok {
+			return 0, false
+		}
+		// The meter sends demand as 24 bit two's complement
+		if raw, _ := strconv.ParseUint(p.Demand[2:], 16, 64); raw&0x800000 != 0 && raw <= 0xffffff {
+			v, _ = scaled(fmt.Sprintf("0x%x", 0x1000000-raw), p.Multiplier, p.Divisor)
+			v = -v
+		}
+		return v, true
+	case CurrentSummationDelivered:
+		return scaled(p.SummationDelivered, p.Multiplier, p.Divisor)
+	case CurrentSummation:
+		return scaled(p.SummationDelivered, p.Multiplier, p.Divisor)
+	case PriceCluster:
+		price, err := Hex2Float(p.Price)
+		if err != nil {
+			return 0, false
+		}
+		return float64(price) / math.Pow10(getval(p.TrailingDigits)), true
+	}
+	return 0, false
+}
+
+// scaled is CalcVal done in float64, so that values like 1.069 print
+// as they should
+func scaled(input, mult, div string) (float64, bool) {
+	var vals [3]float64
+	for i, s := range []string{input, mult, div} {
+		if !hexPattern.MatchString(s) {
+			return 0, false
+		}
+		// Summations run past 32 bits, and past float32's precision
+		v, err := strconv.ParseUint(s[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		vals[i] = float64(v)
+	}
+	return vals[0] * vals[1] / vals[2], true
+}
+
+// String returns the same view of the packet as Root.String
+func (f Fragment) String() string {
+	if s, ok := f.Packet.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return ""
+}
+
+// Header returns the csv column names used by Fields
+func (f Fragment) Header() []string {
+	return []string{"time", "name", "device_mac", "meter_mac", "value"}
+}
+
+// Fields returns the fragment as a csv record
+func (f Fragment) Fields() []string {
+	t := ""
+	if !f.Time.IsZero() {
+		t = f.Time.Format(time.RFC3339)
+	}
+	v := ""
+	if value, ok := f.Value(); ok {
+		v = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return []string{t, f.Name, f.DeviceMacId, f.MeterMacId, v}
+}
+
+// The json form of a fragment
+type jsonFragment struct {
+	Name        string          `json:"name"`
+	DeviceMacId string          `json:"deviceMacId,omitempty"`
+	MeterMacId  string          `json:"meterMacId,omitempty"`
+	Time        *time.Time      `json:"time,omitempty"`
+	Value       *float64        `json:"value,omitempty"`
+	Packet      json.RawMessage `json:"packet"`
+}
+
+// MarshalJSON encodes the fragment with its scaled value alongside
+// the raw packet fields
+func (f Fragment) MarshalJSON() ([]byte, error) {
+	packet, err := json.Marshal(f.Packet)
+	if err != nil {
+		return nil, err
+	}
+	j := jsonFragment{
+		Name:        f.Name,
+		DeviceMacId: f.DeviceMacId,
+		MeterMacId:  f.MeterMacId,
+		Packet:      packet,
+	}
+	if !f.Time.IsZero() {
+		t := f.Time
+		j.Time = &t
+	}
+	if v, ok := f.Value(); ok && !math.IsInf(v, 0) && !math.IsNaN(v) {
+		j.Value = &v
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes a fragment written by MarshalJSON
+func (f *Fragment) UnmarshalJSON(data []byte) error {
+	var j jsonFragment
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	p, err := newPacket(j.Name)
+	if err != nil {
+		return err
+	}
+	if len(j.Packet) > 0 && string(j.Packet) != "null" {
+		if err := json.Unmarshal(j.Packet, p); err != nil {
+			return err
+		}
+	}
+	f.Name = j.Name
+	f.DeviceMacId = j.DeviceMacId
+	f.MeterMacId = j.MeterMacId
+	f.Time = time.Time{}
+	if j.Time != nil {
+		f.Time = *j.Time
+	}
+	f.Packet = reflect.ValueOf(p).Elem().Interface()
+	return nil
+}
+
+// A Filter selects fragments by packet type, meter and time.  Empty
+// fields match everything.
+type Filter struct {
+	Names  []string
+	Meters []string
+	Since  time.Time
+	Until  time.Time
+}
+
+// Match reports whether the fragment passes the filter.  When a time
+// range is set, fragments without a timestamp don't match.
+func (f Filter) Match(frag Fragment) bool {
+	if len(f.Names) > 0 && !containsFold(f.Names, frag.Name) {
+		return false
+	}
+	if len(f.Meters) > 0 {
+		found := false
+		for _, m := range f.Meters {
+			if SameMac(m, frag.MeterMacId) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		if frag.Time.IsZero() {
+			return false
+		}
+		if !f.Since.IsZero() && frag.Time.Before(f.Since) {
+			return false
+		}
+		if !f.Until.IsZero() && !frag.Time.Before(f.Until) {
+			return false
+		}
+	}
+	return true
+}
+
+// SameMac reports whether two mac ids are the same, ignoring case
+// and the 0x prefix
+func SameMac(a, b string) bool {
+	return NormalizeMac(a) == NormalizeMac(b)
+}
+
+// NormalizeMac returns a mac id in the form the eagle sends it,
+// 0x followed by lower case hex digits
+func NormalizeMac(mac string) string {
+	mac = strings.ToLower(strings.TrimSpace(mac))
+	if mac == "" {
+		return ""
+	}
+	return "0x" + strings.TrimPrefix(mac, "0x")
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
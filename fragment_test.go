@@ -0,0 +1,176 @@
+package rainforestCommon
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const uploaderPost = `<?xml version="1.0"?>
+<rainforest>
+<InstantaneousDemand>
+  <DeviceMacId>0xd8d5b90000001234</DeviceMacId>
+  <MeterMacId>0x00135001000056ab</MeterMacId>
+  <TimeStamp>0x1C96BB5D</TimeStamp>
+  <Demand>0x00042d</Demand>
+  <Multiplier>0x00000001</Multiplier>
+  <Divisor>0x000003e8</Divisor>
+  <DigitsRight>0x03</DigitsRight>
+  <DigitsLeft>0x06</DigitsLeft>
+  <SuppressLeadingZero>Y</SuppressLeadingZero>
+</InstantaneousDemand>
+</rainforest>`
+
+const ravenStream = `<NetworkInfo>
+  <DeviceMacId>0xd8d5b90000001234</DeviceMacId>
+  <Status>Connected</Status>
+  <LinkStrength>0x64</LinkStrength>
+</NetworkInfo>
+<Unknown><Thing>1</Thing></Unknown>
+<PriceCluster>
+  <DeviceMacId>0xd8d5b90000001234</DeviceMacId>
+  <MeterMacId>0x00135001000056AB</MeterMacId>
+  <TimeStamp>0x1C96BB5D</TimeStamp>
+  <Price>0x0000000e</Price>
+  <TrailingDigits>0x02</TrailingDigits>
+  <Tier>0x01</Tier>
+</PriceCluster>
+`
+
+func TestDecodeAll(t *testing.T) {
+	frags, err := DecodeAll(strings.NewReader(uploaderPost))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frags) != 1 {
+		t.Fatal("Expected 1 fragment got ", len(frags))
+	}
+	f := frags[0]
+	if f.Name != "InstantaneousDemand" || !f.Time.Equal(targetTimeU) {
+		t.Error("Expected InstantaneousDemand at ", targetTimeU, " got ", f.Name, " at ", f.Time)
+	}
+	if v, ok := f.Value(); !ok || v != 1.069 {
+		t.Error("Expected 1.069 got ", v)
+	}
+
+	frags, err = DecodeAll(strings.NewReader(ravenStream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frags) != 2 || frags[0].Name != "NetworkInfo" || frags[1].Name != "PriceCluster" {
+		t.Fatal("Expected NetworkInfo and PriceCluster got ", frags)
+	}
+	if v, _ := frags[1].Value(); v != 0.14 {
+		t.Error("Expected price 0.14 got ", v)
+	}
+
+	// Exported power is negative, in 24 bit two's complement
+	for _, d := range []struct {
+		demand string
+		want   float64
+	}{
+		{"0xfffbd3", -1.069},
+		{"0xffffff", -0.001},
+		{"0x800000", -8388.608},
+		{"0x7fffff", 8388.607},
+	} {
+		v, ok := Fragment{Packet: InstantaneousDemand{Demand: d.demand, Multiplier: "0x00000001", Divisor: "0x000003e8"}}.Value()
+		if !ok || v != d.want {
+			t.Error("Expected ", d.want, " for ", d.demand, " got ", v)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	frags, _ := DecodeAll(strings.NewReader(ravenStream))
+
+	f := Filter{Meters: []string{"0X00135001000056ab"}}
+	if f.Match(frags[0]) || !f.Match(frags[1]) {
+		t.Error("Meter filter matched the wrong fragments")
+	}
+	f = Filter{Names: []string{"networkinfo"}}
+	if !f.Match(frags[0]) || f.Match(frags[1]) {
+		t.Error("Name filter matched the wrong fragments")
+	}
+	f = Filter{Since: targetTimeU.Add(-time.Second), Until: targetTimeU.Add(time.Second)}
+	if f.Match(frags[0]) || !f.Match(frags[1]) {
+		t.Error("Time filter matched the wrong fragments")
+	}
+	f = Filter{Until: targetTimeU}
+	if f.Match(frags[1]) {
+		t.Error("Until should be exclusive")
+	}
+}
+
+func TestFragmentJSON(t *testing.T) {
+	frags, _ := DecodeAll(strings.NewReader(uploaderPost))
+	data, err := json.Marshal(frags[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f Fragment
+	if err := json.Unmarshal(data, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.String() != frags[0].String() {
+		t.Error("Expected ", frags[0], " got ", f)
+	}
+}
+
+func TestCSVWriter(t *testing.T) {
+	frags, _ := DecodeAll(strings.NewReader(uploaderPost))
+	var buf bytes.Buffer
+	w, _ := NewRecordWriter(&buf, FormatCSV)
+	w.Write(frags[0])
+	w.Flush()
+	expected := "time,name,device_mac,meter_mac,value\n" +
+		"2015-03-14T09:26:53Z,InstantaneousDemand,0xd8d5b90000001234,0x00135001000056ab,1.069\n"
+	if buf.String() != expected {
+		t.Error("Expected ", expected, " got ", buf.String())
+	}
+}
+
+const eagle200Post = `<?xml version="1.0"?>
+<rainforest macId="0xd8d5b90000001234" version="undefined" timestamp="1426325213000ms">
+<InstantaneousDemand>
+  <MeterMacId>0x00135001000056ab</MeterMacId>
+  <Demand>0x00042d</Demand>
+  <Multiplier>0x00000001</Multiplier>
+  <Divisor>0x000003e8</Divisor>
+  <DigitsRight>0x03</DigitsRight>
+  <DigitsLeft>0x06</DigitsLeft>
+  <SuppressLeadingZero>Y</SuppressLeadingZero>
+</InstantaneousDemand>
+</rainforest>`
+
+func TestDecodeUpload(t *testing.T) {
+	env, eagle200, err := DecodeUpload(strings.NewReader(eagle200Post))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Format != EnvelopeEagle200 || env.MacId != "0xd8d5b90000001234" || env.Version != "undefined" || !env.Timestamp.Equal(targetTimeU) {
+		t.Error("Expected the Eagle-200 envelope got ", env)
+	}
+	legacyEnv, legacy, _ := DecodeUpload(strings.NewReader(strings.Replace(uploaderPost, "<rainforest>", `<rainforest macId="0xd8d5b90000001234" timestamp="1426325213s">`, 1)))
+	if legacyEnv.Format != EnvelopeLegacy || !legacyEnv.Timestamp.Equal(targetTimeU) {
+		t.Error("Expected the legacy envelope got ", legacyEnv)
+	}
+	if len(eagle200) != 1 || len(legacy) != 1 {
+		t.Fatal("Expected a fragment from each got ", eagle200, legacy)
+	}
+	a, b := eagle200[0], legacy[0]
+	va, _ := a.Value()
+	vb, _ := b.Value()
+	if a.Name != b.Name || a.DeviceMacId != b.DeviceMacId || a.MeterMacId != b.MeterMacId || !a.Time.Equal(b.Time) || va != vb {
+		t.Error("Expected the same fragment got ", a, " and ", b)
+	}
+	if a.Packet.(InstantaneousDemand).DeviceMacId != b.DeviceMacId {
+		t.Error("Expected the packet's DeviceMacId from the envelope")
+	}
+
+	if env, _, _ := DecodeUpload(strings.NewReader(ravenStream)); env.Format != "" {
+		t.Error("Expected no envelope for a RAVEn stream got ", env)
+	}
+}
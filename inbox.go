@@ -0,0 +1,244 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The duration a utility uses for a message that lasts until it is
+// replaced
+const untilChanged = 0xffff
+
+// A Message is a text message from the utility, decoded from a
+// MessageCluster
+type Message struct {
+	Id                   string
+	MeterMacId           string
+	DeviceMacId          string
+	Text                 string
+	Priority             string
+	Start                time.Time
+	Duration             time.Duration // 0 if the message lasts until replaced
+	ConfirmationRequired bool
+	Confirmed            bool
+	ConfirmedAt          time.Time // when we sent the confirmation
+	Cancelled            bool
+	Received             time.Time
+}
+
+// priorityRank orders priorities from most to least urgent
+var priorityRank = map[string]int{
+	"critical": 0,
+	"high":     1,
+	"medium":   2,
+	"low":      3,
+}
+
+func (m Message) rank() int {
+	if r, ok := priorityRank[strings.ToLower(m.Priority)]; ok {
+		return r
+	}
+	return len(priorityRank)
+}
+
+// Expired reports whether the message's time is over, or it was
+// cancelled
+func (m Message) Expired(now time.Time) bool {
+	if m.Cancelled {
+		return true
+	}
+	return m.Duration > 0 && !now.Before(m.Start.Add(m.Duration))
+}
+
+// Active reports whether the message should be shown now
+func (m Message) Active(now time.Time) bool {
+	return !now.Before(m.Start) && !m.Expired(now)
+}
+
+// NeedsConfirmation reports whether the utility asked for the message
+// to be confirmed and it hasn't been yet
+func (m Message) NeedsConfirmation() bool {
+	return m.ConfirmationRequired && !m.Confirmed && m.ConfirmedAt.IsZero()
+}
+
+// NewMessage decodes a MessageCluster.  A start time of zero means the
+// message starts when it is received.
+func NewMessage(c MessageCluster, received time.Time) Message {
+	m := Message{
+		Id:                   c.Id,
+		MeterMacId:           NormalizeMac(c.MeterMacId),
+		DeviceMacId:          NormalizeMac(c.DeviceMacId),
+		Text:                 c.Text,
+		Priority:             c.Priority,
+		ConfirmationRequired: yes(c.ConfirmationRequired),
+		Confirmed:            yes(c.Confirmed),
+		Cancelled:            strings.EqualFold(c.Queue, "Cancel Pending"),
+		Received:             received,
+		Start:                received,
+	}
+	if v := getval(c.StartTime); v > 0 {
+		m.Start = fragmentTime(c.StartTime)
+	}
+	if d := getval(c.Duration); d > 0 && d != untilChanged {
+		m.Duration = time.Duration(d) * time.Minute
+	}
+	return m
+}
+
+func yes(s string) bool {
+	return strings.EqualFold(s, "Y") || strings.EqualFold(s, "Yes") || strings.EqualFold(s, "true")
+}
+
+// An Inbox keeps the messages the utility has sent, by Id, and sends
+// the confirmations they ask for.  It is a Sink, fed MessageCluster
+// fragments.
+type Inbox struct {
+	// Commander sends confirm_message, through the eagle's local api
+	// or a RAVEn
+	Commander Commander
+
+	// AutoConfirm confirms messages that require it as soon as they
+	// arrive
+	AutoConfirm bool
+
+	// Errors, if not nil, is called when an automatic confirmation
+	// fails
+	Errors func(error)
+
+	mu       sync.Mutex
+	messages map[string]*Message
+}
+
+// NewInbox returns an empty inbox that confirms messages with c
+func NewInbox(c Commander) *Inbox {
+	return &Inbox{Commander: c, messages: make(map[string]*Message)}
+}
+
+// Write records the messages in frags
+func (i *Inbox) Write(ctx context.Context, frags []Fragment) error {
+	var confirm []string
+	now := time.Now()
+	i.mu.Lock()
+	for _, f := range frags {
+		c, ok := f.Packet.(MessageCluster)
+		if !ok || c.Id == "" {
+			continue
+		}
+		m := NewMessage(c, now)
+		if old, ok := i.messages[c.Id]; ok {
+			// Keep what we know from earlier copies
+			m.Received = old.Received
+			if getval(c.StartTime) <= 0 {
+				m.Start = old.Start
+			}
+			m.ConfirmedAt = old.ConfirmedAt
+			m.Confirmed = m.Confirmed || old.Confirmed
+		}
+		i.messages[c.Id] = &m
+		if i.AutoConfirm && m.NeedsConfirmation() {
+			confirm = append(confirm, m.Id)
+		}
+	}
+	i.mu.Unlock()
+
+	for _, id := range confirm {
+		if err := i.Confirm(ctx, id); err != nil && i.Errors != nil {
+			i.Errors(err)
+		}
+	}
+	return nil
+}
+
+// Close does nothing
+func (i *Inbox) Close() error {
+	return nil
+}
+
+// Confirm tells the meter the message has been seen and records when
+func (i *Inbox) Confirm(ctx context.Context, id string) error {
+	i.mu.Lock()
+	m, ok := i.messages[id]
+	var meter string
+	if ok {
+		meter = m.MeterMacId
+	}
+	i.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("No message %s", id)
+	}
+	if i.Commander == nil {
+		return fmt.Errorf("No way to confirm message %s", id)
+	}
+	_, err := i.Commander.Command(ctx, ConfirmMessage(meter, id))
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if m, ok := i.messages[id]; ok {
+		m.ConfirmedAt = time.Now()
+	}
+	return nil
+}
+
+// Get returns a message by Id
+func (i *Inbox) Get(id string) (Message, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	m, ok := i.messages[id]
+	if !ok {
+		return Message{}, false
+	}
+	return *m, true
+}
+
+// Messages returns every message, most urgent first and then newest
+// first
+func (i *Inbox) Messages() []Message {
+	i.mu.Lock()
+	result := make([]Message, 0, len(i.messages))
+	for _, m := range i.messages {
+		result = append(result, *m)
+	}
+	i.mu.Unlock()
+	sort.Slice(result, func(a, b int) bool {
+		if ra, rb := result[a].rank(), result[b].rank(); ra != rb {
+			return ra < rb
+		}
+		if !result[a].Start.Equal(result[b].Start) {
+			return result[a].Start.After(result[b].Start)
+		}
+		return result[a].Id < result[b].Id
+	})
+	return result
+}
+
+// Active returns the messages to show at now, in the order of Messages
+func (i *Inbox) Active(now time.Time) []Message {
+	var result []Message
+	for _, m := range i.Messages() {
+		if m.Active(now) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// Expire forgets messages that expired before now
+func (i *Inbox) Expire(now time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for id, m := range i.messages {
+		if m.Expired(now) {
+			delete(i.messages, id)
+		}
+	}
+}
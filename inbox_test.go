@@ -0,0 +1,80 @@
+package rainforestCommon
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+const messages = `<MessageCluster>
+  <MeterMacId>0x01</MeterMacId>
+  <TimeStamp>0x1C96BB5D</TimeStamp>
+  <Id>0x0000000a</Id>
+  <Text>Rates change tomorrow</Text>
+  <Priority>Low</Priority>
+  <StartTime>0x1C96BB5D</StartTime>
+  <Duration>0x003c</Duration>
+  <ConfirmationRequired>N</ConfirmationRequired>
+  <Confirmed>N</Confirmed>
+  <Queue>Active</Queue>
+</MessageCluster>
+<MessageCluster>
+  <MeterMacId>0x01</MeterMacId>
+  <TimeStamp>0x1C96BB5D</TimeStamp>
+  <Id>0x0000000b</Id>
+  <Text>Critical peak event</Text>
+  <Priority>Critical</Priority>
+  <StartTime>0x1C96BB5D</StartTime>
+  <Duration>0xffff</Duration>
+  <ConfirmationRequired>Y</ConfirmationRequired>
+  <Confirmed>N</Confirmed>
+  <Queue>Active</Queue>
+</MessageCluster>`
+
+type testCommander struct {
+	sent []LocalCommand
+}
+
+func (c *testCommander) Command(ctx context.Context, cmd LocalCommand) ([]Fragment, error) {
+	c.sent = append(c.sent, cmd)
+	return nil, nil
+}
+
+func TestInbox(t *testing.T) {
+	c := &testCommander{}
+	inbox := NewInbox(c)
+	inbox.AutoConfirm = true
+	frags, _ := DecodeAll(strings.NewReader(messages))
+	inbox.Write(context.Background(), frags)
+
+	all := inbox.Messages()
+	if len(all) != 2 || all[0].Id != "0x0000000b" {
+		t.Fatal("Expected the critical message first got ", all)
+	}
+	if len(c.sent) != 1 || c.sent[0].Name != "confirm_message" || c.sent[0].Id != "0x0000000b" || c.sent[0].MacId != "0x01" {
+		t.Error("Expected a confirmation of 0x0000000b got ", c.sent)
+	}
+	if m, _ := inbox.Get("0x0000000b"); m.NeedsConfirmation() || m.ConfirmedAt.IsZero() {
+		t.Error("Expected the confirmation to be recorded got ", m)
+	}
+
+	later := targetTimeU.Add(2 * time.Hour)
+	if active := inbox.Active(later); len(active) != 1 || active[0].Id != "0x0000000b" {
+		t.Error("Expected only the open ended message after an hour got ", active)
+	}
+	if active := inbox.Active(targetTimeU.Add(-time.Minute)); len(active) != 0 {
+		t.Error("Expected nothing before the start got ", active)
+	}
+
+	// A repeat of the message doesn't confirm it again
+	inbox.Write(context.Background(), frags)
+	if len(c.sent) != 1 {
+		t.Error("Expected one confirmation got ", c.sent)
+	}
+
+	inbox.Expire(later)
+	if _, ok := inbox.Get("0x0000000a"); ok {
+		t.Error("Expected the expired message to be forgotten")
+	}
+}
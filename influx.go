@@ -0,0 +1,88 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// An Influx writes readings to InfluxDB using the line protocol.  Each
+// fragment that carries a value becomes a point in a measurement named
+// after the fragment, tagged with the device and meter.
+type Influx struct {
+	// URL is the write endpoint including its query, e.g.
+	// http://localhost:8086/write?db=energy for InfluxDB 1.x or
+	// http://localhost:8086/api/v2/write?org=home&bucket=energy for 2.x
+	URL string
+
+	// Token, if set, is sent as an InfluxDB 2.x api token
+	Token string
+
+	// Client is used to make requests, or http.DefaultClient if nil
+	Client *http.Client
+}
+
+// Write posts the readings in frags
+func (i *Influx) Write(ctx context.Context, frags []Fragment) error {
+	var b bytes.Buffer
+	for _, f := range frags {
+		v, ok := f.Value()
+		if !ok || f.Time.IsZero() {
+			continue
+		}
+		fmt.Fprintf(&b, "%s,device=%s,meter=%s value=%g %d\n",
+			f.Name,
+			influxTag(NormalizeMac(f.DeviceMacId)),
+			influxTag(NormalizeMac(f.MeterMacId)),
+			v,
+			f.Time.UnixNano())
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, i.URL, &b)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.Token != "" {
+		req.Header.Set("Authorization", "Token "+i.Token)
+	}
+	client := i.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influx: %s %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Close does nothing
+func (i *Influx) Close() error {
+	return nil
+}
+
+// influxTag escapes a tag value for the line protocol.  Missing tags
+// are written as "none", as the protocol doesn't allow empty values.
+func influxTag(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
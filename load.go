@@ -0,0 +1,322 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A LoadSample is a meter's demand.  Readings from InstantaneousDemand
+// are at Time; intervals from ProfileData start at Time, last Period
+// and hold the average demand over it.
+type LoadSample struct {
+	MeterMacId string        `json:"meterMacId"`
+	Time       time.Time     `json:"time"`
+	KW         float64       `json:"kw"`
+	Period     time.Duration `json:"period,omitempty"`
+}
+
+// The interval lengths a ProfileIntervalPeriod selects
+var profilePeriods = []time.Duration{
+	24 * time.Hour,
+	60 * time.Minute,
+	30 * time.Minute,
+	15 * time.Minute,
+	10 * time.Minute,
+	7*time.Minute + 30*time.Second,
+	5 * time.Minute,
+	2*time.Minute + 30*time.Second,
+}
+
+// ProfilePeriod returns the length of each of the packet's intervals
+func (p ProfileData) ProfilePeriod() (time.Duration, bool) {
+	i := getval(p.ProfileIntervalPeriod)
+	if i < 0 || i >= len(profilePeriods) {
+		return 0, false
+	}
+	return profilePeriods[i], true
+}
+
+// Intervals returns the packet's delivered intervals, oldest first, as
+// the time each started and its raw value.  The meter sends the most
+// recent interval first, ending at EndTime, and 0xffffff for intervals
+// it has no data for; those are left out.
+func (p ProfileData) Intervals() (starts []time.Time, values []uint64) {
+	period, ok := p.ProfilePeriod()
+	end := fragmentTime(p.EndTime)
+	if !ok || end.IsZero() {
+		return nil, nil
+	}
+	data := []string{p.IntervalData1, p.IntervalData2, p.IntervalData3, p.IntervalData4,
+		p.IntervalData5, p.IntervalData6, p.IntervalData7, p.IntervalData8,
+		p.IntervalData9, p.IntervalData10, p.IntervalData11, p.IntervalData12}
+	n := getval(p.NumberOfPeriodsDelivered)
+	if n < 0 || n > len(data) {
+		n = len(data)
+	}
+	for i := n - 1; i >= 0; i-- {
+		if !hexPattern.MatchString(data[i]) {
+			continue
+		}
+		v, err := strconv.ParseUint(data[i][2:], 16, 64)
+		if err != nil || v == 0xffffff {
+			continue
+		}
+		starts = append(starts, end.Add(-time.Duration(i+1)*period))
+		values = append(values, v)
+	}
+	return starts, values
+}
+
+// LoadSamples returns the demand in frags, from InstantaneousDemand and
+// ProfileData, in the order given.  ProfileData holds energy in the
+// units of the meter's summations, so each meter's intervals are scaled
+// by the Multiplier and Divisor of the last summation before them, or
+// taken as Wh if there was none.
+func LoadSamples(frags []Fragment) []LoadSample {
+	type scale struct{ mult, div string }
+	scales := make(map[string]scale)
+	var samples []LoadSample
+	for _, f := range frags {
+		meter := NormalizeMac(f.MeterMacId)
+		switch p := f.Packet.(type) {
+		case CurrentSummationDelivered:
+			scales[meter] = scale{p.Multiplier, p.Divisor}
+		case CurrentSummation:
+			scales[meter] = scale{p.Multiplier, p.Divisor}
+		case InstantaneousDemand:
+			if kw, ok := demandKW(p); ok && !f.Time.IsZero() {
+				samples = append(samples, LoadSample{MeterMacId: meter, Time: f.Time, KW: kw})
+			}
+		case ProfileData:
+			period, ok := p.ProfilePeriod()
+			if !ok {
+				continue
+			}
+			s, found := scales[meter]
+			if !found {
+				s = scale{"0x1", "0x3e8"}
+			}
+			kwh, ok := scaled("0x1", s.mult, s.div)
+			if !ok || math.IsInf(kwh, 0) || math.IsNaN(kwh) {
+				continue
+			}
+			starts, values := p.Intervals()
+			for i, t := range starts {
+				samples = append(samples, LoadSample{MeterMacId: meter, Time: t,
+					KW: float64(values[i]) * kwh / period.Hours(), Period: period})
+			}
+		}
+	}
+	return samples
+}
+
+// percentile returns the p'th percentile, 0 to 100, of values by
+// nearest rank.  It sorts values.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	i := int(math.Ceil(p/100*float64(len(values)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(values) {
+		i = len(values) - 1
+	}
+	return values[i]
+}
+
+// median returns the middle of values.  It sorts values.
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 0 {
+		return (values[n/2-1] + values[n/2]) / 2
+	}
+	return values[n/2]
+}
+
+// linearFit returns the least squares line through the points (x, y)
+func linearFit(x, y []float64) (intercept, slope float64) {
+	n := float64(len(x))
+	if n == 0 {
+		return 0, 0
+	}
+	var sx, sy, sxx, sxy float64
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		sxy += x[i] * y[i]
+	}
+	if d := n*sxx - sx*sx; d > 0 {
+		slope = (n*sxy - sx*sy) / d
+	}
+	return (sy - slope*sx) / n, slope
+}
+
+// expandHistory returns frags with each HistoryData replaced by the
+// timed summations in it
+func expandHistory(frags []Fragment) []Fragment {
+	var result []Fragment
+	for _, f := range frags {
+		h, ok := f.Packet.(HistoryData)
+		if !ok {
+			result = append(result, f)
+			continue
+		}
+		for _, s := range h.SummationList {
+			if s.XMLName.Local == "" {
+				s.XMLName.Local = "CurrentSummation"
+			}
+			if sf, err := NewFragment(s); err == nil && !sf.Time.IsZero() {
+				result = append(result, sf)
+			}
+		}
+	}
+	return result
+}
+
+// An EnergyHour is a meter's energy use in the hour from Start
+type EnergyHour struct {
+	Start time.Time `json:"start"`
+	KWh   float64   `json:"kWh"`
+}
+
+// HourlyEnergy returns each meter's energy use by hour, in time order,
+// from its summations, including those in HistoryData.  Wraps and
+// resets are taken out with Stitch, and the use between two readings
+// is spread evenly over the time between them.  Readings more than 6
+// hours apart are a gap, with no use recorded.
+func HourlyEnergy(frags []Fragment) map[string][]EnergyHour {
+	var summations []Fragment
+	for _, f := range expandHistory(frags) {
+		if _, _, ok := summation(f); ok && !f.Time.IsZero() {
+			summations = append(summations, f)
+		}
+	}
+	sort.SliceStable(summations, func(i, j int) bool { return summations[i].Time.Before(summations[j].Time) })
+	readings, _ := Stitch(summations)
+
+	bins := make(map[string]map[time.Time]float64)
+	last := make(map[string]CounterReading)
+	for _, r := range readings {
+		prev, ok := last[r.MeterMacId]
+		last[r.MeterMacId] = r
+		dt := r.Time.Sub(prev.Time)
+		if !ok || dt <= 0 || dt > 6*time.Hour {
+			continue
+		}
+		m := bins[r.MeterMacId]
+		if m == nil {
+			m = make(map[time.Time]float64)
+			bins[r.MeterMacId] = m
+		}
+		kwh := r.Corrected - prev.Corrected
+		for t := prev.Time; t.Before(r.Time); {
+			hour := t.Truncate(time.Hour)
+			next := hour.Add(time.Hour)
+			if next.After(r.Time) {
+				next = r.Time
+			}
+			m[hour] += kwh * float64(next.Sub(t)) / float64(dt)
+			t = next
+		}
+	}
+
+	result := make(map[string][]EnergyHour)
+	for meter, m := range bins {
+		hours := make([]EnergyHour, 0, len(m))
+		for t, kwh := range m {
+			hours = append(hours, EnergyHour{t, kwh})
+		}
+		sort.Slice(hours, func(i, j int) bool { return hours[i].Start.Before(hours[j].Start) })
+		result[meter] = hours
+	}
+	return result
+}
+
+// DailyEnergy totals hours by their date in loc.  Days with fewer than
+// 23 hours of data are left out.
+func DailyEnergy(hours []EnergyHour, loc *time.Location) []DailyUse {
+	var days []DailyUse
+	count := 0
+	flush := func() {
+		if count < 23 {
+			days = days[:len(days)-1]
+		}
+	}
+	for _, h := range hours {
+		date := h.Start.In(loc).Format("2006-01-02")
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			if len(days) > 0 {
+				flush()
+			}
+			days = append(days, DailyUse{Date: date})
+			count = 0
+		}
+		days[len(days)-1].KWh += h.KWh
+		count++
+	}
+	if len(days) > 0 {
+		flush()
+	}
+	return days
+}
+
+// An EnergyInterval is a meter's energy use in the Period from Start
+type EnergyInterval struct {
+	Start  time.Time     `json:"start"`
+	Period time.Duration `json:"period"`
+	KWh    float64       `json:"kWh"`
+}
+
+// UsageIntervals returns each meter's energy use, in time order: its
+// ProfileData intervals if it has any, or else the hours from its
+// summations and HistoryData.  Intervals sent more than once, as
+// ProfileData replies that overlap are, are counted once.
+func UsageIntervals(frags []Fragment) map[string][]EnergyInterval {
+	profiles := make(map[string]map[time.Time]EnergyInterval)
+	for _, s := range LoadSamples(frags) {
+		if s.Period == 0 {
+			continue
+		}
+		m := profiles[s.MeterMacId]
+		if m == nil {
+			m = make(map[time.Time]EnergyInterval)
+			profiles[s.MeterMacId] = m
+		}
+		m[s.Time] = EnergyInterval{s.Time, s.Period, s.KW * s.Period.Hours()}
+	}
+
+	result := make(map[string][]EnergyInterval)
+	for meter, hours := range HourlyEnergy(frags) {
+		if profiles[meter] != nil {
+			continue
+		}
+		intervals := make([]EnergyInterval, len(hours))
+		for i, h := range hours {
+			intervals[i] = EnergyInterval{h.Start, time.Hour, h.KWh}
+		}
+		result[meter] = intervals
+	}
+	for meter, m := range profiles {
+		intervals := make([]EnergyInterval, 0, len(m))
+		for _, e := range m {
+			intervals = append(intervals, e)
+		}
+		sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start.Before(intervals[j].Start) })
+		result[meter] = intervals
+	}
+	return result
+}
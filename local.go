@@ -0,0 +1,117 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A Commander sends commands to an eagle or a RAVEn.  LocalClient and
+// Raven are Commanders.
+type Commander interface {
+	Command(ctx context.Context, cmd LocalCommand) ([]Fragment, error)
+}
+
+// A LocalClient sends commands to the local api of an eagle on the
+// same network
+type LocalClient struct {
+	// URL is the eagle's command endpoint, e.g.
+	// http://192.168.1.10/cgi-bin/post_manager
+	URL string
+
+	// User and Password are the eagle's cloud id and install code
+	User     string
+	Password string
+
+	// Client is used to make requests, or http.DefaultClient if nil
+	Client *http.Client
+}
+
+// Command sends a command to the eagle and returns the fragments in
+// its reply
+func (l *LocalClient) Command(ctx context.Context, cmd LocalCommand) ([]Fragment, error) {
+	resp, err := postXML(ctx, l.Client, l.URL, l.User, l.Password, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cmd.Name, err)
+	}
+	defer resp.Body.Close()
+	return DecodeAll(resp.Body)
+}
+
+// postXML posts v, marshalled to xml, to an eagle's local api.  The
+// response has a 200 status and its body must be closed.
+func postXML(ctx context.Context, client *http.Client, url, user, password string, v interface{}) (*http.Response, error) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/xml")
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return resp, nil
+}
+
+// Poll sends each of the named commands to the eagle every interval
+// and passes the replies to out, until ctx is done.  Failed commands
+// are reported to errs (if not nil) and retried at the next interval.
+func (l *LocalClient) Poll(ctx context.Context, macId string, names []string, interval time.Duration, out chan<- Fragment, errs func(error)) error {
+	return Poll(ctx, l, macId, names, interval, out, errs)
+}
+
+// Poll sends each of the named commands with c every interval and
+// passes the replies to out, until ctx is done.  Failed commands are
+// reported to errs (if not nil) and retried at the next interval.
+func Poll(ctx context.Context, c Commander, macId string, names []string, interval time.Duration, out chan<- Fragment, errs func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, name := range names {
+			frags, err := c.Command(ctx, LocalCommand{Name: name, MacId: macId})
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if errs != nil {
+					errs(err)
+				}
+				continue
+			}
+			for _, f := range frags {
+				select {
+				case out <- f:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The number of hex digits the eagle writes for each field.  Entries
+// for "Type.Field" take precedence over those for "Field".  Fields
+// that aren't listed, like Status or Channel, are written as they are.
+var hexWidths = map[string]int{
+	"DeviceMacId":                      16,
+	"MeterMacId":                       16,
+	"CoordMacId":                       16,
+	"ExtPanId":                         16,
+	"InstallCode":                      16,
+	"LinkKey":                          32,
+	"TimeStamp":                        8,
+	"UTCTime":                          8,
+	"LocalTime":                        8,
+	"StartTime":                        8,
+	"EndTime":                          8,
+	"CurrentStart":                     8,
+	"Demand":                           6,
+	"SummationDelivered":               16,
+	"SummationReceived":                16,
+	"Multiplier":                       8,
+	"Divisor":                          8,
+	"DigitsRight":                      2,
+	"DigitsLeft":                       2,
+	"Price":                            8,
+	"Currency":                         4,
+	"TrailingDigits":                   2,
+	"Tier":                             2,
+	"Duration":                         4,
+	"CurrentDuration":                  4,
+	"Id":                               8,
+	"ShortAddr":                        4,
+	"LinkStrength":                     2,
+	"Frequency":                        4,
+	"ProfileIntervalPeriod":            2,
+	"NumberOfPeriodsDelivered":         2,
+	"BlockPeriodConsumption":           16,
+	"BlockPeriodConsumptionMultiplier": 8,
+	"BlockPeriodConsumptionDivisor":    8,
+	"NumberOfBlocks":                   2,
+	"ProfileData.IntervalData1":        6,
+	"ProfileData.IntervalData2":        6,
+	"ProfileData.IntervalData3":        6,
+	"ProfileData.IntervalData4":        6,
+	"ProfileData.IntervalData5":        6,
+	"ProfileData.IntervalData6":        6,
+	"ProfileData.IntervalData7":        6,
+	"ProfileData.IntervalData8":        6,
+	"ProfileData.IntervalData9":        6,
+	"ProfileData.IntervalData10":       6,
+	"ProfileData.IntervalData11":       6,
+	"ProfileData.IntervalData12":       6,
+}
+
+// hexWidth returns the width of a field, or 0 if it isn't hex
+func hexWidth(packet, field string) int {
+	if w, ok := hexWidths[packet+"."+field]; ok {
+		return w
+	}
+	return hexWidths[field]
+}
+
+// formatHex writes a value the way the eagle does: 0x and at least
+// width digits.  The case of the digits is kept, so decoded values are
+// written back as they came.  Decimal values are converted; anything
+// else is returned unchanged.
+func formatHex(s string, width int) string {
+	if width == 0 {
+		return s
+	}
+	var digits string
+	switch {
+	case hexPattern.MatchString(s):
+		digits = s[2:]
+	default:
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return s
+		}
+		digits = strconv.FormatUint(v, 16)
+	}
+	if len(digits) < width {
+		digits = strings.Repeat("0", width-len(digits)) + digits
+	}
+	return "0x" + digits
+}
+
+// marshalPacket writes a packet's fields in the order the eagle sends
+// them, which is the order they are declared in, leaving out the empty
+// ones
+func marshalPacket(e *xml.Encoder, start xml.StartElement, packet interface{}) error {
+	v := reflect.ValueOf(packet)
+	t := v.Type()
+	if start.Name.Local == "" {
+		start.Name.Local = t.Name()
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Name == "XMLName" {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String:
+			s := v.Field(i).String()
+			if s == "" {
+				continue
+			}
+			s = formatHex(s, hexWidth(t.Name(), field.Name))
+			if err := e.EncodeElement(s, xml.StartElement{Name: xml.Name{Local: field.Name}}); err != nil {
+				return err
+			}
+		case reflect.Slice:
+			if err := e.Encode(v.Field(i).Interface()); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Can't marshal %s.%s", t.Name(), field.Name)
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// MarshalXML writes the fragment's packet
+func (f Fragment) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if f.Packet == nil {
+		return fmt.Errorf("Empty fragment %s", f.Name)
+	}
+	return e.Encode(f.Packet)
+}
+
+func (p BlockPriceDetail) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p CurrentSummation) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p CurrentSummationDelivered) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p DeviceInfo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p FastPollStatus) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p HistoryData) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p InstantaneousDemand) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p MessageCluster) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p MeterInfo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p NetworkInfo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p PriceCluster) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p ProfileData) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p ScheduleInfo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
+
+func (p TimeCluster) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return marshalPacket(e, start, p)
+}
@@ -0,0 +1,106 @@
+package rainforestCommon
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+const goldenFragments = `<InstantaneousDemand>
+  <DeviceMacId>0xd8d5b90000001234</DeviceMacId>
+  <MeterMacId>0x00135001000056ab</MeterMacId>
+  <TimeStamp>0x1C96BB5D</TimeStamp>
+  <Demand>0x00042d</Demand>
+  <Multiplier>0x00000001</Multiplier>
+  <Divisor>0x000003e8</Divisor>
+  <DigitsRight>0x03</DigitsRight>
+  <DigitsLeft>0x06</DigitsLeft>
+  <SuppressLeadingZero>Y</SuppressLeadingZero>
+</InstantaneousDemand>
+<NetworkInfo>
+  <DeviceMacId>0xd8d5b90000001234</DeviceMacId>
+  <CoordMacId>0x00135001000056ab</CoordMacId>
+  <Status>Connected</Status>
+  <Description>Successfully Joined</Description>
+  <ExtPanId>0x00135001000056ab</ExtPanId>
+  <Channel>20</Channel>
+  <ShortAddr>0xe1aa</ShortAddr>
+  <LinkStrength>0x64</LinkStrength>
+</NetworkInfo>
+<HistoryData>
+  <CurrentSummation>
+    <DeviceMacId>0xd8d5b90000001234</DeviceMacId>
+    <MeterMacId>0x00135001000056ab</MeterMacId>
+    <TimeStamp>0x1c96bb5d</TimeStamp>
+    <SummationDelivered>0x0000000001321a5f</SummationDelivered>
+    <SummationReceived>0x0000000000000000</SummationReceived>
+    <Multiplier>0x00000001</Multiplier>
+    <Divisor>0x000003e8</Divisor>
+  </CurrentSummation>
+</HistoryData>`
+
+func TestMarshalGolden(t *testing.T) {
+	frags, err := DecodeAll(strings.NewReader(goldenFragments))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, f := range frags {
+		data, err := xml.MarshalIndent(f, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, string(data))
+	}
+	if got := strings.Join(out, "\n"); got != goldenFragments {
+		t.Error("Expected\n", goldenFragments, "\ngot\n", got)
+	}
+}
+
+func TestMarshalWidths(t *testing.T) {
+	data, err := xml.Marshal(PriceCluster{
+		MeterMacId:     "0x1",
+		TimeStamp:      "0x1c96bb5d",
+		Price:          "14",
+		TrailingDigits: "0x2",
+		Tier:           "1",
+		RateLabel:      "Tier 1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<PriceCluster><MeterMacId>0x0000000000000001</MeterMacId><TimeStamp>0x1c96bb5d</TimeStamp>" +
+		"<Price>0x0000000e</Price><TrailingDigits>0x02</TrailingDigits><Tier>0x01</Tier><RateLabel>Tier 1</RateLabel></PriceCluster>"
+	if string(data) != want {
+		t.Error("Expected ", want, " got ", string(data))
+	}
+}
+
+func TestCommands(t *testing.T) {
+	start := time.Date(2015, time.March, 14, 9, 26, 53, 0, time.UTC)
+	c, err := GetHistoryData("0x01", start, start.Add(time.Hour), 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := xml.Marshal(c)
+	want := "<LocalCommand><Name>get_history_data</Name><MacId>0x01</MacId><StartTime>0x1c96bb5d</StartTime>" +
+		"<EndTime>0x1c96c96d</EndTime><Frequency>0x0384</Frequency></LocalCommand>"
+	if string(data) != want {
+		t.Error("Expected ", want, " got ", string(data))
+	}
+
+	c, err = SetFastPoll("0x01", 5*time.Second, 10*time.Minute)
+	if err != nil || c.Name != CommandSetFastPoll || c.Frequency != "0x0005" || c.Duration != "0x000a" {
+		t.Error("Expected 5 seconds for 10 minutes got ", c, " ", err)
+	}
+	if _, err := SetFastPoll("0x01", 5*time.Second, time.Hour); err == nil {
+		t.Error("Expected an error for a long fast poll")
+	}
+	if _, err := GetHistoryData("0x01", start, start.Add(-time.Hour), 0); err == nil {
+		t.Error("Expected an error for an end before the start")
+	}
+	if c := ConfirmMessage("0x01", "0x0a"); c.Name != CommandConfirmMessage || c.Id != "0x0a" {
+		t.Error("Expected a confirmation got ", c)
+	}
+}
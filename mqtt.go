@@ -0,0 +1,154 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// An MQTT publishes fragments as json to an MQTT 3.1.1 broker, at
+// QoS 0, on the topic Topic/<meter>/<fragment name>
+type MQTT struct {
+	// Broker is the host:port of the broker
+	Broker   string
+	ClientId string
+	User     string
+	Password string
+	Topic    string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Write publishes frags, connecting to the broker if need be.  A
+// failed publish drops the connection so the next Write reconnects.
+func (m *MQTT) Write(ctx context.Context, frags []Fragment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		if err := m.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		m.conn.SetWriteDeadline(deadline)
+	} else {
+		m.conn.SetWriteDeadline(time.Time{})
+	}
+	for _, f := range frags {
+		payload, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		source := NormalizeMac(f.MeterMacId)
+		if source == "" {
+			source = NormalizeMac(f.DeviceMacId)
+		}
+		topic := fmt.Sprintf("%s/%s/%s", m.Topic, source, f.Name)
+		var body bytes.Buffer
+		mqttString(&body, topic)
+		body.Write(payload)
+		if err := mqttPacket(m.conn, 0x30, body.Bytes()); err != nil {
+			m.conn.Close()
+			m.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// Close disconnects from the broker
+func (m *MQTT) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return nil
+	}
+	mqttPacket(m.conn, 0xe0, nil)
+	err := m.conn.Close()
+	m.conn = nil
+	return err
+}
+
+func (m *MQTT) connect(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.Broker)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// Keep alive is 0 so the broker won't expect pings between writes
+	var body bytes.Buffer
+	mqttString(&body, "MQTT")
+	flags := byte(0x02) // clean session
+	if m.User != "" {
+		flags |= 0x80
+		if m.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body.Write([]byte{4, flags, 0, 0})
+	mqttString(&body, m.ClientId)
+	if m.User != "" {
+		mqttString(&body, m.User)
+		if m.Password != "" {
+			mqttString(&body, m.Password)
+		}
+	}
+	if err := mqttPacket(conn, 0x10, body.Bytes()); err != nil {
+		conn.Close()
+		return err
+	}
+
+	var ack [4]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		conn.Close()
+		return err
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		conn.Close()
+		return fmt.Errorf("mqtt: connection refused, code %d", ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+	m.conn = conn
+	return nil
+}
+
+// mqttPacket writes a control packet with the given type and flags
+func mqttPacket(w io.Writer, header byte, body []byte) error {
+	if len(body) > 268435455 {
+		return errors.New("mqtt: packet too large")
+	}
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func mqttString(b *bytes.Buffer, s string) {
+	b.WriteByte(byte(len(s) >> 8))
+	b.WriteByte(byte(len(s)))
+	b.WriteString(s)
+}
@@ -0,0 +1,386 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A JoinStatus is the state of an eagle's zigbee connection to its
+// meter, from NetworkInfo.Status
+type JoinStatus int
+
+const (
+	StatusUnknown JoinStatus = iota
+	StatusInitializing
+	StatusNetworkDiscovery
+	StatusJoining
+	StatusJoinFail
+	StatusJoinSuccess
+	StatusAuthenticating
+	StatusAuthenticationSuccess
+	StatusAuthenticationFail
+	StatusConnected
+	StatusDisconnected
+	StatusRejoining
+)
+
+// The Status strings the RAVEn and eagle send
+var joinStatusNames = []string{
+	StatusUnknown:               "Unknown",
+	StatusInitializing:          "Initializing",
+	StatusNetworkDiscovery:      "Network Discovery",
+	StatusJoining:               "Joining",
+	StatusJoinFail:              "Join: Fail",
+	StatusJoinSuccess:           "Join: Success",
+	StatusAuthenticating:        "Authenticating",
+	StatusAuthenticationSuccess: "Authenticating: Success",
+	StatusAuthenticationFail:    "Authenticating: Fail",
+	StatusConnected:             "Connected",
+	StatusDisconnected:          "Disconnected",
+	StatusRejoining:             "Rejoining",
+}
+
+// ParseJoinStatus returns the JoinStatus for a NetworkInfo.Status.
+// Case and spacing don't matter; anything else is StatusUnknown.
+func ParseJoinStatus(s string) JoinStatus {
+	s = strings.Join(strings.Fields(s), " ")
+	for i, name := range joinStatusNames {
+		if strings.EqualFold(s, name) {
+			return JoinStatus(i)
+		}
+	}
+	return StatusUnknown
+}
+
+func (s JoinStatus) String() string {
+	if s < 0 || int(s) >= len(joinStatusNames) {
+		return joinStatusNames[StatusUnknown]
+	}
+	return joinStatusNames[s]
+}
+
+// Joined reports whether the eagle can talk to the meter in this state
+func (s JoinStatus) Joined() bool {
+	return s == StatusConnected || s == StatusJoinSuccess || s == StatusAuthenticationSuccess
+}
+
+// JoinStatus returns the parsed Status
+func (n NetworkInfo) JoinStatus() JoinStatus {
+	return ParseJoinStatus(n.Status)
+}
+
+// LinkPercent returns LinkStrength as a percentage.  The eagle reports
+// it as 0x00 to 0x64.
+func (n NetworkInfo) LinkPercent() (int, bool) {
+	v := getval(n.LinkStrength)
+	if v < 0 {
+		return 0, false
+	}
+	if v > 100 {
+		v = 100
+	}
+	return v, true
+}
+
+// ChannelNumber returns the zigbee channel, 11 to 26, or -1
+func (n NetworkInfo) ChannelNumber() int {
+	return getval(n.Channel)
+}
+
+// The kinds of NetworkEvent
+const (
+	EventJoined         = "joined"
+	EventLeft           = "left"
+	EventChannelChanged = "channel changed"
+	EventDegraded       = "degraded"
+	EventRecovered      = "recovered"
+)
+
+// A NetworkEvent is a change in an eagle's connection to its meter
+type NetworkEvent struct {
+	DeviceMacId string    `json:"deviceMacId"`
+	Kind        string    `json:"kind"`
+	Time        time.Time `json:"time"`
+	From        string    `json:"from,omitempty"`
+	To          string    `json:"to,omitempty"`
+}
+
+// A NetworkReport summarizes an eagle's connection over the time it
+// has been watched
+type NetworkReport struct {
+	DeviceMacId    string        `json:"deviceMacId"`
+	CoordMacId     string        `json:"coordMacId,omitempty"`
+	Status         string        `json:"status"`
+	Channel        int           `json:"channel"`
+	LinkStrength   int           `json:"linkStrength"` // percent
+	FirstSeen      time.Time     `json:"firstSeen"`
+	LastSeen       time.Time     `json:"lastSeen"`
+	Observed       time.Duration `json:"observed"`
+	Connected      time.Duration `json:"connected"`
+	Uptime         float64       `json:"uptime"` // fraction of Observed
+	Joins          int           `json:"joins"`
+	Leaves         int           `json:"leaves"`
+	ChannelChanges int           `json:"channelChanges"`
+	Degraded       time.Duration `json:"degraded"` // time with a weak link
+	MinLink        int           `json:"minLink"`
+	MaxLink        int           `json:"maxLink"`
+	MeanLink       float64       `json:"meanLink"` // time weighted
+	Quality        string        `json:"quality"`
+}
+
+// The Quality of a NetworkReport
+const (
+	QualityGood = "good"
+	QualityFair = "fair"
+	QualityPoor = "poor"
+)
+
+// A NetworkMonitor watches NetworkInfo fragments and keeps track of
+// each eagle's join state, channel and link strength.  It is a Sink.
+type NetworkMonitor struct {
+	// WeakLink is the link strength percentage below which the link
+	// is degraded, 40 if zero
+	WeakLink int
+
+	// Events, if not nil, is called with each change as it is seen
+	Events func(NetworkEvent)
+
+	// Now returns the time of fragments that don't carry one, which
+	// NetworkInfo never does.  time.Now is used if nil.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	devices map[string]*networkState
+}
+
+type networkState struct {
+	last      NetworkInfo
+	status    JoinStatus
+	link      int
+	weak      bool // a degraded event hasn't been followed by recovery
+	first     time.Time
+	seen      time.Time
+	connected time.Duration
+	degraded  time.Duration
+	linkTime  float64 // sum of link percent * seconds
+	minLink   int
+	maxLink   int
+	joins     int
+	leaves    int
+	channels  int
+}
+
+// NewNetworkMonitor returns a monitor with no eagles
+func NewNetworkMonitor() *NetworkMonitor {
+	return &NetworkMonitor{devices: make(map[string]*networkState)}
+}
+
+func (n *NetworkMonitor) now() time.Time {
+	if n.Now != nil {
+		return n.Now()
+	}
+	return time.Now()
+}
+
+func (n *NetworkMonitor) weak() int {
+	if n.WeakLink > 0 {
+		return n.WeakLink
+	}
+	return 40
+}
+
+// Write records the NetworkInfo fragments in frags
+func (n *NetworkMonitor) Write(ctx context.Context, frags []Fragment) error {
+	for _, f := range frags {
+		if info, ok := f.Packet.(NetworkInfo); ok {
+			t := f.Time
+			if t.IsZero() {
+				t = n.now()
+			}
+			n.Update(info, t)
+		}
+	}
+	return nil
+}
+
+// Close does nothing
+func (n *NetworkMonitor) Close() error {
+	return nil
+}
+
+// Update records a NetworkInfo seen at t
+func (n *NetworkMonitor) Update(info NetworkInfo, t time.Time) {
+	var events []NetworkEvent
+	n.mu.Lock()
+	device := NormalizeMac(info.DeviceMacId)
+	status := info.JoinStatus()
+	link, hasLink := info.LinkPercent()
+	s := n.devices[device]
+	if s == nil {
+		s = &networkState{first: t, seen: t, minLink: 100, status: StatusUnknown}
+		n.devices[device] = s
+	} else if t.After(s.seen) {
+		s.account(t, n.weak())
+	} else if t.Before(s.seen) {
+		// Out of order; keep the newer state
+		n.mu.Unlock()
+		return
+	}
+	if !hasLink {
+		link = s.link
+	}
+	event := func(kind, from, to string) {
+		events = append(events, NetworkEvent{DeviceMacId: device, Kind: kind, Time: t, From: from, To: to})
+	}
+
+	if status != StatusUnknown && status.Joined() != s.status.Joined() {
+		if status.Joined() {
+			s.joins++
+			event(EventJoined, s.status.String(), status.String())
+		} else if s.status != StatusUnknown {
+			s.leaves++
+			event(EventLeft, s.status.String(), status.String())
+		}
+	}
+	if old := s.last.ChannelNumber(); old > 0 && info.ChannelNumber() > 0 && old != info.ChannelNumber() {
+		s.channels++
+		event(EventChannelChanged, s.last.Channel, info.Channel)
+	}
+	if hasLink && status.Joined() {
+		isWeak := link < n.weak()
+		if isWeak && !s.weak {
+			event(EventDegraded, "", info.LinkStrength)
+		} else if s.weak && !isWeak {
+			event(EventRecovered, "", info.LinkStrength)
+		}
+		s.weak = isWeak
+		if link < s.minLink {
+			s.minLink = link
+		}
+		if link > s.maxLink {
+			s.maxLink = link
+		}
+	}
+
+	if status != StatusUnknown {
+		s.status = status
+	}
+	s.link = link
+	s.last = info
+	n.mu.Unlock()
+
+	if n.Events != nil {
+		for _, e := range events {
+			n.Events(e)
+		}
+	}
+}
+
+// account adds the time since the last update to the totals, assuming
+// the state held until t
+func (s *networkState) account(t time.Time, weak int) {
+	d := t.Sub(s.seen)
+	if d <= 0 {
+		return
+	}
+	if s.status.Joined() {
+		s.connected += d
+		s.linkTime += float64(s.link) * d.Seconds()
+		if s.link < weak {
+			s.degraded += d
+		}
+	}
+	s.seen = t
+}
+
+// Devices returns the mac ids of the eagles seen so far, in order
+func (n *NetworkMonitor) Devices() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	result := make([]string, 0, len(n.devices))
+	for k := range n.devices {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Report returns an eagle's report, with the current state assumed to
+// have held until now
+func (n *NetworkMonitor) Report(device string, now time.Time) (NetworkReport, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s, ok := n.devices[NormalizeMac(device)]
+	if !ok {
+		return NetworkReport{}, false
+	}
+	c := *s
+	if now.After(c.seen) {
+		c.account(now, n.weak())
+	} else {
+		now = c.seen
+	}
+	r := NetworkReport{
+		DeviceMacId:    NormalizeMac(device),
+		CoordMacId:     NormalizeMac(c.last.CoordMacId),
+		Status:         c.status.String(),
+		Channel:        c.last.ChannelNumber(),
+		LinkStrength:   c.link,
+		FirstSeen:      c.first,
+		LastSeen:       s.seen,
+		Observed:       now.Sub(c.first),
+		Connected:      c.connected,
+		Joins:          c.joins,
+		Leaves:         c.leaves,
+		ChannelChanges: c.channels,
+		Degraded:       c.degraded,
+		MinLink:        c.minLink,
+		MaxLink:        c.maxLink,
+	}
+	if c.maxLink == 0 {
+		r.MinLink = 0
+	}
+	if r.Observed > 0 {
+		r.Uptime = float64(r.Connected) / float64(r.Observed)
+	} else if c.status.Joined() {
+		r.Uptime = 1
+	}
+	if c.connected > 0 {
+		r.MeanLink = c.linkTime / c.connected.Seconds()
+	} else {
+		r.MeanLink = float64(c.link)
+	}
+	r.Quality = networkQuality(r, n.weak())
+	return r, true
+}
+
+// Reports returns the report of every eagle, in order
+func (n *NetworkMonitor) Reports(now time.Time) []NetworkReport {
+	var result []NetworkReport
+	for _, d := range n.Devices() {
+		if r, ok := n.Report(d, now); ok {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// networkQuality grades a report: good if the eagle stayed joined with a
+// strong link, poor if it was often off the network or the link was
+// usually weak
+func networkQuality(r NetworkReport, weak int) string {
+	switch {
+	case r.Uptime < 0.9 || r.MeanLink < float64(weak):
+		return QualityPoor
+	case r.Uptime < 0.99 || r.Leaves > 0 || r.Degraded > r.Connected/10:
+		return QualityFair
+	}
+	return QualityGood
+}
@@ -0,0 +1,75 @@
+package rainforestCommon
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestJoinStatus(t *testing.T) {
+	for s, want := range map[string]JoinStatus{
+		"Connected":               StatusConnected,
+		"join:  fail":             StatusJoinFail,
+		"Authenticating: Success": StatusAuthenticationSuccess,
+		"Sleeping":                StatusUnknown,
+	} {
+		if got := ParseJoinStatus(s); got != want {
+			t.Error("Expected ", want, " for ", s, " got ", got)
+		}
+	}
+	if StatusRejoining.String() != "Rejoining" || StatusRejoining.Joined() {
+		t.Error("Expected Rejoining not to be joined")
+	}
+	n := NetworkInfo{LinkStrength: "0x64", Channel: "0x14"}
+	if p, ok := n.LinkPercent(); !ok || p != 100 || n.ChannelNumber() != 20 {
+		t.Error("Expected 100% on channel 20 got ", p, " ", n.ChannelNumber())
+	}
+}
+
+func TestNetworkMonitor(t *testing.T) {
+	info := func(status, channel, link string) NetworkInfo {
+		return NetworkInfo{
+			XMLName:      xml.Name{Local: "NetworkInfo"},
+			DeviceMacId:  "0xD8D5B9000000ABCD",
+			Status:       status,
+			Channel:      channel,
+			LinkStrength: link,
+		}
+	}
+	var events []NetworkEvent
+	n := NewNetworkMonitor()
+	n.Events = func(e NetworkEvent) { events = append(events, e) }
+
+	start := targetTimeU
+	n.Update(info("Connected", "0x14", "0x64"), start)
+	n.Update(info("Connected", "0x14", "0x1e"), start.Add(10*time.Minute))
+	n.Update(info("Disconnected", "0x14", "0x00"), start.Add(20*time.Minute))
+	n.Update(info("Connected", "0x0f", "0x50"), start.Add(30*time.Minute))
+
+	kinds := []string{EventJoined, EventDegraded, EventLeft, EventJoined, EventChannelChanged, EventRecovered}
+	if len(events) != len(kinds) {
+		t.Fatal("Expected ", kinds, " got ", events)
+	}
+	for i, k := range kinds {
+		if events[i].Kind != k {
+			t.Error("Expected ", k, " got ", events[i])
+		}
+	}
+
+	r, ok := n.Report("0xd8d5b9000000abcd", start.Add(40*time.Minute))
+	if !ok {
+		t.Fatal("Expected a report")
+	}
+	if r.Observed != 40*time.Minute || r.Connected != 30*time.Minute || r.Uptime != 0.75 {
+		t.Error("Expected 30 of 40 minutes connected got ", r.Connected, " of ", r.Observed)
+	}
+	if r.Joins != 2 || r.Leaves != 1 || r.ChannelChanges != 1 || r.Channel != 15 {
+		t.Error("Expected 2 joins, 1 leave and a move to channel 15 got ", r)
+	}
+	if r.Degraded != 10*time.Minute || r.MinLink != 30 || r.MaxLink != 100 || r.MeanLink != 70 {
+		t.Error("Expected 10 minutes degraded and a mean of 70% got ", r)
+	}
+	if r.Quality != QualityPoor {
+		t.Error("Expected poor quality got ", r.Quality)
+	}
+}
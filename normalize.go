@@ -0,0 +1,153 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// A NormalizedPeriod is a meter's use over a period, as it was and as
+// it would have been in normal weather.  The figures are per day, with
+// HDD and CDD the period's average degree days.
+type NormalizedPeriod struct {
+	Start     time.Time      `json:"start"`
+	End       time.Time      `json:"end"`
+	Days      int            `json:"days"`
+	KWh       float64        `json:"kWh"`
+	HDD       float64        `json:"hdd"`
+	CDD       float64        `json:"cdd"`
+	NormalKWh float64        `json:"normalKWh"`
+	Model     DegreeDayModel `json:"model"`
+}
+
+// A NormalizedComparison is the change in a meter's use from Before to
+// After with the weather taken out.  Change is in kWh a day, and
+// Uncertainty its 90% bound; a change bigger than that is Significant.
+type NormalizedComparison struct {
+	MeterMacId    string           `json:"meterMacId"`
+	Before        NormalizedPeriod `json:"before"`
+	After         NormalizedPeriod `json:"after"`
+	ActualChange  float64          `json:"actualChange"`
+	Change        float64          `json:"change"`
+	ChangePercent float64          `json:"changePercent"`
+	Uncertainty   float64          `json:"uncertainty"`
+	Significant   bool             `json:"significant"`
+}
+
+// A Normalizer compares a meter's use in two periods as if both had
+// had the same weather, to tell whether something like an efficiency
+// upgrade made a difference.  A degree day model is fitted to each
+// period's daily use from its summations, and both are asked what a
+// day of normal weather would use.
+type Normalizer struct {
+	// Weather has the daily temperatures of both periods, and
+	// BaseTemp is what degree days are counted from, 18 if zero
+	Weather  Weather
+	BaseTemp float64
+
+	// Normal is the weather of a typical day, such as long term daily
+	// means.  If nil the days of both periods together are used.
+	Normal Weather
+
+	// Location is where days start, UTC if nil
+	Location *time.Location
+}
+
+// Compare returns the comparison of before and after for each meter
+// with enough days in both, in mac id order.  Meters whose periods
+// can't be fitted are left out.
+func (n *Normalizer) Compare(frags []Fragment, before, after Span) []NormalizedComparison {
+	loc := n.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	base := n.BaseTemp
+	if base == 0 {
+		base = 18
+	}
+
+	var comparisons []NormalizedComparison
+	for meter, hours := range HourlyEnergy(frags) {
+		days := DailyEnergy(hours, loc)
+		b, errB := n.period(days, before, base, loc)
+		a, errA := n.period(days, after, base, loc)
+		if errB != nil || errA != nil {
+			continue
+		}
+
+		// Normal weather is the average degree days of the normal days
+		normal := n.Normal
+		if normal == nil {
+			normal = make(Weather)
+			for _, p := range []NormalizedPeriod{b, a} {
+				for d := p.Start; d.Before(p.End); d = d.AddDate(0, 0, 1) {
+					date := d.Format("2006-01-02")
+					if t, ok := n.Weather[date]; ok {
+						normal[date] = t
+					}
+				}
+			}
+		}
+		var hdd, cdd float64
+		for date := range normal {
+			h, c, _ := normal.DegreeDays(date, base)
+			hdd += h
+			cdd += c
+		}
+		if len(normal) > 0 {
+			hdd /= float64(len(normal))
+			cdd /= float64(len(normal))
+		}
+		b.NormalKWh = b.Model.Predict(hdd, cdd)
+		a.NormalKWh = a.Model.Predict(hdd, cdd)
+
+		c := NormalizedComparison{MeterMacId: meter, Before: b, After: a}
+		c.ActualChange = a.KWh - b.KWh
+		c.Change = a.NormalKWh - b.NormalKWh
+		if b.NormalKWh != 0 {
+			c.ChangePercent = 100 * c.Change / b.NormalKWh
+		}
+		// The standard error of each period's mean day
+		se := math.Sqrt(b.Model.Sigma*b.Model.Sigma/float64(b.Model.Days) + a.Model.Sigma*a.Model.Sigma/float64(a.Model.Days))
+		c.Uncertainty = 1.645 * se
+		c.Significant = math.Abs(c.Change) > c.Uncertainty
+		comparisons = append(comparisons, c)
+	}
+	sort.Slice(comparisons, func(i, j int) bool { return comparisons[i].MeterMacId < comparisons[j].MeterMacId })
+	return comparisons
+}
+
+// period fits a model to the days in span
+func (n *Normalizer) period(days []DailyUse, span Span, base float64, loc *time.Location) (NormalizedPeriod, error) {
+	p := NormalizedPeriod{Start: span.Start.In(loc), End: span.End.In(loc)}
+	var in []DailyUse
+	weathered := 0
+	for _, d := range days {
+		t, err := time.ParseInLocation("2006-01-02", d.Date, loc)
+		if err != nil || t.Before(span.Start) || !t.Before(span.End) {
+			continue
+		}
+		in = append(in, d)
+		p.KWh += d.KWh
+		if hdd, cdd, ok := n.Weather.DegreeDays(d.Date, base); ok {
+			p.HDD += hdd
+			p.CDD += cdd
+			weathered++
+		}
+	}
+	p.Days = len(in)
+	if p.Days > 0 {
+		p.KWh /= float64(p.Days)
+	}
+	if weathered > 0 {
+		p.HDD /= float64(weathered)
+		p.CDD /= float64(weathered)
+	}
+	var err error
+	p.Model, err = FitDegreeDays(in, n.Weather, base)
+	return p, err
+}
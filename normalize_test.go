@@ -0,0 +1,38 @@
+package rainforestCommon
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNormalizer(t *testing.T) {
+	// A colder January after an upgrade that cut the base load from 10
+	// to 8 kWh a day and heating from 2 to 1.5 kWh a degree day
+	first := time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+	second := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	w := make(Weather)
+	for d := 0; d < 31; d++ {
+		w[first.AddDate(0, 0, d).Format("2006-01-02")] = 10 - float64(d%7)
+		w[second.AddDate(0, 0, d).Format("2006-01-02")] = 4 - float64(d%7)
+	}
+	frags := append(hourlySummations(first, 31, w, 10, 2), hourlySummations(second, 31, w, 8, 1.5)...)
+
+	n := &Normalizer{Weather: w}
+	c := n.Compare(frags, Span{first, first.AddDate(0, 1, 0)}, Span{second, second.AddDate(0, 1, 0)})
+	if len(c) != 1 {
+		t.Fatal("Expected one comparison got ", c)
+	}
+	r := c[0]
+	if r.Before.Days != 31 || r.After.Days != 31 {
+		t.Fatal("Expected 31 days each got ", r.Before.Days, " ", r.After.Days)
+	}
+	if r.ActualChange <= 0 {
+		t.Error("Expected the cold to hide the saving got ", r.ActualChange)
+	}
+	// Normal weather is the average of the two Januaries
+	hdd := (r.Before.HDD + r.After.HDD) / 2
+	if math.Abs(r.Before.NormalKWh-(10+2*hdd)) > 1e-6 || math.Abs(r.Change+2+0.5*hdd) > 1e-6 || !r.Significant {
+		t.Error("Expected a saving of ", 2+0.5*hdd, " kWh a day got ", r.Before.NormalKWh, " ", r.Change)
+	}
+}
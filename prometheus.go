@@ -0,0 +1,129 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Prometheus keeps the latest readings from each meter and serves
+// them as prometheus gauges
+type Prometheus struct {
+	// Stats, if not nil, returns the BufferStats of sinks by name, to
+	// be served alongside the readings
+	Stats func() map[string]BufferStats
+
+	mu     sync.Mutex
+	gauges map[string]float64
+}
+
+// NewPrometheus returns an exporter with no readings
+func NewPrometheus() *Prometheus {
+	return &Prometheus{gauges: make(map[string]float64)}
+}
+
+// The help text for each metric we export
+var prometheusHelp = map[string]string{
+	"rainforest_demand_kw":                   "Instantaneous demand in kW.",
+	"rainforest_summation_delivered_kwh":     "Energy delivered to the premises in kWh.",
+	"rainforest_summation_received_kwh":      "Energy received from the premises in kWh.",
+	"rainforest_price":                       "Current price per kWh.",
+	"rainforest_price_tier":                  "Current price tier.",
+	"rainforest_link_strength":               "Zigbee link strength, 0 to 100.",
+	"rainforest_last_seen_timestamp_seconds": "Meter time of the newest fragment of each type.",
+	"rainforest_sink_queued":                 "Fragments waiting in a sink's memory queue.",
+	"rainforest_sink_spooled":                "Fragments waiting in a sink's disk spool.",
+	"rainforest_sink_sent_total":             "Fragments written to a sink.",
+	"rainforest_sink_dropped_total":          "Fragments a sink discarded.",
+	"rainforest_sink_quarantined_total":      "Spooled fragments a sink set aside because its spool couldn't be read.",
+	"rainforest_sink_retries_total":          "Failed writes to a sink that were retried.",
+}
+
+// Write records the readings in frags
+func (p *Prometheus) Write(ctx context.Context, frags []Fragment) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, f := range frags {
+		labels := fmt.Sprintf(`device="%s",meter="%s"`, NormalizeMac(f.DeviceMacId), NormalizeMac(f.MeterMacId))
+		if !f.Time.IsZero() {
+			p.gauges[fmt.Sprintf(`rainforest_last_seen_timestamp_seconds{%s,fragment="%s"}`, labels, f.Name)] = float64(f.Time.Unix())
+		}
+		switch v := f.Packet.(type) {
+		case InstantaneousDemand:
+			if kw, ok := f.Value(); ok {
+				p.gauges["rainforest_demand_kw{"+labels+"}"] = kw
+			}
+		case CurrentSummationDelivered:
+			if kwh, ok := f.Value(); ok {
+				p.gauges["rainforest_summation_delivered_kwh{"+labels+"}"] = kwh
+			}
+			if kwh, ok := scaled(v.SummationReceived, v.Multiplier, v.Divisor); ok {
+				p.gauges["rainforest_summation_received_kwh{"+labels+"}"] = kwh
+			}
+		case PriceCluster:
+			if price, ok := f.Value(); ok {
+				p.gauges["rainforest_price{"+labels+"}"] = price
+			}
+			p.gauges["rainforest_price_tier{"+labels+"}"] = float64(getval(v.Tier))
+		case NetworkInfo:
+			p.gauges["rainforest_link_strength{"+labels+"}"] = float64(getval(v.LinkStrength))
+		}
+	}
+	return nil
+}
+
+// Close does nothing; it is here so a Prometheus can be used as an
+// output
+func (p *Prometheus) Close() error {
+	return nil
+}
+
+// ServeHTTP writes the gauges in the prometheus text format
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metrics := make(map[string]float64)
+	p.mu.Lock()
+	for k, v := range p.gauges {
+		metrics[k] = v
+	}
+	p.mu.Unlock()
+	if p.Stats != nil {
+		for name, s := range p.Stats() {
+			label := fmt.Sprintf(`{sink="%s"}`, name)
+			metrics["rainforest_sink_queued"+label] = float64(s.Queued)
+			metrics["rainforest_sink_spooled"+label] = float64(s.Spooled)
+			metrics["rainforest_sink_sent_total"+label] = float64(s.Sent)
+			metrics["rainforest_sink_dropped_total"+label] = float64(s.Dropped)
+			metrics["rainforest_sink_retries_total"+label] = float64(s.Retries)
+			metrics["rainforest_sink_quarantined_total"+label] = float64(s.Quarantined)
+		}
+	}
+
+	keys := make([]string, 0, len(metrics))
+	for k := range metrics {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	last := ""
+	for _, k := range keys {
+		name := k[:strings.IndexByte(k, '{')]
+		if name != last {
+			kind := "gauge"
+			if strings.HasSuffix(name, "_total") {
+				kind = "counter"
+			}
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, prometheusHelp[name], name, kind)
+			last = name
+		}
+		fmt.Fprintf(&b, "%s %g\n", k, metrics[k])
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,319 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of QualityIssue
+const (
+	IssueDuplicate    = "duplicate"
+	IssueOutOfOrder   = "out_of_order"
+	IssueInvalidHex   = "invalid_hex"
+	IssueZeroDivisor  = "zero_divisor"
+	IssueDemandSpike  = "demand_spike"
+	IssueNotMonotonic = "not_monotonic"
+)
+
+// A QualityIssue is one suspect fragment
+type QualityIssue struct {
+	Kind  string    `json:"kind"`
+	Name  string    `json:"name"` // fragment type
+	Field string    `json:"field,omitempty"`
+	Time  time.Time `json:"time"`
+	Value string    `json:"value,omitempty"`
+}
+
+// A QualityStream describes the fragments of one type from a meter.
+// Interval is the expected time between them and Expected the number
+// there should have been from First to Last; Missing counts those that
+// fell in gaps.
+type QualityStream struct {
+	Name       string        `json:"name"`
+	Interval   time.Duration `json:"interval"`
+	First      time.Time     `json:"first"`
+	Last       time.Time     `json:"last"`
+	Expected   int           `json:"expected"`
+	Received   int           `json:"received"`
+	Missing    int           `json:"missing"`
+	Gaps       []Span        `json:"gaps,omitempty"`
+	Duplicates int           `json:"duplicates"`
+	OutOfOrder int           `json:"outOfOrder"`
+}
+
+// A QualityReport describes the fragments from one meter.  Fragments
+// with no meter mac id, like DeviceInfo, are reported under an empty
+// MeterMacId.
+type QualityReport struct {
+	MeterMacId   string          `json:"meterMacId"`
+	Expected     int             `json:"expected"`
+	Received     int             `json:"received"`
+	Missing      int             `json:"missing"`
+	Gaps         int             `json:"gaps"`
+	Duplicates   int             `json:"duplicates"`
+	OutOfOrder   int             `json:"outOfOrder"`
+	InvalidHex   int             `json:"invalidHex"`
+	ZeroDivisor  int             `json:"zeroDivisor"`
+	DemandSpikes int             `json:"demandSpikes"`
+	NotMonotonic int             `json:"notMonotonic"`
+	Streams      []QualityStream `json:"streams"`
+	Issues       []QualityIssue  `json:"issues,omitempty"`
+}
+
+// A QualityCheck reports on the fragments in a dataset before it is
+// trusted.  A fragment is a duplicate if an earlier one of the same
+// type from the same meter has the same time, and out of order if an
+// earlier one is later.  Fields that should be hex but aren't are
+// invalid, as is a Divisor of zero, which makes CalcVal return Inf.
+// Summations are checked to only rise; a wrap or reset shows up as a
+// decrease, which Counter can tell apart.
+type QualityCheck struct {
+	// Intervals is the expected time between fragments of each type.
+	// Types that aren't listed use the median time between their
+	// fragments.  Gaps are longer than twice the interval.
+	Intervals map[string]time.Duration
+
+	// MaxDemand is the largest plausible demand, in kW either way, 100
+	// if zero
+	MaxDemand float64
+}
+
+// qualityKey identifies a stream
+type qualityKey struct {
+	meter string
+	name  string
+}
+
+// Report returns a report for each meter in frags, in mac id order.
+// frags should be in the order they were received.
+func (q *QualityCheck) Report(frags []Fragment) []QualityReport {
+	reports := make(map[string]*QualityReport)
+	streams := make(map[qualityKey][]Fragment)
+	for _, f := range frags {
+		meter := NormalizeMac(f.MeterMacId)
+		r := reports[meter]
+		if r == nil {
+			r = &QualityReport{MeterMacId: meter}
+			reports[meter] = r
+		}
+		k := qualityKey{meter, f.Name}
+		streams[k] = append(streams[k], f)
+		q.checkFields(r, f)
+	}
+
+	keys := make([]qualityKey, 0, len(streams))
+	for k := range streams {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].meter != keys[j].meter {
+			return keys[i].meter < keys[j].meter
+		}
+		return keys[i].name < keys[j].name
+	})
+	summations := make(map[string][]Fragment)
+	for _, k := range keys {
+		r := reports[k.meter]
+		s := q.stream(r, k.name, streams[k])
+		r.Streams = append(r.Streams, s)
+		r.Expected += s.Expected
+		r.Received += s.Received
+		r.Missing += s.Missing
+		r.Gaps += len(s.Gaps)
+		r.Duplicates += s.Duplicates
+		r.OutOfOrder += s.OutOfOrder
+		for _, name := range summationNames {
+			if k.name == name {
+				summations[k.meter] = append(summations[k.meter], streams[k]...)
+			}
+		}
+	}
+	for meter, frags := range summations {
+		checkMonotonic(reports[meter], frags)
+	}
+
+	result := make([]QualityReport, 0, len(reports))
+	for _, r := range reports {
+		sort.SliceStable(r.Issues, func(i, j int) bool {
+			return r.Issues[i].Time.Before(r.Issues[j].Time)
+		})
+		result = append(result, *r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].MeterMacId < result[j].MeterMacId
+	})
+	return result
+}
+
+// stream checks the timing of one type of fragment from a meter, given
+// in the order received
+func (q *QualityCheck) stream(r *QualityReport, name string, frags []Fragment) QualityStream {
+	s := QualityStream{Name: name, Received: len(frags)}
+	seen := make(map[time.Time]bool)
+	var times []time.Time
+	var latest time.Time
+	for _, f := range frags {
+		if f.Time.IsZero() {
+			continue
+		}
+		t := f.Time.UTC()
+		switch {
+		case seen[t]:
+			s.Duplicates++
+			r.Issues = append(r.Issues, QualityIssue{Kind: IssueDuplicate, Name: name, Time: t})
+			continue
+		case t.Before(latest):
+			s.OutOfOrder++
+			r.Issues = append(r.Issues, QualityIssue{Kind: IssueOutOfOrder, Name: name, Time: t})
+		default:
+			latest = t
+		}
+		seen[t] = true
+		times = append(times, t)
+	}
+	if len(times) == 0 {
+		s.Expected = s.Received
+		return s
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	s.First, s.Last = times[0], times[len(times)-1]
+
+	s.Interval = q.Intervals[name]
+	if s.Interval <= 0 {
+		s.Interval = medianSpacing(times)
+	}
+	if s.Interval <= 0 {
+		s.Expected = len(times)
+		return s
+	}
+	s.Expected = int(s.Last.Sub(s.First)/s.Interval) + 1
+	if s.Missing = s.Expected - len(times); s.Missing < 0 {
+		s.Missing = 0
+	}
+	for i := 1; i < len(times); i++ {
+		if times[i].Sub(times[i-1]) > 2*s.Interval {
+			s.Gaps = append(s.Gaps, Span{times[i-1], times[i]})
+		}
+	}
+	return s
+}
+
+// medianSpacing returns the median time between sorted times
+func medianSpacing(times []time.Time) time.Duration {
+	if len(times) < 2 {
+		return 0
+	}
+	spacing := make([]time.Duration, len(times)-1)
+	for i := range spacing {
+		spacing[i] = times[i+1].Sub(times[i])
+	}
+	sort.Slice(spacing, func(i, j int) bool { return spacing[i] < spacing[j] })
+	return spacing[len(spacing)/2]
+}
+
+// checkFields looks for invalid hex, zero divisors and implausible
+// demand in one fragment
+func (q *QualityCheck) checkFields(r *QualityReport, f Fragment) {
+	if f.Packet == nil {
+		return
+	}
+	walkHex(reflect.ValueOf(f.Packet), func(packet, field, value string) {
+		issue := QualityIssue{Name: f.Name, Field: field, Time: f.Time, Value: value}
+		if packet != f.Name {
+			issue.Field = packet + "." + field
+		}
+		switch {
+		case !hexPattern.MatchString(value):
+			issue.Kind = IssueInvalidHex
+			r.InvalidHex++
+		case strings.HasSuffix(field, "Divisor") && isZeroHex(value):
+			issue.Kind = IssueZeroDivisor
+			r.ZeroDivisor++
+		default:
+			return
+		}
+		r.Issues = append(r.Issues, issue)
+	})
+
+	if p, ok := f.Packet.(InstantaneousDemand); ok {
+		max := q.MaxDemand
+		if max <= 0 {
+			max = 100
+		}
+		if kw, ok := demandKW(p); ok && math.Abs(kw) > max {
+			r.DemandSpikes++
+			r.Issues = append(r.Issues, QualityIssue{Kind: IssueDemandSpike, Name: f.Name, Field: "Demand",
+				Time: f.Time, Value: strconv.FormatFloat(kw, 'f', -1, 64)})
+		}
+	}
+}
+
+// walkHex calls fn with each non empty field of a packet that should be
+// hex, including those of packets in its lists
+func walkHex(v reflect.Value, fn func(packet, field, value string)) {
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		switch field.Type.Kind() {
+		case reflect.String:
+			s := v.Field(i).String()
+			if s != "" && hexWidth(t.Name(), field.Name) > 0 {
+				fn(t.Name(), field.Name, s)
+			}
+		case reflect.Slice:
+			for j := 0; j < v.Field(i).Len(); j++ {
+				walkHex(v.Field(i).Index(j), fn)
+			}
+		}
+	}
+}
+
+// isZeroHex reports whether a valid hex value is zero
+func isZeroHex(s string) bool {
+	return strings.Trim(s[2:], "0") == ""
+}
+
+// demandKW returns a demand in kW as Fragment.Value reads it, or false
+// if it can't be read or its divisor is zero
+func demandKW(p InstantaneousDemand) (float64, bool) {
+	kw, ok := Fragment{Packet: p}.Value()
+	if !ok || math.IsInf(kw, 0) || math.IsNaN(kw) {
+		return 0, false
+	}
+	return kw, true
+}
+
+// checkMonotonic flags each summation lower than the one before it
+func checkMonotonic(r *QualityReport, frags []Fragment) {
+	var timed []Fragment
+	for _, f := range frags {
+		if !f.Time.IsZero() {
+			timed = append(timed, f)
+		}
+	}
+	sort.SliceStable(timed, func(i, j int) bool { return timed[i].Time.Before(timed[j].Time) })
+	last, started := 0.0, false
+	for _, f := range timed {
+		kwh, _, ok := summation(f)
+		if !ok {
+			continue
+		}
+		if started && kwh < last {
+			r.NotMonotonic++
+			r.Issues = append(r.Issues, QualityIssue{Kind: IssueNotMonotonic, Name: f.Name, Field: "SummationDelivered",
+				Time: f.Time, Value: strconv.FormatFloat(kwh, 'f', -1, 64)})
+		}
+		last, started = kwh, true
+	}
+}
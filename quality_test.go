@@ -0,0 +1,73 @@
+package rainforestCommon
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestQualityCheck(t *testing.T) {
+	var frags []Fragment
+	sum := func(i int) {
+		f, _ := NewFragment(summationAt(targetTimeU.Add(time.Duration(i) * 15 * time.Minute)))
+		frags = append(frags, f)
+	}
+	// Two hours of summations with the fourth missing, the seventh
+	// arriving late and the fifth sent twice
+	for _, i := range []int{0, 1, 2, 4, 4, 5, 7, 6} {
+		sum(i)
+	}
+	// A summation that goes backwards
+	low := summationAt(targetTimeU.Add(2 * time.Hour))
+	low.SummationDelivered = "0x0000000000000001"
+	f, _ := NewFragment(low)
+	frags = append(frags, f)
+
+	demand := func(d, divisor string) {
+		stamp, _ := EncodeMeterTime(targetTimeU)
+		f, _ := NewFragment(InstantaneousDemand{
+			XMLName:    xml.Name{Local: "InstantaneousDemand"},
+			MeterMacId: "0x02",
+			TimeStamp:  stamp,
+			Demand:     d,
+			Multiplier: "0x00000001",
+			Divisor:    divisor,
+		})
+		frags = append(frags, f)
+	}
+	demand("0x000bb8", "0x000003e8") // 3 kW
+	demand("0xfff448", "0x000003e8") // -3 kW, exporting
+	demand("0x0249f0", "0x000003e8") // 150 kW
+	demand("0x0003e8", "0x00000000") // no divisor
+	demand("12ab", "0x000003e8")     // not hex
+
+	q := &QualityCheck{Intervals: map[string]time.Duration{"InstantaneousDemand": time.Second}}
+	reports := q.Report(frags)
+	if len(reports) != 2 {
+		t.Fatal("Expected two meters got ", reports)
+	}
+
+	r := reports[0]
+	if r.MeterMacId != "0x01" || len(r.Streams) != 1 {
+		t.Fatal("Expected one summation stream got ", r)
+	}
+	s := r.Streams[0]
+	if s.Interval != 15*time.Minute || s.Expected != 9 || s.Received != 9 || s.Missing != 1 {
+		t.Error("Expected 9 summations with one missing got ", s)
+	}
+	if len(s.Gaps) != 0 || s.Duplicates != 1 || s.OutOfOrder != 1 {
+		t.Error("Expected a duplicate and one out of order got ", s)
+	}
+	if r.NotMonotonic != 1 {
+		t.Error("Expected a decrease got ", r.Issues)
+	}
+
+	r = reports[1]
+	if r.DemandSpikes != 1 || r.ZeroDivisor != 1 || r.InvalidHex != 1 {
+		t.Error("Expected a spike, a zero divisor and invalid hex got ", r.Issues)
+	}
+	// All five demands share a time
+	if r.Duplicates != 4 {
+		t.Error("Expected 4 duplicates got ", r.Duplicates)
+	}
+}
@@ -55,3 +55,60 @@ func TestMain(m *testing.M) {
 
 	os.Exit(m.Run())
 }
+
+func TestMeterTimeRoundTrip(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("No zoneinfo: ", err)
+	}
+	times := []time.Time{
+		MeterEpoch,
+		// Either side of the spring forward and fall back in Los Angeles
+		time.Date(2015, time.March, 8, 1, 59, 59, 0, la),
+		time.Date(2015, time.March, 8, 3, 0, 0, 0, la),
+		time.Date(2015, time.November, 1, 1, 30, 0, 0, la),
+		time.Date(2015, time.November, 1, 1, 30, 0, 0, la).Add(time.Hour),
+		// Past the 32 bit unix clock, and past 2^31 meter seconds
+		time.Date(2038, time.January, 19, 3, 14, 8, 0, time.UTC),
+		time.Date(2040, time.June, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2070, time.June, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2136, time.February, 7, 6, 28, 15, 0, time.UTC),
+	}
+	for _, want := range times {
+		s, err := EncodeMeterTime(want)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		got, err := DecodeMeterTime(s)
+		if err != nil || !got.Equal(want) || got.Location() != time.UTC {
+			t.Error("Expected ", want, " from ", s, " got ", got, " ", err)
+		}
+		local, err := DecodeMeterTimeIn(s, "America/Los_Angeles")
+		if err != nil || !local.Equal(want) || local.Location().String() != "America/Los_Angeles" {
+			t.Error("Expected ", want.In(la), " from ", s, " got ", local, " ", err)
+		}
+		if u, err := UnixTime(s); err != nil || !u.Equal(want) {
+			t.Error("Expected UnixTime ", want, " from ", s, " got ", u, " ", err)
+		}
+	}
+
+	// The hour that repeats in the fall is two different timestamps
+	a, _ := EncodeMeterTime(times[3])
+	b, _ := EncodeMeterTime(times[4])
+	if a == b {
+		t.Error("Expected distinct timestamps for the repeated hour got ", a)
+	}
+	if local, _ := DecodeMeterTimeIn(b, "America/Los_Angeles"); local.Hour() != 1 {
+		t.Error("Expected the second 1:30 got ", local)
+	}
+
+	for _, bad := range []time.Time{MeterEpoch.Add(-time.Second), time.Date(2136, time.February, 7, 6, 28, 16, 0, time.UTC)} {
+		if s, err := EncodeMeterTime(bad); err == nil {
+			t.Error("Expected an error for ", bad, " got ", s)
+		}
+	}
+	if _, err := DecodeMeterTimeIn("0x00000000", "Nowhere/Special"); err == nil {
+		t.Error("Expected an error for an unknown location")
+	}
+}
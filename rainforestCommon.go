@@ -6,11 +6,17 @@ package rainforestCommon
 
 import (
 	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 	"time"
 )
 
+// MeterEpoch is the start of the utility meter's clock.  Meter
+// timestamps are unsigned 32 bit counts of seconds from it, so they
+// run until 2136.
+var MeterEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
 // The difference in seconds between the unix epoch
 // and the meter epoch
 var offset int64 = findOffset()
@@ -24,9 +30,7 @@ func init() {
 }
 
 func findOffset() int64 {
-	unix := time.Unix(0, 0)
-	meter, _ := time.Parse("2006-Jan-02", "2000-Jan-01")
-	return int64(meter.Sub(unix).Seconds())
+	return MeterEpoch.Unix()
 }
 
 func getOffset() int64 {
@@ -40,18 +44,58 @@ func MeterTime(t time.Time) time.Time {
 }
 
 // UnixTime converts the hex string in an XML file to time in seconds
-// since the Unix Epoch (Jan 1, 1970)
+// since the Unix Epoch (Jan 1, 1970).  The result is in the host's
+// local zone; DecodeMeterTime and DecodeMeterTimeIn say which zone
+// they return.
 func UnixTime(s string) (time.Time, error) {
-	if hexPattern.MatchString(s) {
-		intVal, err := strconv.ParseInt(s[2:len(s)], 16, 32)
-		if err != nil {
-			return time.Unix(0, 0), err
-		}
-		intVal += offset
-		return time.Unix(int64(intVal), 0), nil
-	} else {
-		return time.Unix(0, 0), fmt.Errorf("Invalid hex value %s", s)
+	secs, err := meterSeconds(s)
+	if err != nil {
+		return time.Unix(0, 0), err
+	}
+	return time.Unix(int64(secs)+offset, 0), nil
+}
+
+// meterSeconds parses a meter timestamp
+func meterSeconds(s string) (uint64, error) {
+	if !hexPattern.MatchString(s) {
+		return 0, fmt.Errorf("Invalid hex value %s", s)
+	}
+	return strconv.ParseUint(s[2:], 16, 32)
+}
+
+// DecodeMeterTime converts a meter timestamp, e.g. 0x1C96BB5D, to UTC
+func DecodeMeterTime(s string) (time.Time, error) {
+	secs, err := meterSeconds(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return MeterEpoch.Add(time.Duration(secs) * time.Second), nil
+}
+
+// DecodeMeterTimeIn converts a meter timestamp to a time in the named
+// IANA location, e.g. America/Los_Angeles.  "" is UTC and "Local" is
+// the host's zone, as for time.LoadLocation.
+func DecodeMeterTimeIn(s, location string) (time.Time, error) {
+	loc, err := time.LoadLocation(location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := DecodeMeterTime(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.In(loc), nil
+}
+
+// EncodeMeterTime converts a time to a meter timestamp.  Fractions of a
+// second are dropped.  Times the meter can't represent, before 2000 or
+// after early 2136, are an error.
+func EncodeMeterTime(t time.Time) (string, error) {
+	secs := t.Unix() - MeterEpoch.Unix()
+	if secs < 0 || secs > math.MaxUint32 {
+		return "", fmt.Errorf("%s is outside the meter's clock", t.UTC().Format(time.RFC3339))
 	}
+	return fmt.Sprintf("0x%08x", secs), nil
 }
 
 // Hex2Float converts the hex value from an XML file to floating point
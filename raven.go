@@ -0,0 +1,65 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+	"sync"
+)
+
+// A Raven is a RAVEn usb stick, which writes fragments to a serial
+// port as they arrive from the meter
+type Raven struct {
+	*os.File
+
+	mu sync.Mutex // serializes commands
+}
+
+// OpenRaven opens the serial port the RAVEn is attached to, e.g.
+// /dev/ttyUSB0.  The RAVEn runs at 115200 baud, 8N1; the port settings
+// are left as the system has them, so set them with stty if needed.
+func OpenRaven(path string) (*Raven, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Raven{File: f}, nil
+}
+
+// The command format of the RAVEn xml api
+type ravenCommand struct {
+	XMLName    xml.Name `xml:"Command"`
+	Name       string
+	MeterMacId string `xml:",omitempty"`
+	Id         string `xml:",omitempty"`
+	StartTime  string `xml:",omitempty"`
+	EndTime    string `xml:",omitempty"`
+	Frequency  string `xml:",omitempty"`
+	Duration   string `xml:",omitempty"`
+}
+
+// Command writes a command to the RAVEn.  The RAVEn replies on the
+// same stream it sends readings on, so the reply is not returned here;
+// it arrives with the other fragments read from the port.
+func (r *Raven) Command(ctx context.Context, cmd LocalCommand) ([]Fragment, error) {
+	data, err := xml.Marshal(ravenCommand{
+		Name:       cmd.Name,
+		MeterMacId: cmd.MacId,
+		Id:         cmd.Id,
+		StartTime:  cmd.StartTime,
+		EndTime:    cmd.EndTime,
+		Frequency:  cmd.Frequency,
+		Duration:   cmd.Duration,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.Write(append(data, '\n'))
+	return nil, err
+}
@@ -0,0 +1,309 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A MeterState is the newest of each kind of status fragment from one
+// meter.  Fragments that haven't been seen are zero, with an empty
+// XMLName, just as in Root.  Net and Device come from the eagle the
+// meter is joined to, as those fragments don't name a meter.
+type MeterState struct {
+	MeterMacId  string
+	DeviceMacId string
+	Demand      InstantaneousDemand
+	Price       PriceCluster
+	Net         NetworkInfo
+	Meter       MeterInfo
+	Device      DeviceInfo
+	Time        TimeCluster
+	Updated     time.Time // host time of the last change
+}
+
+// DemandKW returns the current demand in kW, negative when power is
+// exported
+func (m MeterState) DemandKW() (float64, bool) {
+	if m.Demand.XMLName.Local == "" {
+		return 0, false
+	}
+	return Fragment{Packet: m.Demand}.Value()
+}
+
+// CurrentPrice returns the current price per kWh and its tier
+func (m MeterState) CurrentPrice() (price float64, tier int, ok bool) {
+	if m.Price.XMLName.Local == "" {
+		return 0, 0, false
+	}
+	price, ok = Fragment{Packet: m.Price}.Value()
+	return price, getval(m.Price.Tier), ok
+}
+
+// A Change describes an update to a MeterState
+type Change struct {
+	MeterMacId string
+	Name       string   // the fragment that caused the change
+	Fields     []string // what changed, e.g. "Price.Tier"
+	State      MeterState
+}
+
+// A ChangeFilter picks the changes a subscriber wants.  Fields are
+// either a whole fragment, e.g. "Net", or one of its fields, e.g.
+// "Net.Status".  Empty lists match everything.
+type ChangeFilter struct {
+	Meters []string
+	Fields []string
+}
+
+func (f ChangeFilter) match(c Change) bool {
+	if len(f.Meters) > 0 {
+		found := false
+		for _, m := range f.Meters {
+			if SameMac(m, c.MeterMacId) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Fields) == 0 {
+		return true
+	}
+	for _, want := range f.Fields {
+		for _, changed := range c.Fields {
+			if changed == want || strings.HasPrefix(changed, want+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A Subscription receives changes on C.  Changes are never waited
+// for: if C is full the change is dropped and counted in Dropped.
+type Subscription struct {
+	C <-chan Change
+
+	c       chan Change
+	filter  ChangeFilter
+	dropped uint64
+}
+
+// Dropped returns how many changes didn't fit in C
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// A Registry keeps the latest state of each meter.  It is safe for
+// concurrent use, and is a Sink so it can be fed by rainforestd or a
+// BufferedSink.
+type Registry struct {
+	mu      sync.Mutex
+	meters  map[string]*MeterState
+	devices map[string]*MeterState // Net and Device by eagle
+	subs    map[*Subscription]bool
+	closed  bool
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		meters:  make(map[string]*MeterState),
+		devices: make(map[string]*MeterState),
+		subs:    make(map[*Subscription]bool),
+	}
+}
+
+// Write updates the registry from frags
+func (r *Registry) Write(ctx context.Context, frags []Fragment) error {
+	for _, f := range frags {
+		r.Update(f)
+	}
+	return nil
+}
+
+// Close closes every subscription
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	for s := range r.subs {
+		close(s.c)
+	}
+	r.subs = nil
+	return nil
+}
+
+// Update records a fragment.  Fragment types the registry doesn't keep
+// are ignored.
+func (r *Registry) Update(f Fragment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	now := time.Now()
+	device := NormalizeMac(f.DeviceMacId)
+
+	switch p := f.Packet.(type) {
+	case NetworkInfo, DeviceInfo:
+		// These belong to the eagle; pass them on to its meters
+		d := r.devices[device]
+		if d == nil {
+			d = &MeterState{DeviceMacId: device}
+			r.devices[device] = d
+		}
+		field := "Net"
+		if _, ok := p.(DeviceInfo); ok {
+			field = "Device"
+		}
+		if len(set(d, field, p)) == 0 {
+			return
+		}
+		for _, m := range r.meters {
+			if m.DeviceMacId == device {
+				if changed := set(m, field, p); len(changed) > 0 {
+					m.Updated = now
+					r.notify(f.Name, m, changed)
+				}
+			}
+		}
+		return
+	}
+
+	field := ""
+	switch f.Packet.(type) {
+	case InstantaneousDemand:
+		field = "Demand"
+	case PriceCluster:
+		field = "Price"
+	case MeterInfo:
+		field = "Meter"
+	case TimeCluster:
+		field = "Time"
+	default:
+		return
+	}
+	meter := NormalizeMac(f.MeterMacId)
+	if meter == "" {
+		return
+	}
+	m := r.meters[meter]
+	var changed []string
+	if m == nil {
+		m = &MeterState{MeterMacId: meter}
+		r.meters[meter] = m
+	}
+	if device != "" && m.DeviceMacId != device {
+		m.DeviceMacId = device
+		if d := r.devices[device]; d != nil {
+			changed = append(changed, set(m, "Net", d.Net)...)
+			changed = append(changed, set(m, "Device", d.Device)...)
+		}
+	}
+	changed = append(changed, set(m, field, f.Packet)...)
+	if len(changed) > 0 {
+		m.Updated = now
+		r.notify(f.Name, m, changed)
+	}
+}
+
+// set stores a packet in the named field of m and returns the paths of
+// the fields that changed
+func set(m *MeterState, field string, packet interface{}) []string {
+	dst := reflect.ValueOf(m).Elem().FieldByName(field)
+	src := reflect.ValueOf(packet)
+	var changed []string
+	if dst.FieldByName("XMLName").Interface() != src.FieldByName("XMLName").Interface() {
+		changed = append(changed, field)
+	}
+	for i := 0; i < src.NumField(); i++ {
+		name := src.Type().Field(i).Name
+		if name == "XMLName" {
+			continue
+		}
+		if dst.Field(i).Interface() != src.Field(i).Interface() {
+			changed = append(changed, field+"."+name)
+		}
+	}
+	dst.Set(src)
+	return changed
+}
+
+// notify sends a change to the interested subscribers; r.mu must be held
+func (r *Registry) notify(name string, m *MeterState, fields []string) {
+	c := Change{MeterMacId: m.MeterMacId, Name: name, Fields: fields, State: *m}
+	for s := range r.subs {
+		if !s.filter.match(c) {
+			continue
+		}
+		select {
+		case s.c <- c:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Get returns the state of a meter
+func (r *Registry) Get(meter string) (MeterState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.meters[NormalizeMac(meter)]
+	if !ok {
+		return MeterState{}, false
+	}
+	return *m, true
+}
+
+// Meters returns the mac ids of the meters seen so far, in order
+func (r *Registry) Meters() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]string, 0, len(r.meters))
+	for k := range r.meters {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Subscribe returns a subscription to the changes that pass filter,
+// with room for buffer changes.  The channel is closed by Unsubscribe
+// or Close.
+func (r *Registry) Subscribe(filter ChangeFilter, buffer int) *Subscription {
+	c := make(chan Change, buffer)
+	s := &Subscription{C: c, c: c, filter: filter}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		close(c)
+	} else {
+		r.subs[s] = true
+	}
+	return s
+}
+
+// Unsubscribe stops and closes a subscription
+func (r *Registry) Unsubscribe(s *Subscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subs[s] {
+		delete(r.subs, s)
+		close(s.c)
+	}
+}
@@ -0,0 +1,72 @@
+package rainforestCommon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	all := r.Subscribe(ChangeFilter{}, 10)
+	tiers := r.Subscribe(ChangeFilter{Fields: []string{"Price.Tier"}}, 10)
+	status := r.Subscribe(ChangeFilter{Meters: []string{"0x00135001000056AB"}, Fields: []string{"Net.Status"}}, 10)
+
+	// NetworkInfo arrives before the eagle's meter is known
+	frags, _ := DecodeAll(strings.NewReader(ravenStream + uploaderPost))
+	for _, f := range frags {
+		r.Update(f)
+	}
+
+	m, ok := r.Get("0x00135001000056ab")
+	if !ok {
+		t.Fatal("Expected the meter to be registered")
+	}
+	if kw, _ := m.DemandKW(); kw != 1.069 {
+		t.Error("Expected 1.069 kW got ", kw)
+	}
+	if price, tier, _ := m.CurrentPrice(); price != 0.14 || tier != 1 {
+		t.Error("Expected 0.14 at tier 1 got ", price, " ", tier)
+	}
+	if m.Net.Status != "Connected" {
+		t.Error("Expected the eagle's network status got ", m.Net.Status)
+	}
+	if len(all.C) != 2 || len(tiers.C) != 1 || len(status.C) != 1 {
+		t.Error("Expected 2, 1 and 1 changes got ", len(all.C), " ", len(tiers.C), " ", len(status.C))
+	}
+
+	// Exported power reads as negative demand
+	export := NewRegistry()
+	d := frags[len(frags)-1]
+	demand := d.Packet.(InstantaneousDemand)
+	demand.Demand = "0xfffbd3"
+	d.Packet = demand
+	export.Update(d)
+	m, _ = export.Get(d.MeterMacId)
+	if kw, ok := m.DemandKW(); !ok || kw != -1.069 {
+		t.Error("Expected -1.069 kW got ", kw)
+	}
+	export.Close()
+
+	// The same price again isn't a change
+	r.Update(frags[1])
+	if len(all.C) != 2 {
+		t.Error("Expected no change from a repeated price")
+	}
+
+	net := frags[0]
+	p := net.Packet.(NetworkInfo)
+	p.Status = "Disconnected"
+	net.Packet = p
+	r.Update(net)
+	<-status.C
+	c := <-status.C
+	if c.State.Net.Status != "Disconnected" || c.Name != "NetworkInfo" {
+		t.Error("Expected a disconnect got ", c)
+	}
+
+	r.Unsubscribe(tiers)
+	r.Close()
+	if _, ok := <-all.C; !ok {
+		t.Error("Expected buffered changes to survive Close")
+	}
+}
@@ -0,0 +1,564 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Sink consumes fragments, e.g. by storing them or passing them on
+// to another system.  Prometheus, Influx, MQTT, FileStore and Webhook
+// are Sinks.
+type Sink interface {
+	Write(ctx context.Context, frags []Fragment) error
+	Close() error
+}
+
+// ErrClosed is returned by writes to a closed BufferedSink
+var ErrClosed = errors.New("Sink is closed")
+
+// A Policy says what a BufferedSink does when its queue is full
+type Policy int
+
+const (
+	// DropOldest discards the oldest queued fragments to make room
+	DropOldest Policy = iota
+	// Block makes Write wait for room
+	Block
+)
+
+// BufferOptions configure a BufferedSink.  Zero values get the
+// defaults shown.
+type BufferOptions struct {
+	QueueSize  int           // fragments held in memory, 1000
+	BatchSize  int           // most fragments per write to the sink, 100
+	BatchDelay time.Duration // how long to wait for a batch to fill, 0
+	Policy     Policy        // what to do when the queue is full
+
+	// SpoolDir, if set, is a directory only this sink uses.  Fragments
+	// that don't fit in the queue, that can't be delivered or that are
+	// still queued when the sink is closed are kept there and sent
+	// later, even after a restart.  The Policy only applies when the
+	// spool can't be written.
+	SpoolDir string
+
+	MinBackoff   time.Duration // first wait after a failed write, 1s
+	MaxBackoff   time.Duration // longest wait between retries, 5m
+	MaxRetries   int           // retries before giving up on a batch, 0 for no limit
+	CloseTimeout time.Duration // how long Close keeps trying to deliver, 10s
+
+	// Errors, if not nil, is called with every failed write
+	Errors func(error)
+}
+
+// BufferStats count what a BufferedSink has done with its fragments
+type BufferStats struct {
+	Queued  int    // fragments waiting in memory
+	Spooled int    // fragments waiting on disk
+	Sent    uint64 // fragments written to the sink
+	Dropped uint64 // fragments discarded
+	Retries uint64 // failed writes that were retried
+
+	// Quarantined counts spooled fragments set aside, in a file beside
+	// the spool, because the spool couldn't be read
+	Quarantined uint64
+}
+
+// A BufferedSink queues fragments for another sink, so that a slow or
+// unreachable downstream doesn't hold up the caller.  Fragments are
+// written in batches and failed writes are retried with exponential
+// backoff.
+type BufferedSink struct {
+	sink Sink
+	opts BufferOptions
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	queue  []Fragment
+	spool  *spool
+	closed bool
+	stats  BufferStats
+	wake   chan struct{} // wakes the worker
+	space  chan struct{} // closed when room is made in the queue
+	stop   chan struct{} // closed by Close
+	done   chan struct{} // closed when the worker exits
+}
+
+// NewBufferedSink starts a BufferedSink in front of sink
+func NewBufferedSink(sink Sink, opts BufferOptions) (*BufferedSink, error) {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1000
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Minute
+	}
+	if opts.CloseTimeout <= 0 {
+		opts.CloseTimeout = 10 * time.Second
+	}
+	b := &BufferedSink{
+		sink:  sink,
+		opts:  opts,
+		wake:  make(chan struct{}, 1),
+		space: make(chan struct{}),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if opts.SpoolDir != "" {
+		s, err := openSpool(filepath.Join(opts.SpoolDir, "spool.json"))
+		if err != nil {
+			return nil, err
+		}
+		b.spool = s
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	go b.run()
+	return b, nil
+}
+
+// Write queues frags.  It only waits if the queue is full and the
+// policy is Block.
+func (b *BufferedSink) Write(ctx context.Context, frags []Fragment) error {
+	for len(frags) > 0 {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return ErrClosed
+		}
+		// Once anything is spooled, new fragments go behind it
+		if b.spool != nil && (b.spool.count > 0 || len(b.queue) >= b.opts.QueueSize) {
+			err := b.spool.append(frags)
+			if err == nil {
+				b.stats.Spooled = b.spool.count
+				b.signal()
+				b.mu.Unlock()
+				return nil
+			}
+			b.report(err)
+		}
+		if room := b.opts.QueueSize - len(b.queue); room > 0 {
+			n := len(frags)
+			if n > room {
+				n = room
+			}
+			b.queue = append(b.queue, frags[:n]...)
+			frags = frags[n:]
+			b.stats.Queued = len(b.queue)
+			b.signal()
+			b.mu.Unlock()
+			continue
+		}
+		if b.opts.Policy == DropOldest {
+			n := len(frags)
+			if n > len(b.queue) {
+				n = len(b.queue)
+			}
+			b.queue = append(b.queue[:0], b.queue[n:]...)
+			b.stats.Dropped += uint64(n)
+			b.mu.Unlock()
+			continue
+		}
+		space := b.space
+		b.mu.Unlock()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the sink's counters
+func (b *BufferedSink) Stats() BufferStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// Close stops accepting fragments and tries for up to CloseTimeout to
+// deliver what is queued.  Anything left is spooled if there is a
+// spool, and dropped otherwise.  The underlying sink is then closed.
+func (b *BufferedSink) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.stop)
+	close(b.space)
+	b.mu.Unlock()
+
+	timer := time.AfterFunc(b.opts.CloseTimeout, b.cancel)
+	<-b.done
+	timer.Stop()
+	b.cancel()
+	return b.sink.Close()
+}
+
+// signal wakes the worker; b.mu must be held
+func (b *BufferedSink) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// report passes err to the Errors callback
+func (b *BufferedSink) report(err error) {
+	if b.opts.Errors != nil {
+		b.opts.Errors(err)
+	}
+}
+
+func (b *BufferedSink) run() {
+	defer close(b.done)
+	for {
+		batch := b.next()
+		if batch == nil {
+			return
+		}
+		b.send(batch)
+	}
+}
+
+// next waits for a batch to send.  It returns nil once the sink is
+// closed and the queue is empty.
+func (b *BufferedSink) next() []Fragment {
+	var timer <-chan time.Time
+	expired := false
+	for {
+		b.mu.Lock()
+		if len(b.queue) == 0 && !b.closed && b.spool != nil && b.spool.count > 0 {
+			frags, err := b.spool.take(b.opts.QueueSize)
+			if err != nil {
+				b.report(err)
+			}
+			if err != nil && len(frags) == 0 {
+				// Move the spool aside rather than retry it forever
+				lost, err := b.spool.quarantine()
+				if err != nil {
+					b.report(err)
+				}
+				b.stats.Quarantined += uint64(lost)
+			}
+			b.queue = append(b.queue, frags...)
+			b.stats.Spooled = b.spool.count
+			b.stats.Queued = len(b.queue)
+		}
+		n := len(b.queue)
+		if n >= b.opts.BatchSize || (n > 0 && (expired || b.closed || b.opts.BatchDelay <= 0)) {
+			if n > b.opts.BatchSize {
+				n = b.opts.BatchSize
+			}
+			batch := make([]Fragment, n)
+			copy(batch, b.queue)
+			b.queue = append(b.queue[:0], b.queue[n:]...)
+			b.stats.Queued = len(b.queue)
+			if !b.closed {
+				close(b.space)
+				b.space = make(chan struct{})
+			}
+			b.mu.Unlock()
+			return batch
+		}
+		if n == 0 && b.closed {
+			b.mu.Unlock()
+			return nil
+		}
+		b.mu.Unlock()
+
+		if n > 0 && timer == nil {
+			timer = time.After(b.opts.BatchDelay)
+		}
+		select {
+		case <-b.wake:
+		case <-timer:
+			expired = true
+		case <-b.stop:
+		}
+	}
+}
+
+// send writes a batch to the sink, retrying until it succeeds, the
+// retries run out or Close gives up
+func (b *BufferedSink) send(batch []Fragment) {
+	backoff := b.opts.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err := b.sink.Write(b.ctx, batch)
+		if err == nil {
+			b.mu.Lock()
+			b.stats.Sent += uint64(len(batch))
+			b.mu.Unlock()
+			return
+		}
+		b.report(err)
+		if b.ctx.Err() != nil || (b.opts.MaxRetries > 0 && attempt >= b.opts.MaxRetries) {
+			b.giveUp(batch)
+			return
+		}
+		b.mu.Lock()
+		b.stats.Retries++
+		b.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-b.ctx.Done():
+		}
+		backoff *= 2
+		if backoff > b.opts.MaxBackoff {
+			backoff = b.opts.MaxBackoff
+		}
+	}
+}
+
+// giveUp spools a batch that couldn't be delivered, or drops it
+func (b *BufferedSink) giveUp(batch []Fragment) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.spool != nil {
+		err := b.spool.append(batch)
+		if err == nil {
+			b.stats.Spooled = b.spool.count
+			return
+		}
+		b.report(err)
+	}
+	b.stats.Dropped += uint64(len(batch))
+}
+
+// A spool is a file of fragments waiting to be sent, one json object
+// per line.  Fragments are taken from offset, which is kept in a file
+// beside the spool so that a restart doesn't send them again, and the
+// spool is rewritten without them once they are most of it.
+type spool struct {
+	path   string
+	count  int   // fragments waiting
+	offset int64 // where the first waiting fragment starts
+	size   int64
+}
+
+// spoolCompact is how much of a spool must have been taken before it
+// is rewritten
+const spoolCompact = 1 << 20
+
+func openSpool(path string) (*spool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	s := &spool{path: path}
+	if data, err := ioutil.ReadFile(s.offsetPath()); err == nil {
+		s.offset, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if s.offset < 0 || s.offset > info.Size() {
+		s.offset = 0
+	}
+	if _, err := file.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Count what is waiting, and cut off a line left partly written by
+	// a crash so that the next append starts a line of its own
+	s.size = s.offset
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.size += int64(len(line))
+		var f Fragment
+		if json.Unmarshal(line, &f) == nil {
+			s.count++
+		}
+	}
+	if s.size < info.Size() {
+		if err := file.Truncate(s.size); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *spool) offsetPath() string {
+	return s.path + ".offset"
+}
+
+func (s *spool) append(frags []Fragment) error {
+	var buf bytes.Buffer
+	for _, f := range frags {
+		data, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(buf.Bytes(), s.size); err != nil {
+		// Don't leave part of a line for the next append to run on to
+		file.Truncate(s.size)
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	s.size += int64(buf.Len())
+	s.count += len(frags)
+	return nil
+}
+
+// take removes up to n fragments from the front of the spool.  Lines
+// that can't be decoded are skipped.  The fragments are returned even
+// if the spool can't be emptied or rewritten afterwards.
+func (s *spool) take(n int) ([]Fragment, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var result []Fragment
+	offset := s.offset
+	r := bufio.NewReader(file)
+	for len(result) < n && offset < s.size {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		offset += int64(len(line))
+		var f Fragment
+		if json.Unmarshal(line, &f) == nil {
+			result = append(result, f)
+		}
+	}
+	if err := s.setOffset(offset); err != nil {
+		return nil, err
+	}
+	s.count -= len(result)
+	if offset >= s.size {
+		s.count = 0
+		return result, s.empty()
+	}
+	if offset >= spoolCompact && offset > s.size/2 {
+		return result, s.compact(file)
+	}
+	return result, nil
+}
+
+// setOffset records where the waiting fragments start
+func (s *spool) setOffset(offset int64) error {
+	tmp := s.offsetPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.offsetPath()); err != nil {
+		return err
+	}
+	s.offset = offset
+	return nil
+}
+
+// empty truncates a spool that has had everything taken.  The offset
+// is cleared first, here and in compact: a crash in between sends the
+// fragments again rather than skipping ones appended later.
+func (s *spool) empty() error {
+	if err := os.Remove(s.offsetPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Truncate(s.path, 0); err != nil {
+		return err
+	}
+	s.offset, s.size = 0, 0
+	return nil
+}
+
+// quarantine renames a spool that can't be read to path.<time>.bad and
+// starts an empty one, returning how many fragments it held
+func (s *spool) quarantine() (int, error) {
+	lost := s.count
+	s.count, s.offset, s.size = 0, 0, 0
+	if err := os.Remove(s.offsetPath()); err != nil && !os.IsNotExist(err) {
+		return lost, err
+	}
+	err := os.Rename(s.path, fmt.Sprintf("%s.%d.bad", s.path, time.Now().UnixNano()))
+	if err != nil && !os.IsNotExist(err) {
+		// Appends start from the beginning again either way
+		if terr := os.Truncate(s.path, 0); terr != nil {
+			return lost, err
+		}
+	}
+	return lost, nil
+}
+
+// compact rewrites the spool without what has been taken, reading the
+// rest from file
+func (s *spool) compact(file *os.File) error {
+	if _, err := file.Seek(s.offset, io.SeekStart); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, io.LimitReader(file, s.size-s.offset))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Remove(s.offsetPath()); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		s.setOffset(s.offset)
+		return err
+	}
+	s.offset, s.size = 0, n
+	return nil
+}
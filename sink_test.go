@@ -0,0 +1,246 @@
+package rainforestCommon
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A testSink records what is written to it and fails while down is set
+type testSink struct {
+	mu      sync.Mutex
+	batches [][]Fragment
+	down    bool
+	closed  bool
+}
+
+func (s *testSink) Write(ctx context.Context, frags []Fragment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errors.New("down")
+	}
+	s.batches = append(s.batches, frags)
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func (s *testSink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, b := range s.batches {
+		n += len(b)
+	}
+	return n
+}
+
+func testFragments(n int) []Fragment {
+	var result []Fragment
+	for i := 0; i < n; i++ {
+		result = append(result, Fragment{Name: "InstantaneousDemand", Time: targetTimeU.Add(time.Duration(i) * time.Second), Packet: InstantaneousDemand{}})
+	}
+	return result
+}
+
+func TestBufferedSinkBatches(t *testing.T) {
+	s := &testSink{}
+	b, _ := NewBufferedSink(s, BufferOptions{BatchSize: 4, BatchDelay: time.Hour})
+	b.Write(context.Background(), testFragments(10))
+	b.Close()
+	if s.count() != 10 || len(s.batches) != 3 || len(s.batches[0]) != 4 {
+		t.Error("Expected 10 fragments in batches of 4 got ", len(s.batches), " batches")
+	}
+	if !s.closed {
+		t.Error("Close didn't close the sink")
+	}
+	if err := b.Write(context.Background(), testFragments(1)); err != ErrClosed {
+		t.Error("Expected ErrClosed got ", err)
+	}
+}
+
+func TestBufferedSinkRetries(t *testing.T) {
+	s := &testSink{down: true}
+	b, _ := NewBufferedSink(s, BufferOptions{MinBackoff: time.Millisecond})
+	b.Write(context.Background(), testFragments(3))
+	time.Sleep(20 * time.Millisecond)
+	s.mu.Lock()
+	s.down = false
+	s.mu.Unlock()
+	b.Close()
+	stats := b.Stats()
+	if s.count() != 3 || stats.Sent != 3 || stats.Retries == 0 {
+		t.Error("Expected 3 sent after retries got ", stats)
+	}
+}
+
+func TestBufferedSinkDropOldest(t *testing.T) {
+	s := &testSink{down: true}
+	b, _ := NewBufferedSink(s, BufferOptions{QueueSize: 5, BatchSize: 100, BatchDelay: time.Hour, MaxRetries: 1, MinBackoff: time.Millisecond})
+	b.Write(context.Background(), testFragments(8))
+	if stats := b.Stats(); stats.Dropped != 3 || stats.Queued != 5 {
+		t.Error("Expected 3 dropped and 5 queued got ", stats)
+	}
+	b.Close()
+	if stats := b.Stats(); stats.Dropped != 8 {
+		t.Error("Expected everything dropped when the sink stays down got ", stats)
+	}
+}
+
+func TestBufferedSinkSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &testSink{down: true}
+	opts := BufferOptions{QueueSize: 2, SpoolDir: dir, MinBackoff: time.Millisecond, CloseTimeout: 10 * time.Millisecond}
+	b, _ := NewBufferedSink(s, opts)
+	b.Write(context.Background(), testFragments(6))
+	b.Close()
+	if stats := b.Stats(); stats.Dropped != 0 || stats.Spooled != 6 {
+		t.Error("Expected 6 spooled got ", stats)
+	}
+
+	// A new sink picks up where the old one left off
+	s = &testSink{}
+	b, _ = NewBufferedSink(s, opts)
+	deadline := time.Now().Add(time.Second)
+	for s.count() < 6 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	b.Close()
+	if s.count() != 6 {
+		t.Fatal("Expected 6 fragments from the spool got ", s.count())
+	}
+	seen := make(map[time.Time]bool)
+	for _, batch := range s.batches {
+		for _, f := range batch {
+			seen[f.Time] = true
+		}
+	}
+	if len(seen) != 6 {
+		t.Error("Expected 6 different fragments got ", len(seen))
+	}
+}
+
+func TestSpoolTornLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spool.json")
+
+	s, _ := openSpool(path)
+	if err := s.append(testFragments(2)); err != nil {
+		t.Fatal(err)
+	}
+	// A crash part way through writing a fragment
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"name":"InstantaneousDe`)
+	file.Close()
+
+	s, err = openSpool(path)
+	if err != nil || s.count != 2 {
+		t.Fatal("Expected 2 spooled got ", s, err)
+	}
+	later := testFragments(5)[2:]
+	if err := s.append(later); err != nil {
+		t.Fatal(err)
+	}
+	frags, err := s.take(100)
+	if err != nil || len(frags) != 5 || !frags[4].Time.Equal(later[2].Time) {
+		t.Fatal("Expected all 5 fragments got ", frags, err)
+	}
+	if s.count != 0 {
+		t.Error("Expected an empty spool got ", s.count)
+	}
+}
+
+func TestSpoolOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spool.json")
+
+	s, _ := openSpool(path)
+	all := testFragments(30000)
+	if err := s.append(all); err != nil {
+		t.Fatal(err)
+	}
+	if frags, err := s.take(10); err != nil || len(frags) != 10 {
+		t.Fatal("Expected 10 fragments got ", len(frags), err)
+	}
+
+	// A restart carries on from what was taken
+	s, _ = openSpool(path)
+	if s.count != 29990 {
+		t.Fatal("Expected 29990 spooled got ", s.count)
+	}
+	before, _ := os.Stat(path)
+	if frags, _ := s.take(20000); len(frags) != 20000 || !frags[0].Time.Equal(all[10].Time) {
+		t.Fatal("Expected 20000 fragments from the 11th got ", len(frags))
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size()/2 || s.offset != 0 {
+		t.Error("Expected the spool to be compacted got ", after.Size(), " bytes from ", before.Size())
+	}
+
+	s, _ = openSpool(path)
+	frags, _ := s.take(20000)
+	if len(frags) != 9990 || !frags[9989].Time.Equal(all[29999].Time) {
+		t.Error("Expected the last 9990 fragments got ", len(frags))
+	}
+}
+
+func TestBufferedSinkQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &testSink{down: true}
+	b, _ := NewBufferedSink(s, BufferOptions{QueueSize: 2, SpoolDir: dir, MinBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	b.Write(context.Background(), testFragments(6))
+	if stats := b.Stats(); stats.Spooled != 4 {
+		t.Fatal("Expected 4 spooled got ", stats)
+	}
+
+	// The spool is cut short behind the sink's back
+	os.Truncate(filepath.Join(dir, "spool.json"), 10)
+	s.mu.Lock()
+	s.down = false
+	s.mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for b.Stats().Quarantined == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := b.Stats(); stats.Quarantined != 4 || stats.Spooled != 0 {
+		t.Fatal("Expected 4 quarantined got ", stats)
+	}
+	bad, _ := filepath.Glob(filepath.Join(dir, "spool.json.*.bad"))
+	if len(bad) != 1 {
+		t.Error("Expected the spool to be moved aside got ", bad)
+	}
+
+	// Later fragments still get through
+	b.Write(context.Background(), testFragments(2))
+	b.Close()
+	if s.count() != 4 {
+		t.Error("Expected 4 fragments sent got ", s.count())
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A FileStore keeps fragments on disk as json, one file per meter per
+// day: Dir/<meter>/<yyyy-mm-dd>.json.  Fragments that don't name a
+// meter are filed under their device, and fragments without a
+// timestamp under the day they were written.
+type FileStore struct {
+	Dir string
+
+	mu sync.Mutex
+}
+
+// Write appends frags to the store
+func (s *FileStore) Write(ctx context.Context, frags []Fragment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, frag := range frags {
+		path := s.path(frag)
+		file := files[path]
+		if file == nil {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			var err error
+			file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return err
+			}
+			files[path] = file
+		}
+		data, err := json.Marshal(frag)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	for path, f := range files {
+		delete(files, path)
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close does nothing; files are closed after every Write
+func (s *FileStore) Close() error {
+	return nil
+}
+
+func (s *FileStore) path(f Fragment) string {
+	source := NormalizeMac(f.MeterMacId)
+	if source == "" {
+		source = NormalizeMac(f.DeviceMacId)
+	}
+	if source == "" {
+		source = "unknown"
+	}
+	t := f.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return filepath.Join(s.Dir, source, t.UTC().Format("2006-01-02")+".json")
+}
+
+// Meters returns the meters (or devices) the store has fragments for
+func (s *FileStore) Meters() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result []string
+	for _, e := range entries {
+		if e.IsDir() {
+			result = append(result, e.Name())
+		}
+	}
+	return result, nil
+}
+
+// Read returns the fragments for a meter with timestamps in
+// [since, until) that pass filter, in time order
+func (s *FileStore) Read(meter string, since, until time.Time, filter Filter) ([]Fragment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []Fragment
+	dir := filepath.Join(s.Dir, NormalizeMac(meter))
+	for day := since.UTC().Truncate(24 * time.Hour); day.Before(until); day = day.Add(24 * time.Hour) {
+		file, err := os.Open(filepath.Join(dir, day.Format("2006-01-02")+".json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var f Fragment
+			if err := json.Unmarshal(scanner.Bytes(), &f); err != nil {
+				file.Close()
+				return nil, err
+			}
+			if f.Time.Before(since) || !f.Time.Before(until) || !filter.Match(f) {
+				continue
+			}
+			result = append(result, f)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+	return result, nil
+}
@@ -0,0 +1,42 @@
+package rainforestCommon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	frags, _ := DecodeAll(strings.NewReader(uploaderPost + ravenStream))
+	s := &FileStore{Dir: dir}
+	if err := s.Write(context.Background(), frags); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Read("0x00135001000056AB", targetTimeU, targetTimeU.Add(time.Second), Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Name != "InstantaneousDemand" || got[1].Name != "PriceCluster" {
+		t.Error("Expected demand and price got ", got)
+	}
+
+	got, _ = s.Read("0x00135001000056ab", targetTimeU, targetTimeU.Add(time.Second), Filter{Names: []string{"PriceCluster"}})
+	if len(got) != 1 {
+		t.Error("Expected 1 price got ", len(got))
+	}
+
+	meters, _ := s.Meters()
+	if len(meters) != 2 {
+		t.Error("Expected a meter and a device got ", meters)
+	}
+}
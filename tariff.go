@@ -0,0 +1,296 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A TariffTier prices a block of a month's energy: the kWh up to UpTo,
+// after the tiers before it.  The last tier's UpTo is ignored.
+type TariffTier struct {
+	UpTo float64 `json:"upTo"`
+	Rate float64 `json:"rate"`
+}
+
+// A TariffPeriod is a time of use period, such as on peak: energy used
+// in its Windows, on weekdays unless Weekends is set and in Months if
+// any are given, costs Rate
+type TariffPeriod struct {
+	Name     string   `json:"name"`
+	Windows  []Window `json:"windows"`
+	Weekends bool     `json:"weekends,omitempty"`
+	Months   []int    `json:"months,omitempty"`
+	Rate     float64  `json:"rate"`
+}
+
+// Contains reports whether t, in its own location, is in the period
+func (p TariffPeriod) Contains(t time.Time) bool {
+	if len(p.Months) > 0 {
+		in := false
+		for _, m := range p.Months {
+			in = in || time.Month(m) == t.Month()
+		}
+		if !in {
+			return false
+		}
+	}
+	return inWindows(t, p.Windows, p.Weekends)
+}
+
+// A Tariff is a rate plan.  Energy in one of Periods costs that
+// period's rate; the rest is priced by Tiers, on the month's total, or
+// if there are none at Rate.  Demand is charged per kW of the month's
+// highest demand, measured over the interval data's intervals and, if
+// DemandWindows are given, only within them on weekdays.  Fixed is
+// charged each month.
+//
+// Flat, tiered, time of use and demand plans, and mixes of them, are
+// all Tariffs.
+type Tariff struct {
+	Name          string         `json:"name"`
+	Fixed         float64        `json:"fixed,omitempty"`
+	Rate          float64        `json:"rate,omitempty"`
+	Tiers         []TariffTier   `json:"tiers,omitempty"`
+	Periods       []TariffPeriod `json:"periods,omitempty"`
+	Demand        float64        `json:"demand,omitempty"` // per kW
+	DemandWindows []Window       `json:"demandWindows,omitempty"`
+}
+
+// ReadTariffs reads a json array of tariffs
+func ReadTariffs(r io.Reader) ([]Tariff, error) {
+	var tariffs []Tariff
+	if err := json.NewDecoder(r).Decode(&tariffs); err != nil {
+		return nil, err
+	}
+	for _, t := range tariffs {
+		if t.Name == "" {
+			return nil, fmt.Errorf("Tariff with no name")
+		}
+	}
+	return tariffs, nil
+}
+
+// A TariffMonth is what a month cost on a tariff.  Use is the month's
+// kWh and cost by what they were priced as: a period's name, a tier
+// such as "tier 2", or "flat".
+type TariffMonth struct {
+	Month  string             `json:"month"`
+	KWh    float64            `json:"kWh"`
+	PeakKW float64            `json:"peakKW"`
+	Energy float64            `json:"energy"`
+	Demand float64            `json:"demand"`
+	Fixed  float64            `json:"fixed"`
+	Total  float64            `json:"total"`
+	Use    map[string]float64 `json:"use"`
+	Cost   map[string]float64 `json:"cost"`
+}
+
+// A TariffCost is what the interval data would have cost on a tariff.
+// Difference is how much more than the cheapest tariff it is, and
+// Explanation says why.
+type TariffCost struct {
+	Tariff      string        `json:"tariff"`
+	Rank        int           `json:"rank"`
+	Energy      float64       `json:"energy"`
+	Demand      float64       `json:"demand"`
+	Fixed       float64       `json:"fixed"`
+	Total       float64       `json:"total"`
+	Difference  float64       `json:"difference"`
+	Explanation string        `json:"explanation"`
+	Months      []TariffMonth `json:"months"`
+}
+
+// A TariffComparison ranks tariffs by what a meter's use would have
+// cost on each, cheapest first
+type TariffComparison struct {
+	MeterMacId  string       `json:"meterMacId"`
+	Start       time.Time    `json:"start"`
+	End         time.Time    `json:"end"`
+	KWh         float64      `json:"kWh"`
+	Recommended string       `json:"recommended"`
+	Tariffs     []TariffCost `json:"tariffs"`
+}
+
+// CompareTariffs prices each meter's interval data, from ProfileData
+// or its summations and HistoryData, on each tariff.  Months and
+// windows are in loc, which is UTC if nil.
+func CompareTariffs(frags []Fragment, tariffs []Tariff, loc *time.Location) []TariffComparison {
+	if loc == nil {
+		loc = time.UTC
+	}
+	var comparisons []TariffComparison
+	for meter, intervals := range UsageIntervals(frags) {
+		if len(intervals) == 0 {
+			continue
+		}
+		last := intervals[len(intervals)-1]
+		c := TariffComparison{MeterMacId: meter, Start: intervals[0].Start, End: last.Start.Add(last.Period)}
+		for _, e := range intervals {
+			c.KWh += e.KWh
+		}
+		for _, t := range tariffs {
+			c.Tariffs = append(c.Tariffs, t.Cost(intervals, loc))
+		}
+		sort.SliceStable(c.Tariffs, func(i, j int) bool { return c.Tariffs[i].Total < c.Tariffs[j].Total })
+		if len(c.Tariffs) > 0 {
+			best := c.Tariffs[0]
+			c.Recommended = best.Tariff
+			for i := range c.Tariffs {
+				t := &c.Tariffs[i]
+				t.Rank = i + 1
+				t.Difference = t.Total - best.Total
+				t.Explanation = explainTariff(*t, best)
+			}
+		}
+		comparisons = append(comparisons, c)
+	}
+	sort.Slice(comparisons, func(i, j int) bool { return comparisons[i].MeterMacId < comparisons[j].MeterMacId })
+	return comparisons
+}
+
+// RateAt returns the price per kWh of energy used at t, in its own
+// location: the rate of the period t is in, or the first tier's rate,
+// or Rate
+func (t Tariff) RateAt(at time.Time) float64 {
+	for _, p := range t.Periods {
+		if p.Contains(at) {
+			return p.Rate
+		}
+	}
+	if len(t.Tiers) > 0 {
+		return t.Tiers[0].Rate
+	}
+	return t.Rate
+}
+
+// Cost prices intervals, which are in time order, on the tariff
+func (t Tariff) Cost(intervals []EnergyInterval, loc *time.Location) TariffCost {
+	c := TariffCost{Tariff: t.Name}
+	var m *TariffMonth
+	var tiered float64 // the month's kWh priced by tier so far
+	for _, e := range intervals {
+		start := e.Start.In(loc)
+		month := start.Format("2006-01")
+		if m == nil || m.Month != month {
+			c.Months = append(c.Months, TariffMonth{Month: month, Fixed: t.Fixed,
+				Use: make(map[string]float64), Cost: make(map[string]float64)})
+			m = &c.Months[len(c.Months)-1]
+			tiered = 0
+		}
+		m.KWh += e.KWh
+		charge := func(name string, kwh, rate float64) {
+			m.Use[name] += kwh
+			m.Cost[name] += kwh * rate
+			m.Energy += kwh * rate
+		}
+
+		if e.Period > 0 && (len(t.DemandWindows) == 0 || inWindows(start, t.DemandWindows, false)) {
+			m.PeakKW = math.Max(m.PeakKW, e.KWh/e.Period.Hours())
+		}
+
+		priced := false
+		for _, p := range t.Periods {
+			if p.Contains(start) {
+				charge(p.Name, e.KWh, p.Rate)
+				priced = true
+				break
+			}
+		}
+		switch {
+		case priced:
+		case len(t.Tiers) > 0:
+			// Split the interval across the tiers it reaches
+			pos, left := tiered, e.KWh
+			for i, tier := range t.Tiers {
+				upper := tier.UpTo
+				if i == len(t.Tiers)-1 {
+					upper = math.Inf(1)
+				}
+				if pos < upper && left > 0 {
+					use := math.Min(left, upper-pos)
+					charge(fmt.Sprintf("tier %d", i+1), use, tier.Rate)
+					pos += use
+					left -= use
+				}
+			}
+			tiered += e.KWh
+		default:
+			charge("flat", e.KWh, t.Rate)
+		}
+	}
+	for i := range c.Months {
+		m := &c.Months[i]
+		m.Demand = m.PeakKW * t.Demand
+		m.Total = m.Energy + m.Demand + m.Fixed
+		c.Energy += m.Energy
+		c.Demand += m.Demand
+		c.Fixed += m.Fixed
+		c.Total += m.Total
+	}
+	return c
+}
+
+// explainTariff says what makes t cost more than best, the cheapest
+func explainTariff(t, best TariffCost) string {
+	if t.Tariff == best.Tariff {
+		return fmt.Sprintf("cheapest, %.2f in total", t.Total)
+	}
+	var parts []string
+	for _, d := range []struct {
+		what string
+		t, b float64
+	}{
+		{"energy", t.Energy, best.Energy},
+		{"demand charges", t.Demand, best.Demand},
+		{"fixed charges", t.Fixed, best.Fixed},
+	} {
+		if diff := d.t - d.b; math.Abs(diff) >= 0.005 {
+			more := "more"
+			if diff < 0 {
+				more = "less"
+			}
+			parts = append(parts, fmt.Sprintf("%.2f %s for %s", math.Abs(diff), more, d.what))
+		}
+	}
+	s := fmt.Sprintf("%.2f more than %s", t.Difference, best.Tariff)
+	if len(parts) > 0 {
+		s += ": " + strings.Join(parts, ", ")
+	}
+
+	// What drove the cost: the priciest use, and the highest demand
+	// if it was charged for
+	use, cost := make(map[string]float64), make(map[string]float64)
+	var peak float64
+	var peakMonth string
+	for _, m := range t.Months {
+		for k, v := range m.Use {
+			use[k] += v
+			cost[k] += m.Cost[k]
+		}
+		if m.Demand > 0 && m.PeakKW > peak {
+			peak, peakMonth = m.PeakKW, m.Month
+		}
+	}
+	top := ""
+	for k := range cost {
+		if top == "" || cost[k] > cost[top] || cost[k] == cost[top] && k < top {
+			top = k
+		}
+	}
+	if top != "" {
+		s += fmt.Sprintf("; most of the energy cost was %.0f kWh at the %s rate, %.2f", use[top], top, cost[top])
+	}
+	if peakMonth != "" {
+		s += fmt.Sprintf("; the highest demand was %.1f kW in %s", peak, peakMonth)
+	}
+	return s
+}
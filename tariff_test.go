@@ -0,0 +1,55 @@
+package rainforestCommon
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const tariffs = `[
+	{"name": "flat", "rate": 0.15},
+	{"name": "tiered", "tiers": [{"upTo": 500, "rate": 0.10}, {"rate": 0.20}]},
+	{"name": "time of use", "rate": 0.08, "periods": [{"name": "peak", "windows": ["17:00-21:00"], "rate": 0.40}]},
+	{"name": "demand", "rate": 0.10, "demand": 5}
+]`
+
+func TestCompareTariffs(t *testing.T) {
+	// June 2015: 1 kWh an hour, 3 from 17:00 to 21:00 on weekdays
+	start := time.Date(2015, time.June, 1, 0, 0, 0, 0, time.UTC)
+	frags := summationsOf(start, 30*24, func(t time.Time) float64 {
+		if t.Weekday() != time.Saturday && t.Weekday() != time.Sunday && t.Hour() >= 17 && t.Hour() < 21 {
+			return 3
+		}
+		return 1
+	})
+	plans, err := ReadTariffs(strings.NewReader(tariffs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := CompareTariffs(frags, plans, nil)
+	if len(c) != 1 || math.Abs(c[0].KWh-896) > 1e-6 {
+		t.Fatal("Expected 896 kWh got ", c)
+	}
+	want := []struct {
+		name  string
+		total float64
+	}{{"demand", 104.6}, {"tiered", 129.2}, {"flat", 134.4}, {"time of use", 156.16}}
+	for i, w := range want {
+		got := c[0].Tariffs[i]
+		if got.Tariff != w.name || got.Rank != i+1 || math.Abs(got.Total-w.total) > 1e-6 {
+			t.Error("Expected ", w, " got ", got.Tariff, " ", got.Total)
+		}
+	}
+	if c[0].Recommended != "demand" {
+		t.Error("Expected demand recommended got ", c[0].Recommended)
+	}
+	tou := c[0].Tariffs[3]
+	if len(tou.Months) != 1 || math.Abs(tou.Months[0].Use["peak"]-264) > 1e-6 {
+		t.Error("Expected 264 kWh on peak got ", tou.Months)
+	}
+	if !strings.Contains(tou.Explanation, "at the peak rate") {
+		t.Error("Expected the peak use to be explained got ", tou.Explanation)
+	}
+}
@@ -10,17 +10,22 @@ import (
 )
 
 type LocalCommand struct {
-	XMLName   xml.Name `xml:"LocalCommand"`
+	XMLName   xml.Name `xml:"LocalCommand" json:"-"`
 	Name      string   `xml:"Name"`
-	MacId     string
-	StartTime string
-	EndTime   string
-	Frequency string
+	MacId     string   `xml:",omitempty"`
+	StartTime string   `xml:",omitempty"`
+	EndTime   string   `xml:",omitempty"`
+	Frequency string   `xml:",omitempty"`
+	Duration  string   `xml:",omitempty"`
+	Id        string   `xml:",omitempty"`
 }
 
 // All the different packets that might be sent from the eagle
 type Root struct {
-	XMLName     xml.Name `xml:"rainforest"`
+	XMLName     xml.Name `xml:"rainforest" json:"-"`
+	MacId       string   `xml:"macId,attr"`
+	Version     string   `xml:"version,attr"`
+	Timestamp   string   `xml:"timestamp,attr"`
 	Current     CurrentSummationDelivered
 	Device      DeviceInfo
 	Demand      InstantaneousDemand
@@ -38,7 +43,7 @@ type Root struct {
 
 // Not in uploader API manual
 type BlockPriceDetail struct {
-	XMLName                          xml.Name `xml:"BlockPriceDetail"`
+	XMLName                          xml.Name `xml:"BlockPriceDetail" json:"-"`
 	DeviceMacId                      string
 	MeterMacId                       string
 	TimeStamp                        string
@@ -56,12 +61,12 @@ type BlockPriceDetail struct {
 }
 
 type HistoryData struct {
-	XMLName       xml.Name           `xml:"HistoryData"`
+	XMLName       xml.Name           `xml:"HistoryData" json:"-"`
 	SummationList []CurrentSummation `xml:"CurrentSummation"`
 }
 
 type CurrentSummation struct {
-	XMLName             xml.Name `xml:"CurrentSummation"`
+	XMLName             xml.Name `xml:"CurrentSummation" json:"-"`
 	DeviceMacId         string
 	MeterMacId          string
 	TimeStamp           string
@@ -76,7 +81,7 @@ type CurrentSummation struct {
 }
 
 type CurrentSummationDelivered struct {
-	XMLName             xml.Name `xml:"CurrentSummationDelivered"`
+	XMLName             xml.Name `xml:"CurrentSummationDelivered" json:"-"`
 	DeviceMacId         string
 	MeterMacId          string
 	TimeStamp           string
@@ -91,7 +96,7 @@ type CurrentSummationDelivered struct {
 }
 
 type DeviceInfo struct {
-	XMLName      xml.Name `xml:"DeviceInfo"`
+	XMLName      xml.Name `xml:"DeviceInfo" json:"-"`
 	DeviceMacId  string
 	InstallCode  string
 	LinkKey      string
@@ -105,7 +110,7 @@ type DeviceInfo struct {
 }
 
 type FastPollStatus struct {
-	XMLName     xml.Name `xml:"FastPollStatus"`
+	XMLName     xml.Name `xml:"FastPollStatus" json:"-"`
 	DeviceMacId string
 	MeterMacId  string
 	Frequency   string
@@ -114,7 +119,7 @@ type FastPollStatus struct {
 }
 
 type InstantaneousDemand struct {
-	XMLName             xml.Name `xml:"InstantaneousDemand"`
+	XMLName             xml.Name `xml:"InstantaneousDemand" json:"-"`
 	DeviceMacId         string
 	MeterMacId          string
 	TimeStamp           string
@@ -128,7 +133,7 @@ type InstantaneousDemand struct {
 }
 
 type MessageCluster struct {
-	XMLName              xml.Name `xml:"MessageCluster"`
+	XMLName              xml.Name `xml:"MessageCluster" json:"-"`
 	DeviceMacId          string
 	MeterMacId           string
 	TimeStamp            string
@@ -144,7 +149,7 @@ type MessageCluster struct {
 }
 
 type MeterInfo struct {
-	XMLName     xml.Name `xml:"MeterInfo"`
+	XMLName     xml.Name `xml:"MeterInfo" json:"-"`
 	DeviceMacId string
 	MeterMacId  string
 	Type        string
@@ -156,7 +161,7 @@ type MeterInfo struct {
 }
 
 type NetworkInfo struct {
-	XMLName      xml.Name `xml:"NetworkInfo"`
+	XMLName      xml.Name `xml:"NetworkInfo" json:"-"`
 	DeviceMacId  string
 	CoordMacId   string
 	Status       string
@@ -169,7 +174,7 @@ type NetworkInfo struct {
 }
 
 type PriceCluster struct {
-	XMLName        xml.Name `xml:"PriceCluster"`
+	XMLName        xml.Name `xml:"PriceCluster" json:"-"`
 	DeviceMacId    string
 	MeterMacId     string
 	TimeStamp      string
@@ -184,7 +189,7 @@ type PriceCluster struct {
 }
 
 type ProfileData struct {
-	XMLName                  xml.Name `xml:"ProfileData"`
+	XMLName                  xml.Name `xml:"ProfileData" json:"-"`
 	DeviceMacId              string
 	MeterMacId               string
 	EndTime                  string
@@ -208,7 +213,7 @@ type ProfileData struct {
 
 // Not in uploader API manual
 type ScheduleInfo struct {
-	XMLName     xml.Name `xml:"ScheduleInfo"`
+	XMLName     xml.Name `xml:"ScheduleInfo" json:"-"`
 	DeviceMacId string
 	MeterMacId  string
 	Event       string
@@ -218,7 +223,7 @@ type ScheduleInfo struct {
 
 // Not in uploader API manual
 type TimeCluster struct {
-	XMLName     xml.Name `xml:"TimeCluster"`
+	XMLName     xml.Name `xml:"TimeCluster" json:"-"`
 	DeviceMacId string
 	MeterMacId  string
 	UTCTime     string
@@ -0,0 +1,53 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"io"
+	"net/http"
+)
+
+// An Uploader accepts the posts the eagle makes to a cloud uploader
+// url and passes the fragments they contain to Fragments.  Point the
+// eagle's custom uploader setting at the address the Uploader is served
+// on.
+type Uploader struct {
+	Fragments chan Fragment
+
+	// Errors, if not nil, is called with posts that can't be decoded
+	Errors func(error)
+}
+
+// NewUploader returns an Uploader whose Fragments channel holds up to
+// buffer fragments
+func NewUploader(buffer int) *Uploader {
+	return &Uploader{Fragments: make(chan Fragment, buffer)}
+}
+
+// The largest post we will read
+const maxUpload = 1 << 20
+
+func (u *Uploader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	frags, err := DecodeAll(io.LimitReader(r.Body, maxUpload))
+	if err != nil {
+		if u.Errors != nil {
+			u.Errors(err)
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, f := range frags {
+		select {
+		case u.Fragments <- f:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,211 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Weather is the mean outdoor temperature of each day, keyed by date,
+// e.g. 2015-03-14.  The scale, Celsius or Fahrenheit, is whatever the
+// base temperature used with it is in.
+type Weather map[string]float64
+
+// ReadWeather reads a csv of date,temperature or date,min,max with an
+// optional header row.  The mean of min and max is taken as the day's
+// temperature.
+func ReadWeather(r io.Reader) (Weather, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	w := make(Weather)
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return w, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("Weather line %d: want date,temperature", line)
+		}
+		date, err := time.Parse("2006-01-02", strings.TrimSpace(record[0]))
+		if err != nil {
+			if line == 1 {
+				continue // header
+			}
+			return nil, fmt.Errorf("Weather line %d: %v", line, err)
+		}
+		var sum float64
+		for _, s := range record[1:] {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Weather line %d: %v", line, err)
+			}
+			sum += v
+		}
+		w[date.Format("2006-01-02")] = sum / float64(len(record)-1)
+	}
+}
+
+// DegreeDays returns the heating and cooling degree days of date from
+// base, or false if the day's temperature isn't known
+func (w Weather) DegreeDays(date string, base float64) (hdd, cdd float64, ok bool) {
+	t, ok := w[date]
+	if !ok {
+		return 0, 0, false
+	}
+	return math.Max(base-t, 0), math.Max(t-base, 0), true
+}
+
+// A DailyUse is a meter's energy use on Date
+type DailyUse struct {
+	Date string  `json:"date"`
+	KWh  float64 `json:"kWh"`
+}
+
+// A DegreeDayModel explains daily use as a base load plus a part that
+// rises with heating and with cooling degree days:
+//
+//	kWh = Intercept + Heating*HDD + Cooling*CDD
+//
+// Sigma is the standard deviation of the days it was fitted to around
+// it, and R2 the fraction of their variance it explains.
+type DegreeDayModel struct {
+	Base      float64 `json:"base"`
+	Intercept float64 `json:"intercept"` // kWh a day
+	Heating   float64 `json:"heating"`   // kWh per degree day
+	Cooling   float64 `json:"cooling"`
+	Sigma     float64 `json:"sigma"`
+	R2        float64 `json:"r2"`
+	Days      int     `json:"days"`
+}
+
+// Predict returns the daily use the model expects for the given degree
+// days
+func (m DegreeDayModel) Predict(hdd, cdd float64) float64 {
+	return m.Intercept + m.Heating*hdd + m.Cooling*cdd
+}
+
+// PredictDate returns the daily use the model expects on date, or
+// false if its temperature isn't known
+func (m DegreeDayModel) PredictDate(w Weather, date string) (float64, bool) {
+	hdd, cdd, ok := w.DegreeDays(date, m.Base)
+	if !ok {
+		return 0, false
+	}
+	return m.Predict(hdd, cdd), true
+}
+
+// FitDegreeDays fits a model to the days of use with known weather, by
+// least squares.  A term with no degree days, like cooling in winter,
+// is left at zero.  At least 7 days are needed.
+func FitDegreeDays(days []DailyUse, w Weather, base float64) (DegreeDayModel, error) {
+	m := DegreeDayModel{Base: base}
+	var x [][3]float64
+	var y []float64
+	for _, d := range days {
+		hdd, cdd, ok := w.DegreeDays(d.Date, base)
+		if !ok {
+			continue
+		}
+		x = append(x, [3]float64{1, hdd, cdd})
+		y = append(y, d.KWh)
+	}
+	m.Days = len(y)
+	if m.Days < 7 {
+		return m, fmt.Errorf("Only %d days with weather, need 7", m.Days)
+	}
+
+	// Keep the terms that vary
+	use := []int{0}
+	for j := 1; j < 3; j++ {
+		for i := range x {
+			if x[i][j] != x[0][j] {
+				use = append(use, j)
+				break
+			}
+		}
+	}
+	n := len(use)
+	a := make([][]float64, n)
+	for r := range a {
+		a[r] = make([]float64, n+1)
+		for c := 0; c < n; c++ {
+			for i := range x {
+				a[r][c] += x[i][use[r]] * x[i][use[c]]
+			}
+		}
+		for i := range x {
+			a[r][n] += x[i][use[r]] * y[i]
+		}
+	}
+	coef, err := solve(a)
+	if err != nil {
+		return m, err
+	}
+	var beta [3]float64
+	for k, j := range use {
+		beta[j] = coef[k]
+	}
+	m.Intercept, m.Heating, m.Cooling = beta[0], beta[1], beta[2]
+
+	var mean, ss, sr float64
+	for _, v := range y {
+		mean += v
+	}
+	mean /= float64(len(y))
+	for i, v := range y {
+		r := v - m.Predict(x[i][1], x[i][2])
+		sr += r * r
+		ss += (v - mean) * (v - mean)
+	}
+	if ss > 0 {
+		m.R2 = 1 - sr/ss
+	}
+	if dof := len(y) - n; dof > 0 {
+		m.Sigma = math.Sqrt(sr / float64(dof))
+	}
+	return m, nil
+}
+
+// solve solves the augmented system a by gaussian elimination
+func solve(a [][]float64) ([]float64, error) {
+	n := len(a)
+	for c := 0; c < n; c++ {
+		p := c
+		for r := c + 1; r < n; r++ {
+			if math.Abs(a[r][c]) > math.Abs(a[p][c]) {
+				p = r
+			}
+		}
+		if math.Abs(a[p][c]) < 1e-12 {
+			return nil, fmt.Errorf("Degree days don't vary enough to fit")
+		}
+		a[c], a[p] = a[p], a[c]
+		for r := c + 1; r < n; r++ {
+			k := a[r][c] / a[c][c]
+			for j := c; j <= n; j++ {
+				a[r][j] -= k * a[c][j]
+			}
+		}
+	}
+	x := make([]float64, n)
+	for r := n - 1; r >= 0; r-- {
+		x[r] = a[r][n]
+		for c := r + 1; c < n; c++ {
+			x[r] -= a[r][c] * x[c]
+		}
+		x[r] /= a[r][r]
+	}
+	return x, nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2016 Tom Messick. All rights reserved.
+// Use of this source code is governed by a license
+// that can be found in the LICENSE file.
+
+package rainforestCommon
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of a webhook body, as
+// "sha256=" followed by the hex digest
+const SignatureHeader = "X-Rainforest-Signature"
+
+// A WebhookPayload is the json body a Webhook posts.  Type is
+// "fragments" or "alert".
+type WebhookPayload struct {
+	Type      string     `json:"type"`
+	Sent      time.Time  `json:"sent"`
+	Fragments []Fragment `json:"fragments,omitempty"`
+	Alert     *Alert     `json:"alert,omitempty"`
+}
+
+// A Webhook posts fragments and alerts to a url as json.  It is both a
+// Sink and a Notifier.  Failed posts are retried with exponential
+// backoff; posts that still fail are appended to DeadLetter, if set.
+type Webhook struct {
+	URL string
+
+	// Secret, if set, signs each body; see SignatureHeader
+	Secret string
+
+	// DeadLetter is a file to keep payloads that couldn't be
+	// delivered, one json object per line
+	DeadLetter string
+
+	MaxAttempts int           // posts before giving up, 5
+	MinBackoff  time.Duration // first wait after a failure, 1s
+	MaxBackoff  time.Duration // longest wait between attempts, 1m
+
+	// Client is used to make requests, or http.DefaultClient if nil
+	Client *http.Client
+
+	mu sync.Mutex // serializes writes to DeadLetter
+}
+
+// Write posts frags
+func (h *Webhook) Write(ctx context.Context, frags []Fragment) error {
+	return h.deliver(ctx, WebhookPayload{Type: "fragments", Sent: time.Now().UTC(), Fragments: frags})
+}
+
+// Notify posts an alert
+func (h *Webhook) Notify(ctx context.Context, a Alert) error {
+	return h.deliver(ctx, WebhookPayload{Type: "alert", Sent: time.Now().UTC(), Alert: &a})
+}
+
+// Close does nothing
+func (h *Webhook) Close() error {
+	return nil
+}
+
+// Sign returns the signature header value for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature reports whether signature, the value of the
+// SignatureHeader, is correct for body
+func VerifySignature(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// A webhookError is a failed post; permanent errors aren't retried
+type webhookError struct {
+	err       error
+	permanent bool
+}
+
+func (e *webhookError) Error() string {
+	return e.err.Error()
+}
+
+// deliver posts a payload, retrying until it is accepted or the
+// attempts run out.  A payload that is given up on is dead lettered,
+// and only reported as an error if there is no dead letter file.
+func (h *Webhook) deliver(ctx context.Context, payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	attempts := h.MaxAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	backoff := h.MinBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := h.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = h.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if e, ok := err.(*webhookError); ok && e.permanent {
+			break
+		}
+		if attempt >= attempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	if h.DeadLetter == "" {
+		return err
+	}
+	if dlErr := h.deadLetter(body, err); dlErr != nil {
+		return fmt.Errorf("%v; dead letter: %v", err, dlErr)
+	}
+	return nil
+}
+
+func (h *Webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return &webhookError{err: err, permanent: true}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if h.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(h.Secret, body))
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &webhookError{err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("webhook %s: %s %s", h.URL, resp.Status, strings.TrimSpace(string(msg)))
+	// Other than throttling, a 4xx won't get better by trying again
+	permanent := resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout
+	return &webhookError{err: err, permanent: permanent}
+}
+
+// A deadLetter is one line of the dead letter file
+type deadLetter struct {
+	URL     string          `json:"url"`
+	Failed  time.Time       `json:"failed"`
+	Error   string          `json:"error"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func (h *Webhook) deadLetter(body []byte, cause error) error {
+	line, err := json.Marshal(deadLetter{URL: h.URL, Failed: time.Now().UTC(), Error: cause.Error(), Payload: body})
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.DeadLetter, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
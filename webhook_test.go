@@ -0,0 +1,82 @@
+package rainforestCommon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var payloads []WebhookPayload
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if !VerifySignature("secret", body, r.Header.Get(SignatureHeader)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var p WebhookPayload
+		json.Unmarshal(body, &p)
+		payloads = append(payloads, p)
+	}))
+	defer srv.Close()
+
+	h := &Webhook{URL: srv.URL, Secret: "secret", MinBackoff: time.Millisecond}
+	frags, _ := DecodeAll(strings.NewReader(uploaderPost))
+	if err := h.Write(context.Background(), frags); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Notify(context.Background(), Alert{Rule: "high", State: Firing}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || len(payloads) != 2 {
+		t.Fatal("Expected a retry and 2 payloads got ", calls, " calls and ", payloads)
+	}
+	if payloads[0].Type != "fragments" || len(payloads[0].Fragments) != 1 || payloads[0].Fragments[0].String() != frags[0].String() {
+		t.Error("Expected the fragment got ", payloads[0])
+	}
+	if payloads[1].Type != "alert" || payloads[1].Alert.Rule != "high" {
+		t.Error("Expected the alert got ", payloads[1])
+	}
+
+	// A wrong secret is refused for good, so it is dead lettered at once
+	dir, _ := ioutil.TempDir("", "webhook")
+	defer os.RemoveAll(dir)
+	h = &Webhook{URL: srv.URL, Secret: "wrong", DeadLetter: filepath.Join(dir, "dead"), MinBackoff: time.Millisecond}
+	calls = 1
+	if err := h.Write(context.Background(), frags); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Error("Expected no retries got ", calls, " calls")
+	}
+	f, err := os.Open(h.DeadLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	var dl deadLetter
+	json.Unmarshal(scanner.Bytes(), &dl)
+	if dl.URL != srv.URL || !strings.Contains(dl.Error, "401") || len(dl.Payload) == 0 {
+		t.Error("Expected a dead letter got ", scanner.Text())
+	}
+}